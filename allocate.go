@@ -0,0 +1,133 @@
+package gobt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Allocation how files of a torrent take disk space
+type Allocation string
+
+// allocation modes
+const (
+	AllocateSparse  Allocation = "sparse"  // files are of full length at once, disk space is taken as written
+	AllocateFull    Allocation = "full"    // disk space of all files is reserved at once
+	AllocateCompact Allocation = "compact" // files grow as written
+)
+
+// ErrDiskFull the disk is too small for the data of a torrent
+var ErrDiskFull = errors.New("disk full")
+
+// storageAllocator a storage of files which can be allocated
+type storageAllocator interface {
+	allocate(mode Allocation, skip []bool) error // skip files not wanted, nil for none
+}
+
+// allocate allocates files in storage if they are
+func (t *Torrent) allocate() error {
+	a, ok := t.storage.(storageAllocator)
+	if !ok {
+		return nil
+	}
+	t.filesMutex.Lock()
+	defer t.filesMutex.Unlock()
+	skip := make([]bool, len(t.filePriorities))
+	for i, p := range t.filePriorities {
+		skip[i] = p == PrioritySkip
+	}
+	return a.allocate(t.allocation, skip)
+}
+
+func parseAllocation(s string) (Allocation, error) {
+	switch a := Allocation(s); a {
+	case AllocateSparse, AllocateFull, AllocateCompact:
+		return a, nil
+	case "":
+		return AllocateSparse, nil
+	}
+	return "", fmt.Errorf("unknown allocation %q", s)
+}
+
+// diskFull wraps ErrDiskFull if err is of no space left
+func diskFull(err error) error {
+	if err != nil && errors.Is(err, syscall.ENOSPC) && !errors.Is(err, ErrDiskFull) {
+		return fmt.Errorf("%w: %s", ErrDiskFull, err)
+	}
+	return err
+}
+
+// allocateFiles allocates files under root, which are created already, but not those of skip true.
+// Unless compact, it fails if free space of the disk is less than what is not allocated yet.
+func allocateFiles(root string, files []fileRange, mode Allocation, skip []bool) error {
+	if mode == AllocateCompact {
+		return nil
+	}
+	needed := int64(0)
+	for i, r := range files {
+		if skip != nil && skip[i] {
+			continue
+		}
+		st, err := os.Stat(filepath.Join(root, r.path))
+		if err != nil {
+			return err
+		}
+		if n := r.length - allocatedSize(st); n > 0 {
+			needed += n
+		}
+	}
+	if free, ok := diskFree(root); ok && needed > free {
+		return fmt.Errorf("%w: %s needs %d bytes, %d free", ErrDiskFull, root, needed, free)
+	}
+	for i, r := range files {
+		if skip != nil && skip[i] {
+			continue
+		}
+		err := allocateFile(filepath.Join(root, r.path), r.length, mode)
+		if err != nil {
+			return diskFull(err)
+		}
+	}
+	return nil
+}
+
+func allocateFile(filename string, length int64, mode Allocation) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if mode == AllocateFull && allocatedSize(st) < length {
+		return fallocate(f, length)
+	}
+	if st.Size() < length {
+		return f.Truncate(length)
+	}
+	return nil
+}
+
+// writeZeros extends f to size by writing zeros, where fallocate is not supported
+func writeZeros(f *os.File, size int64) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 1<<16)
+	for off := st.Size(); off < size; off += int64(len(zeros)) {
+		b := zeros
+		if size-off < int64(len(b)) {
+			b = b[:size-off]
+		}
+		_, err := f.WriteAt(b, off)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
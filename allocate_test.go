@@ -0,0 +1,90 @@
+package gobt
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAllocateFiles(t *testing.T) {
+	mi := testMetainfo("a", []byte("hello world"), 4)
+	for _, mode := range []Allocation{AllocateSparse, AllocateFull, AllocateCompact} {
+		root := t.TempDir()
+		s, err := NewFileStorage(mi.Info, root)
+		if err != nil {
+			t.Fatalf("new storage error: %v", err)
+		}
+		err = s.(storageAllocator).allocate(mode, nil)
+		s.Close()
+		if err != nil {
+			t.Errorf("%s: %v", mode, err)
+			continue
+		}
+		st, err := os.Stat(filepath.Join(root, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := int64(11)
+		if mode == AllocateCompact {
+			size = 0
+		}
+		if st.Size() != size {
+			t.Errorf("%s: size %d", mode, st.Size())
+		}
+		if mode == AllocateFull && allocatedSize(st) < 11 {
+			t.Errorf("full: allocated %d", allocatedSize(st))
+		}
+	}
+}
+
+func TestAllocateDiskFull(t *testing.T) {
+	root := t.TempDir()
+	if _, ok := diskFree(root); !ok {
+		t.Skip("free space not known")
+	}
+	info := &MetainfoInfo{Name: "huge", Length: 1 << 60, PieceLength: 1 << 20}
+	err := ensureFile(context.Background(), root, info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = allocateFiles(root, fileRanges(info), AllocateFull, nil)
+	if !errors.Is(err, ErrDiskFull) {
+		t.Errorf("allocate error %v", err)
+	}
+	if err := allocateFiles(root, fileRanges(info), AllocateCompact, nil); err != nil {
+		t.Errorf("compact error %v", err)
+	}
+	if err := diskFull(&os.PathError{Op: "write", Path: "a", Err: syscall.ENOSPC}); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("write error %v", err)
+	}
+}
+
+func TestAddTorrentAllocation(t *testing.T) {
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	config.Allocation = "none"
+	if _, err := NewClient(config); err == nil {
+		t.Errorf("unknown allocation accepted")
+	}
+	config.Allocation = string(AllocateSparse)
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.AddTorrent(testMetainfo("a", []byte("hello world"), 4)); err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	if _, err := c.AddTorrentWithOptions(testMetainfo("b", []byte("hello"), 4), TorrentOptions{Allocation: AllocateCompact}); err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	for name, size := range map[string]int64{"a": 11, "b": 0} {
+		st, err := os.Stat(filepath.Join(config.DownloadRoot, name))
+		if err != nil || st.Size() != size {
+			t.Errorf("%s: %v %v", name, st, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package gobt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const altSpeedCheckInterval = time.Minute
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// speedRule days and a time of day range, the range may end after midnight
+type speedRule struct {
+	days       [7]bool
+	start, end time.Duration // since midnight
+}
+
+// speedSchedule when alternative speed is on, e.g. "Mon-Fri 09:00-18:00, Sat-Sun 22:00-02:00"
+type speedSchedule []speedRule
+
+// parseSpeedSchedule parses rules separated by comma, days are optional and mean every day
+func parseSpeedSchedule(s string) (speedSchedule, error) {
+	var schedule speedSchedule
+	for _, r := range strings.Split(s, ",") {
+		fields := strings.Fields(r)
+		if len(fields) == 0 {
+			continue
+		}
+		var rule speedRule
+		days := "sun-sat"
+		switch len(fields) {
+		case 1:
+		case 2:
+			days = fields[0]
+		default:
+			return nil, fmt.Errorf("bad speed rule %q", r)
+		}
+		err := rule.parseDays(days)
+		if err != nil {
+			return nil, err
+		}
+		err = rule.parseTimes(fields[len(fields)-1])
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, rule)
+	}
+	return schedule, nil
+}
+
+func (r *speedRule) parseDays(s string) error {
+	parts := strings.SplitN(strings.ToLower(s), "-", 2)
+	first, ok := weekdays[parts[0]]
+	if !ok {
+		return fmt.Errorf("bad weekday %q", parts[0])
+	}
+	last := first
+	if len(parts) == 2 {
+		last, ok = weekdays[parts[1]]
+		if !ok {
+			return fmt.Errorf("bad weekday %q", parts[1])
+		}
+	}
+	for d := first; ; d = (d + 1) % 7 {
+		r.days[d] = true
+		if d == last {
+			return nil
+		}
+	}
+}
+
+func (r *speedRule) parseTimes(s string) error {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad time range %q", s)
+	}
+	var err error
+	r.start, err = parseTimeOfDay(parts[0])
+	if err != nil {
+		return err
+	}
+	r.end, err = parseTimeOfDay(parts[1])
+	return err
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active tells if alternative speed is on at t
+func (s speedSchedule) active(t time.Time) bool {
+	day := t.Weekday()
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	for _, r := range s {
+		if r.start <= r.end {
+			if r.days[day] && tod >= r.start && tod < r.end {
+				return true
+			}
+			continue
+		}
+		// after midnight belongs to the day before
+		if r.days[day] && tod >= r.start || r.days[(day+6)%7] && tod < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// runAltSpeed switches rates by the schedule until ctx done
+func (c *Client) runAltSpeed(ctx context.Context) {
+	ticker := time.NewTicker(altSpeedCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.applyAltSpeed(time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Client) applyAltSpeed(now time.Time) {
+	c.altMutex.Lock()
+	defer c.altMutex.Unlock()
+	active := c.altSchedule.active(now)
+	if active == c.altActive {
+		return
+	}
+	c.altActive = active
+	if active {
+		c.config.logf("alternative speed on")
+		c.limiters.set(c.config.AltUploadRate, c.config.AltDownloadRate)
+	} else {
+		c.config.logf("alternative speed off")
+		c.limiters.set(c.config.UploadRate, c.config.DownloadRate)
+	}
+}
+
+// AltSpeedActive tells if the alternative speed is in use now
+func (c *Client) AltSpeedActive() bool {
+	c.altMutex.Lock()
+	defer c.altMutex.Unlock()
+	return c.altActive
+}
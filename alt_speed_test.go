@@ -0,0 +1,72 @@
+package gobt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpeedSchedule(t *testing.T) {
+	s, err := parseSpeedSchedule("Mon-Fri 09:00-18:00, Sat-Sun 22:00-02:00")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	// 2024-01-01 is a Monday
+	tests := []struct {
+		time   string
+		active bool
+	}{
+		{"2024-01-01 09:00", true},
+		{"2024-01-01 08:59", false},
+		{"2024-01-05 17:59", true},
+		{"2024-01-01 18:00", false},
+		{"2024-01-06 12:00", false},
+		{"2024-01-06 23:00", true},
+		{"2024-01-07 01:00", true}, // Saturday night
+		{"2024-01-08 01:00", true}, // Sunday night
+		{"2024-01-06 01:00", false},
+		{"2024-01-08 02:00", false},
+	}
+	for _, tt := range tests {
+		tm, _ := time.ParseInLocation("2006-01-02 15:04", tt.time, time.Local)
+		if s.active(tm) != tt.active {
+			t.Errorf("%s active %v", tt.time, !tt.active)
+		}
+	}
+
+	every, err := parseSpeedSchedule("00:00-01:00")
+	if err != nil || len(every) != 1 || !every[0].days[time.Wednesday] {
+		t.Errorf("every day %v %v", every, err)
+	}
+	for _, bad := range []string{"Mon", "Foo 01:00-02:00", "Mon 1-2", "Mon 01:00-25:00", "Mon Tue 01:00-02:00"} {
+		if _, err := parseSpeedSchedule(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestApplyAltSpeed(t *testing.T) {
+	config := DefaultClientConfig()
+	config.UploadRate = 100000
+	config.AltUploadRate = 50000
+	config.AltDownloadRate = 60000
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	c.altSchedule, _ = parseSpeedSchedule("Mon 09:00-18:00")
+
+	monday := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	c.applyAltSpeed(monday)
+	if !c.AltSpeedActive() || c.limiters.up.Rate() != 50000 || c.limiters.down.Rate() != 60000 {
+		t.Errorf("alternative rates %d %d", c.limiters.up.Rate(), c.limiters.down.Rate())
+	}
+	c.SetRateLimits(200000, 0)
+	if c.limiters.up.Rate() != 50000 {
+		t.Errorf("set while alternative %d", c.limiters.up.Rate())
+	}
+	c.applyAltSpeed(monday.Add(9 * time.Hour))
+	if c.AltSpeedActive() || c.limiters.up.Rate() != 200000 || c.limiters.down.Rate() != 0 {
+		t.Errorf("normal rates %d %d", c.limiters.up.Rate(), c.limiters.down.Rate())
+	}
+}
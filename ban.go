@@ -0,0 +1,80 @@
+package gobt
+
+import (
+	"net"
+	"sync"
+)
+
+const maxHashFailures = 3 // bad pieces a peer sent blocks of, before it is banned
+
+// banList peers sending bad data, by ip, as a peer may come again from another port
+type banList struct {
+	mu       sync.Mutex
+	failures map[string]int
+	bans     map[string]bool
+}
+
+func newBanList() *banList {
+	return &banList{
+		failures: make(map[string]int),
+		bans:     make(map[string]bool),
+	}
+}
+
+// fail counts a bad piece of host, true if it is banned by this one
+func (b *banList) fail(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bans[host] {
+		return false
+	}
+	b.failures[host]++
+	if b.failures[host] < maxHashFailures {
+		return false
+	}
+	b.bans[host] = true
+	return true
+}
+
+func (b *banList) banned(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bans[host]
+}
+
+func peerHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// hashFailed blames every peer sent blocks of a bad piece, as we can not tell which block is bad
+func (t *Torrent) hashFailed(index int, from []*peer) {
+	t.client.config.logf("piece %d hash mismatch, blocks from %v", index, from)
+	for _, p := range from {
+		host := peerHost(p.Addr)
+		if !t.client.bans.fail(host) {
+			continue
+		}
+		t.client.config.logf("ban %s", host)
+		t.client.emit(Event{Type: EventPeerBanned, Torrent: t, Peer: p.String(), Err: ErrHashMismatch})
+		t.client.dropHost(host)
+	}
+}
+
+// dropHost disconnects peers of all torrents at host
+func (c *Client) dropHost(host string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, t := range c.torrents {
+		t.peersMutex.RLock()
+		for _, p := range t.peers {
+			if peerHost(p.Addr) == host {
+				p.cancel()
+			}
+		}
+		t.peersMutex.RUnlock()
+	}
+}
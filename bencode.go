@@ -111,14 +111,14 @@ func encodeSlice(v reflect.Value) ([]byte, error) {
 func encodeMap(v reflect.Value) ([]byte, error) {
 	b := make([]byte, 0, v.Len())
 	b = append(b, 'd')
-	m := sortMapValueByKey(v)
-	for k, v := range m {
-		kstr, err := Encode(k)
+	// keys must appear in sorted order
+	for _, k := range sortedMapKeys(v) {
+		kstr, err := Encode(k.String())
 		if err != nil {
 			return nil, err
 		}
 		b = append(b, []byte(kstr)...)
-		str, err := Encode(v)
+		str, err := Encode(v.MapIndex(k).Interface())
 		if err != nil {
 			return nil, err
 		}
@@ -127,20 +127,12 @@ func encodeMap(v reflect.Value) ([]byte, error) {
 	b = append(b, 'e')
 	return b, nil
 }
-func sortMapValueByKey(m reflect.Value) (ret map[string]interface{}) {
-
+func sortedMapKeys(m reflect.Value) []reflect.Value {
 	ks := m.MapKeys()
-	keys := make([]string, 0, m.Len())
-	for _, k := range ks {
-		keys = append(keys, k.String())
-	}
-	sort.Strings(keys)
-
-	ret = map[string]interface{}{}
-	for _, k := range keys {
-		ret[k] = m.MapIndex(reflect.ValueOf(k)).Interface()
-	}
-	return
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i].String() < ks[j].String()
+	})
+	return ks
 }
 
 // Parse 解码 bencode
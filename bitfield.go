@@ -1,8 +1,7 @@
 package gobt
 
 import (
-	"io/ioutil"
-	"log"
+	"fmt"
 	"sync"
 )
 
@@ -35,16 +34,45 @@ func (b *bitfield) Bit(i int) int {
 	bv >>= (7 - ii)
 	return int(bv) & 1
 }
-func (b bitfield) SetBit(i int, v byte) {
+func (b *bitfield) SetBit(i int, v byte) error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	if v|1 != v {
-		log.Fatal("bit must be 0 or 1")
+	if v|1 != 1 {
+		return ErrBadBit
 	}
 	bi := i / 8
 	ii := i % 8
-	v <<= (7 - ii)
-	b.bitData[bi] |= v
+	if i < 0 || bi >= len(b.bitData) {
+		return fmt.Errorf("bit %d out of range", i)
+	}
+	mask := byte(1) << (7 - ii)
+	if v == 1 {
+		b.bitData[bi] |= mask
+	} else {
+		b.bitData[bi] &^= mask
+	}
+	return nil
+}
+
+// hasAnyNotIn tells if b has a bit other does not
+func (b *bitfield) hasAnyNotIn(other *bitfield) bool {
+	o := other.copyData()
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for i, ch := range b.bitData {
+		if i < len(o) && ch&^o[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bitfield) copyData() []byte {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	data := make([]byte, len(b.bitData))
+	copy(data, b.bitData)
+	return data
 }
 
 // size: count of pieces
@@ -64,26 +92,3 @@ func allZeroBitFieldByte(byteCount int) *bitfield {
 		make([]byte, byteCount),
 	}
 }
-func bitfieldFromFile(filename string) (*bitfield, error) {
-	b, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
-	bf := &bitfield{
-		new(sync.RWMutex),
-		b,
-	}
-	return bf, nil
-}
-func (b *bitfield) ToFile(filename string) error {
-	b.lock.RLock()
-	defer b.lock.RUnlock()
-	return ioutil.WriteFile(filename, b.bitData, 0664)
-}
-func (b *bitfield) left() uint64 {
-	sum := uint64(0)
-	for _, ch := range b.bitData {
-		sum += uint64(byteTable[ch])
-	}
-	return sum
-}
@@ -0,0 +1,172 @@
+package gobt
+
+import (
+	"sync"
+)
+
+// blockMap download state of the blocks of a torrent: which peers they are requested from,
+// which are received and from which peer. Pieces are assembled from blocks of any peers.
+type blockMap struct {
+	mu       sync.Mutex
+	info     *MetainfoInfo
+	requests map[blockRequest][]*peer // outstanding, in endgame a block is requested from more than one peer
+	pieces   map[uint32]*partialPiece // pieces with blocks received, until verified
+}
+
+// partialPiece blocks of a piece, indexed by begin / requestLength
+type partialPiece struct {
+	from    []*peer // who sent the block, nil if not received
+	done    []bool  // on disk, including blocks restored from resume data
+	written int     // blocks on disk
+}
+
+func newBlockMap(info *MetainfoInfo) *blockMap {
+	return &blockMap{
+		info:     info,
+		requests: make(map[blockRequest][]*peer),
+		pieces:   make(map[uint32]*partialPiece),
+	}
+}
+
+func (m *blockMap) add(b blockRequest, p *peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[b] = append(m.requests[b], p)
+}
+
+func (m *blockMap) remove(b blockRequest, p *peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := m.requests[b]
+	for i, pp := range peers {
+		if pp == p {
+			peers = append(peers[:i:i], peers[i+1:]...)
+			break
+		}
+	}
+	if len(peers) == 0 {
+		delete(m.requests, b)
+	} else {
+		m.requests[b] = peers
+	}
+}
+
+// piece the state of a piece, created if none, must hold mu
+func (m *blockMap) piece(index uint32) *partialPiece {
+	pp, ok := m.pieces[index]
+	if !ok {
+		n := len(pieceBlocks(m.info, int(index)))
+		pp = &partialPiece{from: make([]*peer, n), done: make([]bool, n)}
+		m.pieces[index] = pp
+	}
+	return pp
+}
+
+// received records p sent a block and removes all requests of it.
+// ok is false if the block is not one of the piece or is already received, it should not be written then.
+// others are the peers other than p still waiting for it.
+func (m *blockMap) received(b blockRequest, p *peer) (others []*peer, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pp := range m.requests[b] {
+		if pp != p {
+			others = append(others, pp)
+		}
+	}
+	delete(m.requests, b)
+	if b.Begin%requestLength != 0 || int(b.Index) >= m.info.piecesCount() {
+		return others, false
+	}
+	pp := m.piece(b.Index)
+	i := int(b.Begin / requestLength)
+	if i >= len(pp.from) || pp.from[i] != nil || pp.done[i] {
+		return others, false
+	}
+	pp.from[i] = p
+	return others, true
+}
+
+// unreceived forgets a block which failed to be written
+func (m *blockMap) unreceived(b blockRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pp, ok := m.pieces[b.Index]; ok {
+		pp.from[b.Begin/requestLength] = nil
+	}
+}
+
+// written counts a received block on disk, true for the last block of its piece.
+// It is true once for a piece, so the piece is verified once.
+func (m *blockMap) written(b blockRequest) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pp := m.piece(b.Index)
+	pp.done[b.Begin/requestLength] = true
+	pp.written++
+	return pp.written == len(pp.from)
+}
+
+// missing the blocks not received yet
+func (m *blockMap) missing(blocks []blockRequest) []blockRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var left []blockRequest
+	for _, b := range blocks {
+		pp, ok := m.pieces[b.Index]
+		if !ok || pp.from[b.Begin/requestLength] == nil && !pp.done[b.Begin/requestLength] {
+			left = append(left, b)
+		}
+	}
+	return left
+}
+
+// verified forgets the blocks of a piece after its hash is checked, returns the peers which sent them.
+// If the hash is wrong the piece is downloaded again from the start.
+func (m *blockMap) verified(index uint32) []*peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pp, ok := m.pieces[index]
+	if !ok {
+		return nil
+	}
+	delete(m.pieces, index)
+	var peers []*peer
+	for _, p := range pp.from {
+		if p != nil && !containsPeer(peers, p) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// partial the blocks on disk of pieces not verified yet
+func (m *blockMap) partial() map[int][]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blocks := make(map[int][]bool)
+	for index, pp := range m.pieces {
+		if pp.written > 0 {
+			blocks[int(index)] = append([]bool(nil), pp.done...)
+		}
+	}
+	return blocks
+}
+
+// restore marks blocks of a piece on disk, as saved in resume data.
+// It is false if all blocks are, the piece is downloaded again then as it would never be verified.
+func (m *blockMap) restore(index int, done []bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pp := m.piece(uint32(index))
+	for i, d := range done {
+		if d && i < len(pp.done) && !pp.done[i] {
+			pp.done[i] = true
+			pp.written++
+		}
+	}
+	if pp.written == 0 || pp.written == len(pp.done) {
+		delete(m.pieces, uint32(index))
+		return false
+	}
+	return true
+}
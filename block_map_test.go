@@ -0,0 +1,91 @@
+package gobt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+func TestBlockMap(t *testing.T) {
+	// the last piece is short and of two blocks
+	info := testMetainfo("a", make([]byte, 4*requestLength+100), int(3*requestLength)).Info
+	m := newBlockMap(info)
+	p1 := &peer{}
+	p2 := &peer{}
+	last := pieceBlocks(info, 1)
+	if len(last) != 2 || last[1].Length != 100 {
+		t.Fatalf("last piece blocks %v", last)
+	}
+
+	// assembled from two peers
+	if _, ok := m.received(last[1], p1); !ok {
+		t.Errorf("block not received")
+	}
+	if _, ok := m.received(last[1], p2); ok {
+		t.Errorf("block received twice")
+	}
+	if missing := m.missing(last); len(missing) != 1 || missing[0] != last[0] {
+		t.Errorf("missing %v", missing)
+	}
+	if m.written(last[1]) {
+		t.Errorf("piece done with a block")
+	}
+	if _, ok := m.received(last[0], p2); !ok {
+		t.Errorf("block not received")
+	}
+	if !m.written(last[0]) {
+		t.Errorf("piece not done")
+	}
+	if _, ok := m.received(last[0], p1); ok {
+		t.Errorf("block of a piece being verified received")
+	}
+	if from := m.verified(1); len(from) != 2 || from[0] != p2 || from[1] != p1 {
+		t.Errorf("from %v", from)
+	}
+	if len(m.missing(last)) != 2 {
+		t.Errorf("blocks kept after verified")
+	}
+
+	// a block failed to write is downloaded again
+	m.received(last[0], p1)
+	m.unreceived(last[0])
+	if len(m.missing(last)) != 2 {
+		t.Errorf("block failed to write not missing")
+	}
+	if _, ok := m.received(blockRequest{0, 1, 2}, p1); ok {
+		t.Errorf("unaligned block received")
+	}
+}
+
+func TestPieceFromTwoPeers(t *testing.T) {
+	data := make([]byte, 2*requestLength)
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", data, len(data)))
+	defer c.Close()
+	seed := []*peerwire.Message{
+		{ID: peerwire.Bitfield, Bitfield: []byte{0x80}},
+		{ID: peerwire.Unchoke},
+	}
+
+	// a sends the first block and is gone
+	a := connectPeer(t, tt)
+	writeMessages(t, a, seed...)
+	nextMessage(t, a, peerwire.Request)
+	nextMessage(t, a, peerwire.Request)
+	writeMessages(t, a, &peerwire.Message{ID: peerwire.Piece, Index: 0, Begin: 0, Block: data[:requestLength]})
+	for i := 0; len(tt.blocks.missing(pieceBlocks(tt.Metainfo.Info, 0))) != 1; i++ {
+		if i > 100 {
+			t.Fatalf("block not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Close()
+
+	// b is only asked for the rest
+	b := connectPeer(t, tt)
+	defer b.Close()
+	writeMessages(t, b, seed...)
+	if m := nextMessage(t, b, peerwire.Request); m.Begin != requestLength {
+		t.Errorf("b got %s", m)
+	}
+}
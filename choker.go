@@ -0,0 +1,173 @@
+package gobt
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+const chokeInterval = 10 * time.Second
+const optimisticRounds = 3 // the optimistic unchoke rotates every 30 seconds
+const snubTimeout = time.Minute
+
+// choker unchokes the peers giving us most, tit-for-tat
+type choker struct {
+	round      int
+	optimistic *peer
+	last       map[*peer]int64 // bytes counted at last round
+}
+
+// peerRate what the choker knows about a peer in a round
+type peerRate struct {
+	p          *peer
+	rate       int64 // bytes per second, download rate while leeching, upload rate while seeding
+	interested bool
+	snubbed    bool
+}
+
+// runChoker rechokes peers until ctx done
+func (t *Torrent) runChoker(ctx context.Context) {
+	c := &choker{last: make(map[*peer]int64)}
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	for {
+		t.rechoke(c, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Torrent) rechoke(c *choker, now time.Time) {
+	seeding := t.left() == 0
+	t.peersMutex.RLock()
+	var rates []peerRate
+	for _, p := range t.peers {
+		if atomic.LoadInt32(&p.ready) == 1 {
+			rates = append(rates, p.rate(c, seeding, now))
+		}
+	}
+	t.peersMutex.RUnlock()
+
+	last := make(map[*peer]int64, len(rates))
+	for _, r := range rates {
+		last[r.p] = c.last[r.p]
+	}
+	c.last = last
+
+	unchoke := make(map[*peer]bool)
+	if !t.client.config.NoUpload {
+		for _, p := range selectUnchoked(rates, t.client.config.UploadSlots) {
+			unchoke[p] = true
+		}
+		if c.round%optimisticRounds == 0 || !containsRate(rates, c.optimistic) || unchoke[c.optimistic] {
+			c.optimistic = pickOptimistic(rates, unchoke)
+		}
+		if c.optimistic != nil {
+			unchoke[c.optimistic] = true
+		}
+	}
+	c.round++
+
+	for _, r := range rates {
+		r.p.setChoking(!unchoke[r.p])
+	}
+}
+
+func containsRate(rates []peerRate, p *peer) bool {
+	for _, r := range rates {
+		if r.p == p {
+			return true
+		}
+	}
+	return false
+}
+
+// rate measures the peer since last round
+func (p *peer) rate(c *choker, seeding bool, now time.Time) peerRate {
+	bytes := atomic.LoadInt64(&p.downloaded)
+	if seeding {
+		bytes = atomic.LoadInt64(&p.uploaded)
+	}
+	rate := (bytes - c.last[p]) / int64(chokeInterval/time.Second)
+	c.last[p] = bytes
+	return peerRate{
+		p:          p,
+		rate:       rate,
+		interested: atomic.LoadUint32(&p.PeerInterested) == 1,
+		snubbed:    !seeding && p.snubbed(now),
+	}
+}
+
+// selectUnchoked the interested peers of best rates, snubbed peers are left to optimistic unchoke
+func selectUnchoked(rates []peerRate, slots int) []*peer {
+	var candidates []peerRate
+	for _, r := range rates {
+		if r.interested && !r.snubbed {
+			candidates = append(candidates, r)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rate > candidates[j].rate
+	})
+	if len(candidates) > slots {
+		candidates = candidates[:slots]
+	}
+	peers := make([]*peer, len(candidates))
+	for i, r := range candidates {
+		peers[i] = r.p
+	}
+	return peers
+}
+
+// pickOptimistic a random interested peer not unchoked, nil if none
+func pickOptimistic(rates []peerRate, unchoked map[*peer]bool) *peer {
+	var candidates []*peer
+	for _, r := range rates {
+		if r.interested && !unchoked[r.p] {
+			candidates = append(candidates, r.p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// setChoking sends choke or unchoke if it changes, without waiting for the peer to take it
+func (p *peer) setChoking(choke bool) {
+	var v uint32
+	if choke {
+		v = 1
+	}
+	if atomic.SwapUint32(&p.AmChoking, v) == v {
+		return
+	}
+	select {
+	case p.chokeChanged <- struct{}{}:
+	default:
+		// startSend is told already
+	}
+}
+
+// updateInterest tells the peer if it has pieces we lack
+func (p *peer) updateInterest() {
+	var v uint32
+	if p.Bitfield.hasAnyNotIn(p.t.bitfield) {
+		v = 1
+	}
+	if atomic.SwapUint32(&p.AmInterested, v) == v {
+		return
+	}
+	if v == 1 {
+		p.sendCmd(peerwire.Interested)
+	} else {
+		p.sendCmd(peerwire.NotInterested)
+	}
+}
@@ -0,0 +1,122 @@
+package gobt
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+func TestSelectUnchoked(t *testing.T) {
+	peers := make([]*peer, 5)
+	for i := range peers {
+		peers[i] = &peer{}
+	}
+	rates := []peerRate{
+		{p: peers[0], rate: 10, interested: true},
+		{p: peers[1], rate: 50, interested: true},
+		{p: peers[2], rate: 90, interested: false},
+		{p: peers[3], rate: 80, interested: true, snubbed: true},
+		{p: peers[4], rate: 30, interested: true},
+	}
+	got := selectUnchoked(rates, 2)
+	if len(got) != 2 || got[0] != peers[1] || got[1] != peers[4] {
+		t.Errorf("unchoked %v", got)
+	}
+
+	unchoked := map[*peer]bool{peers[1]: true, peers[4]: true}
+	for i := 0; i < 20; i++ {
+		p := pickOptimistic(rates, unchoked)
+		if p != peers[0] && p != peers[3] {
+			t.Errorf("optimistic %v", p)
+		}
+	}
+	if pickOptimistic(rates[2:3], nil) != nil {
+		t.Errorf("optimistic unchoke of a peer not interested")
+	}
+}
+
+func TestChoker(t *testing.T) {
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", []byte("hello world"), 4))
+	defer c.Close()
+	conn := connectPeer(t, tt)
+	defer conn.Close()
+
+	// nothing we lack, not interesting
+	writeMessages(t, conn,
+		&peerwire.Message{ID: peerwire.Bitfield, Bitfield: []byte{0}},
+		&peerwire.Message{ID: peerwire.Interested},
+	)
+	nextMessage(t, conn, peerwire.Extended)
+	var p *peer
+	for p == nil || atomic.LoadUint32(&p.PeerInterested) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		tt.peersMutex.RLock()
+		for _, pp := range tt.peers {
+			p = pp
+		}
+		tt.peersMutex.RUnlock()
+	}
+	if atomic.LoadUint32(&p.AmInterested) != 0 {
+		t.Errorf("interested in a peer without pieces")
+	}
+
+	tt.rechoke(&choker{last: make(map[*peer]int64)}, time.Now())
+	if m := readMessage(t, conn); m.ID != peerwire.Unchoke {
+		t.Errorf("got %s, want unchoke", m)
+	}
+
+	writeMessages(t, conn, &peerwire.Message{ID: peerwire.Have, Index: 1})
+	if m := readMessage(t, conn); m.ID != peerwire.Interested {
+		t.Errorf("got %s, want interested", m)
+	}
+
+	writeMessages(t, conn, &peerwire.Message{ID: peerwire.NotInterested})
+	for atomic.LoadUint32(&p.PeerInterested) == 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tt.rechoke(&choker{last: make(map[*peer]int64)}, time.Now())
+	if m := readMessage(t, conn); m.ID != peerwire.Choke {
+		t.Errorf("got %s, want choke", m)
+	}
+}
+
+func TestSetChokingNoWait(t *testing.T) {
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", []byte("hello world"), 4))
+	defer c.Close()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	p := newPeer(tt, a.RemoteAddr())
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	defer p.cancel()
+	p.Conn = a
+
+	// nothing is sending to the peer, the choker goes on
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.setChoking(false)
+		p.setChoking(true)
+		p.setChoking(false)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("setChoking waits for the peer")
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.startSend(stop)
+	if m := readMessage(t, b); m.ID != peerwire.Unchoke {
+		t.Errorf("got %s, want unchoke", m)
+	}
+	go p.send(&peerwire.Message{ID: peerwire.Have, Index: 1})
+	if m := readMessage(t, b); m.ID != peerwire.Have {
+		t.Errorf("got %s, want have", m)
+	}
+}
@@ -2,436 +2,369 @@ package gobt
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"errors"
-	"flag"
 	"fmt"
-	"io"
-	"log"
 	"math/rand"
 	"net"
 	"strconv"
 	"sync"
+	"time"
 )
 
-const doNotBotherTracker = true // for debug use
-
 // const
 const hashSize = 20
 const peerIDSize = 20
 
-// settings
-var maxPeerCount int
-
-// DownloadRoot root directory of download
-var DownloadRoot string
-
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-	maxPeerCount = *flag.Int("max-peer-count", 30, "how many peers to connect")
-	DownloadRoot = *flag.String("root", ".", "download root directory")
-
-	myPeerID = genPeerID()
-	gPeersToStart = make(chan *peer, 10)
-
-}
-
-var byteTable = map[byte]int{
-	0:   0,
-	1:   1,
-	2:   1,
-	3:   2,
-	4:   1,
-	5:   2,
-	6:   2,
-	7:   3,
-	8:   1,
-	9:   2,
-	10:  2,
-	11:  3,
-	12:  2,
-	13:  3,
-	14:  3,
-	15:  4,
-	16:  1,
-	17:  2,
-	18:  2,
-	19:  3,
-	20:  2,
-	21:  3,
-	22:  3,
-	23:  4,
-	24:  2,
-	25:  3,
-	26:  3,
-	27:  4,
-	28:  3,
-	29:  4,
-	30:  4,
-	31:  5,
-	32:  1,
-	33:  2,
-	34:  2,
-	35:  3,
-	36:  2,
-	37:  3,
-	38:  3,
-	39:  4,
-	40:  2,
-	41:  3,
-	42:  3,
-	43:  4,
-	44:  3,
-	45:  4,
-	46:  4,
-	47:  5,
-	48:  2,
-	49:  3,
-	50:  3,
-	51:  4,
-	52:  3,
-	53:  4,
-	54:  4,
-	55:  5,
-	56:  3,
-	57:  4,
-	58:  4,
-	59:  5,
-	60:  4,
-	61:  5,
-	62:  5,
-	63:  6,
-	64:  0,
-	65:  1,
-	66:  1,
-	67:  2,
-	68:  1,
-	69:  2,
-	70:  2,
-	71:  3,
-	72:  1,
-	73:  2,
-	74:  2,
-	75:  3,
-	76:  2,
-	77:  3,
-	78:  3,
-	79:  4,
-	80:  1,
-	81:  2,
-	82:  2,
-	83:  3,
-	84:  2,
-	85:  3,
-	86:  3,
-	87:  4,
-	88:  2,
-	89:  3,
-	90:  3,
-	91:  4,
-	92:  3,
-	93:  4,
-	94:  4,
-	95:  5,
-	96:  1,
-	97:  2,
-	98:  2,
-	99:  3,
-	100: 2,
-	101: 3,
-	102: 3,
-	103: 4,
-	104: 2,
-	105: 3,
-	106: 3,
-	107: 4,
-	108: 3,
-	109: 4,
-	110: 4,
-	111: 5,
-	112: 2,
-	113: 3,
-	114: 3,
-	115: 4,
-	116: 3,
-	117: 4,
-	118: 4,
-	119: 5,
-	120: 3,
-	121: 4,
-	122: 4,
-	123: 5,
-	124: 4,
-	125: 5,
-	126: 5,
-	127: 6,
-	128: 0,
-	129: 1,
-	130: 1,
-	131: 2,
-	132: 1,
-	133: 2,
-	134: 2,
-	135: 3,
-	136: 1,
-	137: 2,
-	138: 2,
-	139: 3,
-	140: 2,
-	141: 3,
-	142: 3,
-	143: 4,
-	144: 1,
-	145: 2,
-	146: 2,
-	147: 3,
-	148: 2,
-	149: 3,
-	150: 3,
-	151: 4,
-	152: 2,
-	153: 3,
-	154: 3,
-	155: 4,
-	156: 3,
-	157: 4,
-	158: 4,
-	159: 5,
-	160: 1,
-	161: 2,
-	162: 2,
-	163: 3,
-	164: 2,
-	165: 3,
-	166: 3,
-	167: 4,
-	168: 2,
-	169: 3,
-	170: 3,
-	171: 4,
-	172: 3,
-	173: 4,
-	174: 4,
-	175: 5,
-	176: 2,
-	177: 3,
-	178: 3,
-	179: 4,
-	180: 3,
-	181: 4,
-	182: 4,
-	183: 5,
-	184: 3,
-	185: 4,
-	186: 4,
-	187: 5,
-	188: 4,
-	189: 5,
-	190: 5,
-	191: 6,
-	192: 0,
-	193: 1,
-	194: 1,
-	195: 2,
-	196: 1,
-	197: 2,
-	198: 2,
-	199: 3,
-	200: 1,
-	201: 2,
-	202: 2,
-	203: 3,
-	204: 2,
-	205: 3,
-	206: 3,
-	207: 4,
-	208: 1,
-	209: 2,
-	210: 2,
-	211: 3,
-	212: 2,
-	213: 3,
-	214: 3,
-	215: 4,
-	216: 2,
-	217: 3,
-	218: 3,
-	219: 4,
-	220: 3,
-	221: 4,
-	222: 4,
-	223: 5,
-	224: 1,
-	225: 2,
-	226: 2,
-	227: 3,
-	228: 2,
-	229: 3,
-	230: 3,
-	231: 4,
-	232: 2,
-	233: 3,
-	234: 3,
-	235: 4,
-	236: 3,
-	237: 4,
-	238: 4,
-	239: 5,
-	240: 2,
-	241: 3,
-	242: 3,
-	243: 4,
-	244: 3,
-	245: 4,
-	246: 4,
-	247: 5,
-	248: 3,
-	249: 4,
-	250: 4,
-	251: 5,
-	252: 4,
-	253: 5,
-	254: 5,
-	255: 6,
-}
-
-const (
-	statePeerInit = iota
-	statePeerConnected
-	statePeerError
-)
-
-var myPeerID peerID
-var gBitField *bitfield
-var peersStateMap map[string]int
-var peersMap map[string]*peer
-var peersMapMutex sync.RWMutex
-var gPeersToStart chan *peer
-
-type ipPort struct {
-	IP   uint32
-	Port uint16
+// Client listens for peers and runs torrents
+type Client struct {
+	ctx    context.Context // done when client closed
+	cancel context.CancelFunc
+	config ClientConfig
+	peerID peerID
+	ln     net.Listener
+	port   uint16
+
+	peerCount int32 // peers of all torrents, atomic
+	events    chan Event
+	limiters  rateLimiters
+	transfer  transferCounter
+	hashJobs  chan hashJob
+	storage   StorageFunc // of torrents added
+	files     *fileCache  // open files of torrents in files
+	bans      *banList
+
+	altMutex    sync.Mutex // guards altActive and the rates in config
+	altSchedule speedSchedule
+	altActive   bool
+
+	mu       sync.RWMutex
+	torrents map[hash]*Torrent
+	adding   map[hash]bool // torrents being added, their files are allocated without mu locked
 }
 
-func newIPPortFromUint64(u uint64) ipPort {
-	return ipPort{
-		uint32(0xFFFFFFFF & u),
-		uint16(u >> 32),
+// NewClient starts listening, config can be nil for default
+func NewClient(config *ClientConfig) (*Client, error) {
+	if config == nil {
+		config = DefaultClientConfig()
+	}
+	config = config.withDefaults()
+	schedule, err := parseSpeedSchedule(config.AltSpeedSchedule)
+	if err != nil {
+		return nil, err
 	}
+	if _, err := parseAllocation(config.Allocation); err != nil {
+		return nil, err
+	}
+	ln, port, err := availablePort(config.ListenPortStart, config.ListenPortEnd)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		ctx:      ctx,
+		cancel:   cancel,
+		config:   *config,
+		peerID:   genPeerID(config.PeerIDPrefix),
+		ln:       ln,
+		port:     port,
+		torrents: make(map[hash]*Torrent),
+		adding:   make(map[hash]bool),
+		events:   make(chan Event, eventBufferSize),
+		limiters: newRateLimiters(config.UploadRate, config.DownloadRate),
+		hashJobs: make(chan hashJob, hashQueueSize),
+		files:    newFileCache(config.MaxOpenFiles),
+		bans:     newBanList(),
+
+		altSchedule: schedule,
+	}
+	c.storage, err = c.defaultStorage()
+	if err != nil {
+		ln.Close()
+		cancel()
+		return nil, err
+	}
+	go c.accept()
+	c.startHashers(ctx)
+	if len(schedule) > 0 {
+		go c.runAltSpeed(ctx)
+	}
+	return c, nil
 }
 
-func (i ipPort) Uint64() uint64 {
-	return uint64(i.IP)<<32 | uint64(i.Port)
+// AddTorrentFile add a torrent from .torrent file and start downloading
+func (c *Client) AddTorrentFile(filename string) (*Torrent, error) {
+	mi, err := NewMetainfoFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.AddTorrent(mi)
 }
 
-func (i ipPort) String() string {
-	return IPIntToString(int(i.IP)) + ":" + strconv.Itoa(int(i.Port))
+// TorrentOptions settings of a torrent other than those in config of the client
+type TorrentOptions struct {
+	Allocation     Allocation      // empty for allocation in config
+	FilePriorities []PiecePriority // of every file, files skipped are not created; nil for all normal
 }
 
-// Download download BT file
-func Download(filename string) {
+// AddTorrent add a torrent and start downloading
+func (c *Client) AddTorrent(mi *Metainfo) (*Torrent, error) {
+	return c.AddTorrentWithOptions(mi, TorrentOptions{})
+}
 
-	metaInfo, err := NewMetainfoFromFile(filename)
+// AddTorrentWithOptions add a torrent of its own settings and start downloading
+func (c *Client) AddTorrentWithOptions(mi *Metainfo, opts TorrentOptions) (*Torrent, error) {
+	if opts.Allocation == "" {
+		opts.Allocation = Allocation(c.config.Allocation)
+	}
+	allocation, err := parseAllocation(string(opts.Allocation))
 	if err != nil {
-		fmt.Printf("parse bt file error: %s\n", err)
-		return
+		return nil, err
+	}
+	opts.Allocation = allocation
+	if opts.FilePriorities != nil {
+		if len(opts.FilePriorities) != len(fileRanges(mi.Info)) {
+			return nil, fmt.Errorf("%d file priorities for %d files", len(opts.FilePriorities), len(fileRanges(mi.Info)))
+		}
+		for _, p := range opts.FilePriorities {
+			if err := checkPriority(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		return nil, errors.New("client closed")
 	}
+	if c.torrents[mi.InfoHash] != nil || c.adding[mi.InfoHash] {
+		c.mu.Unlock()
+		return nil, errors.New("torrent already added")
+	}
+	c.adding[mi.InfoHash] = true
+	storage := c.storage
+	c.mu.Unlock()
 
-	gBitField, err = ensureFile(metaInfo.Info)
+	// files may take long to allocate, other torrents are not blocked meanwhile
+	t, reason, err := c.newTorrent(mi, storage, opts)
+	c.mu.Lock()
+	delete(c.adding, mi.InfoHash)
+	if err == nil && c.ctx.Err() != nil {
+		t.cancel()
+		t.storage.Close()
+		err = errors.New("client closed")
+	}
 	if err != nil {
-		fmt.Printf("file error: %s\n", err)
-		log.Fatal(err)
+		c.mu.Unlock()
+		return nil, err
 	}
+	verify := reason != "" && c.config.AutoVerify
+	if verify {
+		// locked until verified, so it is not resumed before
+		t.stateMutex.Lock()
+	}
+	c.torrents[mi.InfoHash] = t
+	c.mu.Unlock()
+	if verify {
+		c.config.logf("verify %s: %s", mi.Info.Name, reason)
+		go t.verifyAndResume()
+		return t, nil
+	}
+	return t, t.Resume()
+}
 
-	ln, port, err := availablePort()
+// newTorrent opens and allocates the storage of a torrent, and restores it from resume data.
+// It tells why the data on disk should be checked, as loadResume.
+func (c *Client) newTorrent(mi *Metainfo, storage StorageFunc, opts TorrentOptions) (*Torrent, string, error) {
+	t, err := newTorrent(c, mi, storage, opts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", err
+	}
+	// checked before files are allocated, which makes them look long enough
+	reason := t.loadResume(opts.FilePriorities == nil)
+	if err := t.allocate(); err != nil {
+		t.cancel()
+		t.storage.Close()
+		return nil, "", err
 	}
-	defer ln.Close()
+	return t, reason, nil
+}
 
-	trackerProtocol(metaInfo, port)
+// SetStorage changes where data of torrents added later is, nil for the storage in config
+func (c *Client) SetStorage(storage StorageFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if storage == nil {
+		storage, _ = c.defaultStorage()
+	}
+	c.storage = storage
+}
 
-	go func() {
-		fmt.Printf("Listening...\n")
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.Fatal(err)
-			}
-			fmt.Printf("connection comes from %s\n", conn.RemoteAddr())
-			go handleConnection(conn, metaInfo)
+// RemoveTorrent stops the torrent and removes it from client, downloaded data is kept
+func (c *Client) RemoveTorrent(t *Torrent) error {
+	c.mu.Lock()
+	if c.torrents[t.Metainfo.InfoHash] != t {
+		c.mu.Unlock()
+		return errors.New("torrent not in client")
+	}
+	delete(c.torrents, t.Metainfo.InfoHash)
+	c.mu.Unlock()
+	return t.Stop()
+}
+
+// Close stops all torrents and the listener
+func (c *Client) Close() error {
+	c.mu.Lock()
+	torrents := c.torrents
+	c.torrents = make(map[hash]*Torrent)
+	c.mu.Unlock()
+
+	// goroutines of torrents and verifies in progress return early
+	c.cancel()
+	err := c.ln.Close()
+	for _, t := range torrents {
+		err2 := t.Stop()
+		if err == nil {
+			err = err2
 		}
-	}()
+	}
+	return err
+}
 
-	// do peers
-	for {
-		peer := <-gPeersToStart
+// Torrents all torrents of client
+func (c *Client) Torrents() []*Torrent {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ret := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+func (c *Client) torrent(ih hash) *Torrent {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.torrents[ih]
+}
 
-		peersMapMutex.RLock()
-		if peersMap[peer.String()] == nil {
-			fmt.Printf("start peer %s\n", peer.String())
-			peersMap[peer.String()] = peer
-			go peer.startHandle(metaInfo)
+func (c *Client) accept() {
+	c.config.logf("Listening...")
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			if oe, ok := err.(net.Error); ok && oe.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			c.config.logf("stop listening: %s", err)
+			return
 		}
-		peersMapMutex.RUnlock()
+		c.config.logf("connection comes from %s", conn.RemoteAddr())
+		go c.handleConnection(conn)
+	}
+}
+
+// handleConnection finds the torrent by info hash in handshake
+func (c *Client) handleConnection(conn net.Conn) {
+	if c.bans.banned(peerHost(conn.RemoteAddr())) {
+		conn.Close()
+		return
 	}
+	err := conn.SetDeadline(time.Now().Add(c.config.HandshakeTimeout))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	ih, reserved, err := acceptHandshake(conn)
+	if err != nil {
+		c.config.logf("%s handshake error: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	t := c.torrent(ih)
+	if t == nil {
+		c.config.logf("%s asks for unknown torrent %x", conn.RemoteAddr(), ih)
+		conn.Close()
+		return
+	}
+	p := newPeer(t, conn.RemoteAddr())
+	p.Conn = conn
+	p.Reserved = reserved
+	p.PeerID, err = finishHandshake(conn, ih, c.peerID)
+	if err != nil {
+		c.config.logf("%s handshake error: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil || !t.addPeer(p) {
+		conn.Close()
+	}
+}
 
+type ipPort struct {
+	IP   uint32
+	Port uint16
 }
-func handleConnection(conn net.Conn, metaInfo *Metainfo) {
-	addr := conn.RemoteAddr()
-	peersMapMutex.RLock()
-	defer peersMapMutex.RUnlock()
-	if peersMap[addr.String()] == nil {
-		var pid peerID
-		p := newPeer(addr, pid)
-		p.Conn = conn
-		go p.handleConnection(metaInfo)
+
+func newIPPortFromUint64(u uint64) ipPort {
+	return ipPort{
+		uint32(0xFFFFFFFF & u),
+		uint16(u >> 32),
 	}
 }
 
-func compactPeerList(b []byte, piecesCount int) ([]*peer, error) {
-	ret := make([]*peer, 0)
+func (i ipPort) Uint64() uint64 {
+	return uint64(i.IP)<<32 | uint64(i.Port)
+}
+
+func (i ipPort) String() string {
+	return IPIntToString(int(i.IP)) + ":" + strconv.Itoa(int(i.Port))
+}
+
+func compactPeerList(b []byte) ([]net.Addr, error) {
 	if len(b)%6 != 0 {
 		return nil, errors.New("compact peers is not 6s")
 	}
-	for i := 0; i < len(b)/6; i++ {
-		ip := int(b[i*6])*0xFFFFFF + int(b[i*6+1])*0xFFFF + int(b[i*6+2])*0xFF + int(b[i*6+3])
-		port := int(b[i*6+4])*0xFF + int(b[i*6+5])
+	lst := make([]ipPort, len(b)/6)
+	for i := range lst {
+		lst[i].IP = binary.BigEndian.Uint32(b[i*6:])
+		lst[i].Port = binary.BigEndian.Uint16(b[i*6+4:])
+	}
+	return ipPortAddrList(lst), nil
+}
 
-		address := IPIntToString(ip) + ":" + strconv.Itoa(port)
-		addr, err := net.ResolveTCPAddr("tcp", address)
+func ipPortAddrList(lst []ipPort) []net.Addr {
+	ret := make([]net.Addr, 0, len(lst))
+	for _, ipp := range lst {
+		addr, err := net.ResolveTCPAddr("tcp", ipp.String())
 		if err != nil {
-			fmt.Printf("peer address resolve error: %s\n", err)
 			continue
 		}
-
-		var pid peerID
-		i := newPeer(addr, pid)
-		ret = append(ret, i)
+		ret = append(ret, addr)
 	}
-	return ret, nil
+	return ret
 }
 
-func peerList(peers map[string]interface{}, piecesCount int) ([]*peer, error) {
-	ret := make([]*peer, 0)
+func peerList(peers []interface{}) ([]net.Addr, error) {
+	ret := make([]net.Addr, 0)
 	for _, p := range peers {
-		pm := p.(map[string]interface{})
-
-		pid, err := peerIDFromBytes(pm["peer id"].([]byte))
-		if err != nil {
-			return ret, err
+		pm, ok := p.(map[string]interface{})
+		if !ok {
+			return ret, errors.New("peer is not a dictionary")
 		}
 
-		address := string(pm["ip"].([]byte)) + ":" + string(pm["port"].([]byte))
+		ip, _ := pm["ip"].([]byte)
+		port, _ := pm["port"].(int64)
+		address := net.JoinHostPort(string(ip), strconv.Itoa(int(port)))
 		addr, err := net.ResolveTCPAddr("tcp", address)
 		if err != nil {
-			fmt.Printf("peer address resolve error: %s\n", err)
 			continue
 		}
-		pp := newPeer(addr, pid)
-		ret = append(ret, pp)
+		ret = append(ret, addr)
 	}
 	return ret, nil
 }
@@ -443,6 +376,9 @@ func unique(intSlice []string) []string {
 	keys := make(map[string]bool)
 	list := []string{}
 	for _, entry := range intSlice {
+		if entry == "" {
+			continue
+		}
 		if _, value := keys[entry]; !value {
 			keys[entry] = true
 			list = append(list, entry)
@@ -451,92 +387,122 @@ func unique(intSlice []string) []string {
 	return list
 }
 
-func udpTracker(address string, metainfo *Metainfo) error {
+func udpTracker(ctx context.Context, address string, req *TrackerRequest, timeout time.Duration) (*TrackerResponse, error) {
 	// http://www.bittorrent.org/beps/bep_0015.html
-	raddr, err := net.ResolveUDPAddr("udp", address)
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", address)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	conn, err := net.DialUDP("udp", nil, raddr)
+	conn := c.(*net.UDPConn)
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err = conn.SetDeadline(deadline)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
 	var transactionID = uint32(rand.Int31())
 	err = connectRequest(conn, transactionID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	connectionID, err := connectResponse(conn, transactionID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// IPv4 announce request
-	req := NewTrackerRequest(metainfo, 88) // TODO what port?
-	announceRequest(conn, transactionID, connectionID, req)
+	err = announceRequest(conn, transactionID, connectionID, req)
+	if err != nil {
+		return nil, err
+	}
 
 	// IPv4 announce response
-	announceResponse(conn, transactionID)
-	return nil
+	return announceResponse(conn, transactionID)
 }
-func announceResponse(conn *net.UDPConn, transactionID uint32) (*TrackerResponse, error) {
 
-	action, err := readUint32(conn)
+// readPacket read one datagram, and turns an error action into error
+func readPacket(conn *net.UDPConn, transactionID uint32) (uint32, *bytes.Reader, error) {
+	buffer := make([]byte, udpMaxPacketSize)
+	n, err := conn.Read(buffer)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
-	// action          1 // announce
-	if action != 1 {
-		log.Fatal("action not 1")
+	buf := bytes.NewReader(buffer[:n])
+	action, err := readUint32(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	t, err := readUint32(buf)
+	if err != nil {
+		return 0, nil, err
 	}
+	if t != transactionID {
+		return 0, nil, ErrTransactionMismatch
+	}
+	if action == actionError {
+		msg := make([]byte, buf.Len())
+		buf.Read(msg)
+		return 0, nil, fmt.Errorf("tracker error: %s", msg)
+	}
+	return action, buf, nil
+}
+func announceResponse(conn *net.UDPConn, transactionID uint32) (*TrackerResponse, error) {
 
-	t, err := readUint32(conn)
+	action, buf, err := readPacket(conn, transactionID)
 	if err != nil {
 		return nil, err
 	}
-	if t != transactionID {
-		log.Fatal("transactionID mismatch")
+	if action != actionAnnounce {
+		return nil, fmt.Errorf("%w: action not announce", ErrBadPacket)
 	}
 
-	interval, err := readUint32(conn)
+	interval, err := readUint32(buf)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("interval %d\n", interval)
 
-	leechers, err := readUint32(conn)
+	leechers, err := readUint32(buf)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("leechers %d\n", leechers)
 
-	seeders, err := readUint32(conn)
+	seeders, err := readUint32(buf)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("seeders %d\n", seeders)
 
-	lst := make([]ipPort, 0)
-	for {
-		ip, err := readUint32(conn)
+	if buf.Len()%6 != 0 {
+		return nil, fmt.Errorf("%w: compact peers is not 6s", ErrBadPacket)
+	}
+	lst := make([]ipPort, 0, buf.Len()/6)
+	for buf.Len() > 0 {
+		ip, err := readUint32(buf)
 		if err != nil {
 			return nil, err
 		}
-		port, err := read2Byte(conn)
+		port, err := read2Byte(buf)
 		if err != nil {
-			if err == io.EOF {
-				lst = append(lst, ipPort{ip, port})
-				break
-			}
 			return nil, err
 		}
 		lst = append(lst, ipPort{ip, port})
 	}
 	resp := TrackerResponse{
 		Action:        action,
-		TransactionID: t,
+		TransactionID: transactionID,
 		Interval:      interval,
 		Leechers:      leechers,
 		Seeders:       seeders,
@@ -545,140 +511,57 @@ func announceResponse(conn *net.UDPConn, transactionID uint32) (*TrackerResponse
 	return &resp, nil
 }
 func announceRequest(conn *net.UDPConn, transactionID uint32, connectionID uint64, req *TrackerRequest) error {
-	b, err := announceRequestBytes(conn, transactionID, connectionID, req)
+	b, err := announceRequestBytes(transactionID, connectionID, req)
 	if err != nil {
 		return err
 	}
-	n, err := conn.Write(b)
-	if err != nil {
-		return err
-	}
-	if n != len(b) {
-		log.Fatal("only n", n)
-	}
-	return nil
+	_, err = conn.Write(b)
+	return err
 }
 
-func announceRequestBytes(conn *net.UDPConn, transactionID uint32, connectionID uint64, req *TrackerRequest) ([]byte, error) {
-	action := uint32(1) // announce
-	var err error
-	buf := bytes.NewBuffer(make([]byte, 1024))
-
-	err = binary.Write(buf, binary.BigEndian, connectionID)
+func announceRequestBytes(transactionID uint32, connectionID uint64, req *TrackerRequest) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := writeIntegers(buf,
+		connectionID,
+		actionAnnounce,
+		transactionID,
+		req.InfoHash,
+		req.PeerID,
+		req.Downloaded,
+		req.Left,
+		req.Uploaded,
+		req.Event,
+		req.IP,
+		req.Key,
+		req.NumWant,
+		req.Port,
+	)
 	if err != nil {
 		return nil, err
 	}
-
-	binary.Write(buf, binary.BigEndian, action)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, transactionID)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.InfoHash)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.PeerID)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.Downloaded)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.Left)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.Uploaded)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.Event)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.IP)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.Key)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.NumWant)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.Write(buf, binary.BigEndian, req.Port)
-	if err != nil {
-		return nil, err
-	}
-
 	return buf.Bytes(), nil
 }
 
-func genPeerID() [peerIDSize]byte {
-	b := make([]byte, peerIDSize)
-	n, err := rand.Read(b)
-	if err != nil {
-		log.Fatal("rand error")
-	}
-	if n != peerIDSize {
-		log.Fatal("rand length error")
-	}
+func genPeerID(prefix string) [peerIDSize]byte {
 	var a [peerIDSize]byte
-	copy(a[:], b[:peerIDSize])
+	rand.Read(a[:]) // never fails
+	copy(a[:], prefix)
 	return a
 }
-func infoHash(info map[string]interface{}) hash {
+func infoHash(info map[string]interface{}) (hash, error) {
 	s, err := Encode(info)
 	if err != nil {
-		log.Fatal("info encode fail")
+		return hash{}, err
 	}
-	return sha1.Sum(s)
+	return sha1.Sum(s), nil
 }
 func connectResponse(conn *net.UDPConn, transactionID uint32) (uint64, error) {
-
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return 0, err
-	}
-	fmt.Printf("read %d bytes\n", n)
-	if n != 16 {
-		log.Fatal("not 16 read")
-	}
-	buf := bytes.NewReader(buffer)
-	action := uint32(0)
-	err = binary.Read(buf, binary.BigEndian, &action)
-	if err != nil {
-		return 0, err
-	}
-	if action != 0 {
-		log.Fatal("action not 0")
-	}
-	transID := uint32(0)
-	err = binary.Read(buf, binary.BigEndian, &transID)
+	action, buf, err := readPacket(conn, transactionID)
 	if err != nil {
 		return 0, err
 	}
-	if transID != transactionID {
-		return 0, errors.New("transaction_id not equal")
+	if action != actionConnect {
+		return 0, fmt.Errorf("%w: action not connect", ErrBadPacket)
 	}
 	var connectionID uint64
 	err = binary.Read(buf, binary.BigEndian, &connectionID)
@@ -692,29 +575,12 @@ func connectRequest(conn *net.UDPConn, transactionID uint32) error {
 	if err != nil {
 		return err
 	}
-	n, err := conn.Write(b)
-	if err != nil {
-		return err
-	}
-	if n != len(b) {
-		log.Fatal("only n", n)
-	}
-	return nil
+	_, err = conn.Write(b)
+	return err
 }
 func connectRequestBytes(transactionID uint32) ([]byte, error) {
-	var protocolID uint64 = 0x41727101980 // magic constant
-	action := uint32(0)
-	var err error
-	buf := bytes.NewBuffer(make([]byte, 16))
-	err = binary.Write(buf, binary.BigEndian, protocolID)
-	if err != nil {
-		return nil, err
-	}
-	binary.Write(buf, binary.BigEndian, action)
-	if err != nil {
-		return nil, err
-	}
-	binary.Write(buf, binary.BigEndian, transactionID)
+	buf := new(bytes.Buffer)
+	err := writeIntegers(buf, udpProtocolID, actionConnect, transactionID)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"log"
+
 	"github.com/picasso250/gobt"
 )
 
@@ -15,6 +17,15 @@ func main() {
 	// }
 
 	// gobt.PrintMetainfo(v.(map[string]interface{}))
-	gobt.DownloadRoot = ".debug"
-	gobt.Download("Mutant.Year.Zero.Road.to.Eden.Seed.of.Evil.torrent")
+	config := gobt.DefaultClientConfig()
+	config.DownloadRoot = ".debug"
+	c, err := gobt.NewClient(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = c.AddTorrentFile("Mutant.Year.Zero.Road.to.Eden.Seed.of.Evil.torrent")
+	if err != nil {
+		log.Fatal(err)
+	}
+	select {}
 }
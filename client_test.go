@@ -1,6 +1,9 @@
 package gobt
 
 import (
+	"crypto/sha1"
+	"net"
+	"strconv"
 	"testing"
 )
 
@@ -10,3 +13,143 @@ func TestDownload(t *testing.T) {
 	// Download("Mutant.Year.Zero.Road.to.Eden.Seed.of.Evil.torrent")
 	// t.Errorf("not implemented")
 }
+
+// testMetainfo a single file torrent without trackers
+func testMetainfo(name string, data []byte, pieceLength int) *Metainfo {
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[i:end])
+		pieces = append(pieces, h[:]...)
+	}
+	mi, err := NewMetainfoFromMap(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         []byte(name),
+			"piece length": int64(pieceLength),
+			"pieces":       pieces,
+			"length":       int64(len(data)),
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return mi
+}
+
+func TestClientTorrents(t *testing.T) {
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+
+	a := testMetainfo("a", []byte("hello"), 4)
+	b := testMetainfo("b", []byte("world"), 4)
+	for _, mi := range []*Metainfo{a, b} {
+		_, err = c.AddTorrent(mi)
+		if err != nil {
+			t.Fatalf("add torrent error: %v", err)
+		}
+	}
+	if _, err = c.AddTorrent(a); err == nil {
+		t.Errorf("add torrent twice")
+	}
+	if len(c.Torrents()) != 2 {
+		t.Errorf("torrents %d", len(c.Torrents()))
+	}
+
+	// incoming connection goes to the torrent of its info hash
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(c.port)))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	p := &peer{Addr: conn.RemoteAddr(), Conn: conn}
+	var pid peerID
+	copy(pid[:], "-TEST-0123456789abcd")
+	err = handshake(p, b, pid)
+	if err != nil {
+		t.Fatalf("handshake error: %v", err)
+	}
+	if p.PeerID != c.peerID {
+		t.Errorf("peer id %x", p.PeerID)
+	}
+
+	// other calls go on while files of a torrent are allocated
+	opened := make(chan struct{})
+	allocated := make(chan struct{})
+	c.SetStorage(func(info *MetainfoInfo, root string) (Storage, error) {
+		close(opened)
+		<-allocated
+		return NewFileStorage(info, root)
+	})
+	slow := testMetainfo("slow", []byte("slow"), 4)
+	added := make(chan error)
+	go func() {
+		_, err := c.AddTorrent(slow)
+		added <- err
+	}()
+	<-opened
+	if len(c.Torrents()) != 2 {
+		t.Errorf("torrents %d while adding", len(c.Torrents()))
+	}
+	if _, err := c.AddTorrent(slow); err == nil {
+		t.Errorf("add torrent being added")
+	}
+	close(allocated)
+	if err := <-added; err != nil || len(c.Torrents()) != 3 {
+		t.Errorf("add torrent error: %v, torrents %d", err, len(c.Torrents()))
+	}
+}
+
+func TestTorrentLifecycle(t *testing.T) {
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	tt, err := c.AddTorrent(testMetainfo("a", []byte("hello"), 4))
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+
+	err = tt.Pause()
+	if err != nil {
+		t.Errorf("pause error: %v", err)
+	}
+	if tt.addPeer(newPeer(tt, c.ln.Addr())) {
+		t.Errorf("paused torrent adds peer")
+	}
+	err = tt.Resume()
+	if err != nil {
+		t.Errorf("resume error: %v", err)
+	}
+
+	err = c.RemoveTorrent(tt)
+	if err != nil {
+		t.Errorf("remove error: %v", err)
+	}
+	if len(c.Torrents()) != 0 {
+		t.Errorf("torrent not removed")
+	}
+	if tt.Resume() == nil {
+		t.Errorf("resume stopped torrent")
+	}
+
+	_, err = c.AddTorrent(testMetainfo("b", []byte("world"), 4))
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Errorf("close error: %v", err)
+	}
+	if _, err = c.AddTorrent(testMetainfo("c", []byte("!"), 4)); err == nil {
+		t.Errorf("add torrent to closed client")
+	}
+}
@@ -0,0 +1,287 @@
+package gobt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientConfig settings of a client.
+// Keys in config files and command line are the config tags.
+// Counts and timeouts left zero are the default, e.g. in a config not from DefaultClientConfig.
+type ClientConfig struct {
+	DownloadRoot string `config:"download_root"` // root directory of download
+
+	ListenPortStart int `config:"listen_port_start"` // first port tried to listen on
+	ListenPortEnd   int `config:"listen_port_end"`   // last port tried to listen on
+
+	MaxPeerCount   int `config:"max_peer_count"`  // how many peers to connect per torrent
+	MaxConnections int `config:"max_connections"` // how many peers to connect for all torrents
+
+	UploadSlots int `config:"upload_slots"` // peers unchoked by rate, one more is unchoked optimistically
+
+	RequestQueueDepth int           `config:"request_queue_depth"` // outstanding block requests per peer, fewer if the peer asks so
+	RequestTimeout    time.Duration `config:"request_timeout"`     // a block not received in time is canceled and requested again
+
+	HashWorkers int           `config:"hash_workers"` // goroutines checking piece hashes for all torrents
+	AutoVerify  bool          `config:"auto_verify"`  // check all pieces when a torrent is added if data on disk does not match its resume data
+	ResumeDelay time.Duration `config:"resume_delay"` // resume data is saved this long after a change, and when paused
+
+	Storage      string `config:"storage"`        // "file", or "mmap" to map files into memory, files can not be skipped then
+	Allocation   string `config:"allocation"`     // "sparse", "full" to reserve disk space when added, or "compact" to grow files as written
+	MaxOpenFiles int    `config:"max_open_files"` // files kept open for all torrents, the least recently used are closed
+
+	UploadRate       int64  `config:"upload_rate"`        // bytes per second of all torrents, 0 for no limit
+	DownloadRate     int64  `config:"download_rate"`      // bytes per second of all torrents, 0 for no limit
+	PeerUploadRate   int64  `config:"peer_upload_rate"`   // bytes per second of each peer, 0 for no limit
+	PeerDownloadRate int64  `config:"peer_download_rate"` // bytes per second of each peer, 0 for no limit
+	AltUploadRate    int64  `config:"alt_upload_rate"`    // upload_rate while alternative speed is on
+	AltDownloadRate  int64  `config:"alt_download_rate"`  // download_rate while alternative speed is on
+	AltSpeedSchedule string `config:"alt_speed_schedule"` // e.g. "Mon-Fri 09:00-18:00", empty for never
+
+	DialTimeout       time.Duration `config:"dial_timeout"`
+	HandshakeTimeout  time.Duration `config:"handshake_timeout"`
+	TrackerTimeout    time.Duration `config:"tracker_timeout"`
+	KeepAliveInterval time.Duration `config:"keep_alive_interval"`
+
+	PeerIDPrefix string `config:"peer_id_prefix"` // e.g. -GB0001-, the rest of peer id is random
+
+	NoUpload          bool `config:"no_upload"`           // do not answer requests of peers
+	NoUDPTrackers     bool `config:"no_udp_trackers"`     // only announce to http trackers
+	DebugTrackerCache bool `config:"debug_tracker_cache"` // cache tracker responses in .debug, for debug use
+
+	Logger *log.Logger // what peers, trackers and torrents do, for debug use; nil for no log
+}
+
+// DefaultClientConfig returns the default settings
+func DefaultClientConfig() *ClientConfig {
+	return &ClientConfig{
+		DownloadRoot:      ".",
+		ListenPortStart:   6881,
+		ListenPortEnd:     6889,
+		MaxPeerCount:      30,
+		MaxConnections:    200,
+		UploadSlots:       4,
+		RequestQueueDepth: 16,
+		RequestTimeout:    30 * time.Second,
+		HashWorkers:       runtime.NumCPU(),
+		AutoVerify:        true,
+		ResumeDelay:       10 * time.Second,
+		Storage:           "file",
+		Allocation:        string(AllocateSparse),
+		MaxOpenFiles:      defaultMaxOpenFiles,
+		DialTimeout:       10 * time.Second,
+		HandshakeTimeout:  10 * time.Second,
+		TrackerTimeout:    15 * time.Second,
+		KeepAliveInterval: 2 * time.Minute,
+		PeerIDPrefix:      "-GB0001-",
+	}
+}
+
+// withDefaults a copy of c, settings which do not work at zero or below are the default
+func (c *ClientConfig) withDefaults() *ClientConfig {
+	d := DefaultClientConfig()
+	config := *c
+	for _, v := range []struct{ value, def *int }{
+		{&config.MaxPeerCount, &d.MaxPeerCount},
+		{&config.MaxConnections, &d.MaxConnections},
+		{&config.UploadSlots, &d.UploadSlots},
+		{&config.RequestQueueDepth, &d.RequestQueueDepth},
+		{&config.HashWorkers, &d.HashWorkers},
+		{&config.MaxOpenFiles, &d.MaxOpenFiles},
+	} {
+		if *v.value <= 0 {
+			*v.value = *v.def
+		}
+	}
+	for _, v := range []struct{ value, def *time.Duration }{
+		{&config.RequestTimeout, &d.RequestTimeout},
+		{&config.DialTimeout, &d.DialTimeout},
+		{&config.HandshakeTimeout, &d.HandshakeTimeout},
+		{&config.TrackerTimeout, &d.TrackerTimeout},
+		{&config.KeepAliveInterval, &d.KeepAliveInterval},
+	} {
+		if *v.value <= 0 {
+			*v.value = *v.def
+		}
+	}
+	return &config
+}
+
+// LoadClientConfig reads a .json, .toml or .yaml file over the default settings.
+// Only flat key value pairs are supported in toml and yaml.
+func LoadClientConfig(filename string) (*ClientConfig, error) {
+	c := DefaultClientConfig()
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	default:
+		return nil, fmt.Errorf("unknown config file type %s", filename)
+	case ".json":
+		err = json.Unmarshal(b, &m)
+	case ".toml":
+		m, err = parseFlatConfig(b, '=')
+	case ".yaml", ".yml":
+		m, err = parseFlatConfig(b, ':')
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	for k, v := range m {
+		err = c.set(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	return c, nil
+}
+
+// parseFlatConfig parses lines of `key = value` (toml) or `key: value` (yaml)
+func parseFlatConfig(b []byte, sep byte) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line == "---" {
+			continue
+		}
+		i := strings.IndexByte(line, sep)
+		if i == -1 {
+			return nil, fmt.Errorf("line %d: no %c", lineNo, sep)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, `'`) {
+			s, err := unquoteConfigValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNo, err)
+			}
+			m[key] = s
+			continue
+		}
+		if j := strings.IndexByte(value, '#'); j != -1 {
+			value = strings.TrimSpace(value[:j])
+		}
+		if value == "" {
+			return nil, fmt.Errorf("line %d: nested values are not supported", lineNo)
+		}
+		m[key] = value
+	}
+	return m, scanner.Err()
+}
+
+func unquoteConfigValue(value string) (string, error) {
+	q := value[0]
+	end := strings.IndexByte(value[1:], q)
+	if end == -1 {
+		return "", errors.New("unterminated string")
+	}
+	s := value[:end+2]
+	if q == '\'' {
+		return s[1 : len(s)-1], nil
+	}
+	return strconv.Unquote(s)
+}
+
+// Set sets the setting of key, value is parsed by the type of setting
+func (c *ClientConfig) Set(key string, value string) error {
+	return c.set(key, value)
+}
+
+// Keys all keys of settings, fields without a config tag are set by code only
+func (c *ClientConfig) Keys() []string {
+	t := reflect.TypeOf(c).Elem()
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("config"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (c *ClientConfig) set(key string, value interface{}) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if key == "" || t.Field(i).Tag.Get("config") != key {
+			continue
+		}
+		err := setConfigValue(v.Field(i), value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %s", key)
+}
+
+// logf writes to Logger if any
+func (c *ClientConfig) logf(format string, v ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, v...)
+	}
+}
+
+// setConfigValue value is string, float64 or bool, as parsed from files
+func setConfigValue(f reflect.Value, value interface{}) error {
+	s, isString := value.(string)
+	switch f.Interface().(type) {
+	case string:
+		if !isString {
+			return errors.New("not a string")
+		}
+		f.SetString(s)
+	case bool:
+		if isString {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return err
+			}
+			f.SetBool(b)
+		} else if b, ok := value.(bool); ok {
+			f.SetBool(b)
+		} else {
+			return errors.New("not a bool")
+		}
+	case time.Duration:
+		if isString {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			f.SetInt(int64(d))
+		} else if n, ok := value.(float64); ok {
+			// plain numbers are seconds
+			f.SetInt(int64(n * float64(time.Second)))
+		} else {
+			return errors.New("not a duration")
+		}
+	case int, int64:
+		if isString {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return err
+			}
+			f.SetInt(n)
+		} else if n, ok := value.(float64); ok && n == float64(int64(n)) {
+			f.SetInt(int64(n))
+		} else {
+			return errors.New("not an integer")
+		}
+	}
+	return nil
+}
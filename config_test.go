@@ -0,0 +1,96 @@
+package gobt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.json": `{"download_root": "/data", "max_peer_count": 5, "dial_timeout": "3s", "no_upload": true, "tracker_timeout": 2}`,
+		"a.toml": "# comment\ndownload_root = \"/data\"\nmax_peer_count = 5 # five\ndial_timeout = \"3s\"\nno_upload = true\ntracker_timeout = \"2s\"\n",
+		"a.yaml": "---\ndownload_root: '/data'\nmax_peer_count: 5\ndial_timeout: 3s\nno_upload: true\ntracker_timeout: 2s\n",
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		err := ioutil.WriteFile(filename, []byte(content), 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := LoadClientConfig(filename)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if c.DownloadRoot != "/data" || c.MaxPeerCount != 5 || c.DialTimeout != 3*time.Second ||
+			!c.NoUpload || c.TrackerTimeout != 2*time.Second {
+			t.Errorf("%s: %+v", name, c)
+		}
+		// not in file, keep default
+		if c.ListenPortStart != 6881 || c.PeerIDPrefix != "-GB0001-" {
+			t.Errorf("%s: default lost %+v", name, c)
+		}
+	}
+
+	filename := filepath.Join(dir, "bad.toml")
+	ioutil.WriteFile(filename, []byte("no_such_key = 1\n"), 0664)
+	if _, err := LoadClientConfig(filename); err == nil {
+		t.Errorf("unknown key accepted")
+	}
+}
+
+func TestClientConfigSet(t *testing.T) {
+	c := DefaultClientConfig()
+	if err := c.Set("upload_rate", "1024"); err != nil || c.UploadRate != 1024 {
+		t.Errorf("set upload_rate: %v %d", err, c.UploadRate)
+	}
+	if err := c.Set("keep_alive_interval", "1m"); err != nil || c.KeepAliveInterval != time.Minute {
+		t.Errorf("set keep_alive_interval: %v %s", err, c.KeepAliveInterval)
+	}
+	if err := c.Set("max_peer_count", "many"); err == nil {
+		t.Errorf("bad integer accepted")
+	}
+	if len(c.Keys()) == 0 || c.Keys()[0] != "download_root" {
+		t.Errorf("keys %v", c.Keys())
+	}
+	for _, key := range c.Keys() {
+		if key == "" {
+			t.Errorf("keys %v", c.Keys())
+		}
+	}
+	if err := c.Set("", "x"); err == nil {
+		t.Errorf("set a field without key")
+	}
+}
+
+func TestClientConfigLog(t *testing.T) {
+	c := DefaultClientConfig()
+	c.logf("not logged %d", 1)
+	var buf bytes.Buffer
+	c.Logger = log.New(&buf, "", 0)
+	c.logf("logged %d", 2)
+	if buf.String() != "logged 2\n" {
+		t.Errorf("log %q", buf.String())
+	}
+}
+
+func TestClientConfigDefaults(t *testing.T) {
+	c, err := NewClient(&ClientConfig{DownloadRoot: t.TempDir(), UploadSlots: 2, HandshakeTimeout: -1})
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	d := DefaultClientConfig()
+	if c.config.KeepAliveInterval != d.KeepAliveInterval || c.config.HandshakeTimeout != d.HandshakeTimeout ||
+		c.config.HashWorkers != d.HashWorkers || c.config.MaxOpenFiles != d.MaxOpenFiles || c.config.RequestTimeout != d.RequestTimeout {
+		t.Errorf("config %+v", c.config)
+	}
+	if c.config.UploadSlots != 2 || c.config.UploadRate != 0 {
+		t.Errorf("settings given changed %+v", c.config)
+	}
+}
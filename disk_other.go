@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package gobt
+
+import "os"
+
+// diskFree is not known
+func diskFree(dir string) (free int64, ok bool) {
+	return 0, false
+}
+
+// allocatedSize is taken as the size of a file
+func allocatedSize(st os.FileInfo) int64 {
+	return st.Size()
+}
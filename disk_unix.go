@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package gobt
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskFree bytes free for us on the disk of dir, ok is false if not known
+func diskFree(dir string) (free int64, ok bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
+
+// allocatedSize bytes of disk taken by a file, less than its size if sparse
+func allocatedSize(st os.FileInfo) int64 {
+	if s, ok := st.Sys().(*syscall.Stat_t); ok {
+		return int64(s.Blocks) * 512
+	}
+	return st.Size()
+}
@@ -0,0 +1,53 @@
+package gobt
+
+import (
+	"sort"
+)
+
+const gotElsewhereBufferSize = 64
+
+// endgame returns at most n blocks requested from other peers, which p has and has not been asked for.
+// Blocks requested from fewer peers come first.
+func (m *blockMap) endgame(p *peer, n int) []blockRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var blocks []blockRequest
+	for b, peers := range m.requests {
+		if p.Bitfield.Bit(int(b.Index)) == 0 || containsPeer(peers, p) {
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		ni, nj := len(m.requests[blocks[i]]), len(m.requests[blocks[j]])
+		if ni != nj {
+			return ni < nj
+		}
+		if blocks[i].Index != blocks[j].Index {
+			return blocks[i].Index < blocks[j].Index
+		}
+		return blocks[i].Begin < blocks[j].Begin
+	})
+	if len(blocks) > n {
+		blocks = blocks[:n]
+	}
+	return blocks
+}
+
+func containsPeer(peers []*peer, p *peer) bool {
+	for _, pp := range peers {
+		if pp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// gotElsewhere tells p a block it asked for came from another peer, it sends cancel.
+// If p is busy the notice is dropped, p then gets the block again.
+func (p *peer) gotElsewhere(b blockRequest) {
+	select {
+	case p.elsewhere <- b:
+	default:
+	}
+}
@@ -0,0 +1,82 @@
+package gobt
+
+import (
+	"net"
+	"testing"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+// nextMessage skips messages until one of id
+func nextMessage(t *testing.T, conn net.Conn, id peerwire.ID) *peerwire.Message {
+	for {
+		m := readMessage(t, conn)
+		if m.ID == id {
+			return m
+		}
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	data := make([]byte, 2*requestLength)
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", data, len(data)))
+	defer c.Close()
+	seed := []*peerwire.Message{
+		{ID: peerwire.Bitfield, Bitfield: []byte{0x80}},
+		{ID: peerwire.Unchoke},
+	}
+
+	a := connectPeer(t, tt)
+	defer a.Close()
+	writeMessages(t, a, seed...)
+	nextMessage(t, a, peerwire.Request)
+	nextMessage(t, a, peerwire.Request)
+
+	// the only piece is downloading from a, b is asked for the same blocks
+	b := connectPeer(t, tt)
+	defer b.Close()
+	writeMessages(t, b, seed...)
+	first := nextMessage(t, b, peerwire.Request)
+	second := nextMessage(t, b, peerwire.Request)
+	if first.Begin != 0 || second.Begin != requestLength {
+		t.Fatalf("endgame requests %s, %s", first, second)
+	}
+
+	writeMessages(t, a, &peerwire.Message{ID: peerwire.Piece, Index: 0, Begin: 0, Block: data[:requestLength]})
+	if m := nextMessage(t, b, peerwire.Cancel); m.Begin != 0 {
+		t.Errorf("b got %s", m)
+	}
+	writeMessages(t, b, &peerwire.Message{ID: peerwire.Piece, Index: 0, Begin: requestLength, Block: data[requestLength:]})
+	if m := nextMessage(t, a, peerwire.Cancel); m.Begin != requestLength {
+		t.Errorf("a got %s", m)
+	}
+}
+
+func TestBlockMapRequests(t *testing.T) {
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", make([]byte, 3*requestLength), int(3*requestLength)))
+	defer c.Close()
+	p1 := newPeer(tt, nil)
+	p2 := newPeer(tt, nil)
+	p2.Bitfield.SetBit(0, 1)
+	blocks := pieceBlocks(tt.Metainfo.Info, 0)
+	r := newBlockMap(tt.Metainfo.Info)
+	for _, b := range blocks {
+		r.add(b, p1)
+	}
+	r.add(blocks[2], p2)
+
+	eg := r.endgame(p2, 1)
+	if len(eg) != 1 || eg[0] != blocks[0] {
+		t.Errorf("endgame %v", eg)
+	}
+	if len(r.endgame(p1, 10)) != 0 {
+		t.Errorf("endgame of a peer without the piece")
+	}
+	if others, _ := r.received(blocks[2], p1); len(others) != 1 || others[0] != p2 {
+		t.Errorf("others %v", others)
+	}
+	r.remove(blocks[0], p1)
+	if len(r.requests) != 1 {
+		t.Errorf("requests %v", r.requests)
+	}
+}
@@ -0,0 +1,53 @@
+package gobt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors that drop a peer or a tracker, test them with errors.Is
+var (
+	ErrProtocolMismatch    = errors.New("peer does not speak BitTorrent protocol")
+	ErrInfoHashMismatch    = errors.New("info hash mismatch")
+	ErrBadMessage          = errors.New("bad peer message")
+	ErrBadBit              = errors.New("bit must be 0 or 1")
+	ErrBadPacket           = errors.New("bad tracker packet")
+	ErrTransactionMismatch = errors.New("transaction id mismatch")
+	ErrBadMetainfo         = errors.New("bad metainfo")
+	ErrHashMismatch        = errors.New("piece hash mismatch")
+)
+
+// PeerError why a peer was dropped
+type PeerError struct {
+	Addr string
+	Err  error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %s", e.Addr, e.Err)
+}
+
+// Unwrap returns the cause
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// TrackerError why an announce failed
+type TrackerError struct {
+	URL string
+	Err error
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s: %s", e.URL, e.Err)
+}
+
+// Unwrap returns the cause
+func (e *TrackerError) Unwrap() error {
+	return e.Err
+}
+
+// badMessage wraps ErrBadMessage with detail
+func badMessage(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrBadMessage, fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,91 @@
+package gobt
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerDroppedEvent(t *testing.T) {
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	tt, err := c.AddTorrent(testMetainfo("a", []byte("hello"), 4))
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+
+	// a peer answering with the info hash of another torrent
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := acceptHandshake(conn); err != nil {
+			return
+		}
+		var other hash
+		copy(other[:], "another info hash!!!")
+		finishHandshake(conn, other, peerID{})
+	}()
+
+	if !tt.addPeer(newPeer(tt, ln.Addr())) {
+		t.Fatalf("peer not added")
+	}
+	select {
+	case e := <-c.Events():
+		if e.Type != EventPeerDropped || e.Torrent != tt || e.Peer != ln.Addr().String() {
+			t.Errorf("event %+v", e)
+		}
+		var pe *PeerError
+		if !errors.As(e.Err, &pe) || !errors.Is(e.Err, ErrInfoHashMismatch) {
+			t.Errorf("event error %v", e.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event")
+	}
+}
+
+func TestBadMetainfo(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         []byte("a"),
+		"piece length": int64(4),
+		"pieces":       []byte("short"),
+		"length":       int64(5),
+	}
+	_, err := NewMetainfoFromMap(map[string]interface{}{"info": info})
+	if !errors.Is(err, ErrBadMetainfo) {
+		t.Errorf("bad pieces: %v", err)
+	}
+	_, err = NewMetainfoFromMap(map[string]interface{}{"info": []byte("x")})
+	if !errors.Is(err, ErrBadMetainfo) {
+		t.Errorf("bad info: %v", err)
+	}
+}
+
+func TestSetBitError(t *testing.T) {
+	bf := allZeroBitField(10)
+	if err := bf.SetBit(3, 2); !errors.Is(err, ErrBadBit) {
+		t.Errorf("set bit 2: %v", err)
+	}
+	if err := bf.SetBit(100, 1); err == nil {
+		t.Errorf("set bit out of range")
+	}
+	if err := bf.SetBit(3, 1); err != nil || bf.Bit(3) != 1 {
+		t.Errorf("set bit: %v", err)
+	}
+	if err := bf.SetBit(3, 0); err != nil || bf.Bit(3) != 0 {
+		t.Errorf("clear bit: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package gobt
+
+// EventType kind of Event
+type EventType int
+
+// event types
+const (
+	EventPeerDropped  EventType = iota // a peer connection ended, Err tells why
+	EventTrackerError                  // an announce failed
+	EventTorrentError                  // e.g. disk error, the torrent goes on
+	EventPeerBanned                    // a peer sent blocks of too many bad pieces
+)
+
+const eventBufferSize = 1024
+
+// Event something happened in client, read them from Client.Events
+type Event struct {
+	Type    EventType
+	Torrent *Torrent
+	Peer    string // address of peer
+	Tracker string // announce url
+	Err     error
+}
+
+// Events returns the event stream, events are dropped if it is not read fast enough
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+func (c *Client) emit(e Event) {
+	select {
+	case c.events <- e:
+	default:
+	}
+}
@@ -0,0 +1,18 @@
+package gobt
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves disk space of f up to size, zeros are written if the file system does not support it
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return writeZeros(f, size)
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
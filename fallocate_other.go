@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package gobt
+
+import "os"
+
+// fallocate writes zeros past the end of f up to size
+func fallocate(f *os.File, size int64) error {
+	return writeZeros(f, size)
+}
@@ -0,0 +1,109 @@
+package gobt
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+const defaultMaxOpenFiles = 64
+
+// fileCache open files, shared by readers and writers.
+// The least recently used ones are closed when there are more than limit.
+type fileCache struct {
+	mu    sync.Mutex
+	limit int
+	lru   *list.List // of *cachedFile, most recently used first
+	files map[string]*list.Element
+}
+
+// cachedFile a file in use is closed when the last user releases it
+type cachedFile struct {
+	name     string
+	f        *os.File
+	writable bool
+	refs     int  // users
+	removed  bool // from cache, close when refs is 0
+}
+
+func newFileCache(limit int) *fileCache {
+	if limit < 1 {
+		limit = 1
+	}
+	return &fileCache{
+		limit: limit,
+		lru:   list.New(),
+		files: make(map[string]*list.Element),
+	}
+}
+
+// open gets a file from cache or opens it, the file is created if write. Call release after use.
+func (c *fileCache) open(name string, write bool) (*cachedFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.files[name]; ok {
+		cf := e.Value.(*cachedFile)
+		if cf.writable || !write {
+			cf.refs++
+			c.lru.MoveToFront(e)
+			return cf, nil
+		}
+		// opened read only
+		c.remove(e)
+	}
+	flag := os.O_RDWR
+	if write {
+		flag |= os.O_CREATE
+	}
+	writable := true
+	f, err := os.OpenFile(name, flag, 0664)
+	if os.IsPermission(err) && !write {
+		writable = false
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cf := &cachedFile{name: name, f: f, writable: writable, refs: 1}
+	c.files[name] = c.lru.PushFront(cf)
+	for c.lru.Len() > c.limit {
+		c.remove(c.lru.Back())
+	}
+	return cf, nil
+}
+
+func (c *fileCache) release(cf *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cf.refs--
+	if cf.refs == 0 && cf.removed {
+		cf.f.Close()
+	}
+}
+
+// remove must hold mu
+func (c *fileCache) remove(e *list.Element) error {
+	cf := e.Value.(*cachedFile)
+	c.lru.Remove(e)
+	delete(c.files, cf.name)
+	cf.removed = true
+	if cf.refs == 0 {
+		return cf.f.Close()
+	}
+	return nil
+}
+
+// close closes files of names, e.g. of a torrent paused
+func (c *fileCache) close(names []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, name := range names {
+		if e, ok := c.files[name]; ok {
+			if err2 := c.remove(e); err == nil {
+				err = err2
+			}
+		}
+	}
+	return err
+}
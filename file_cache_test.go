@@ -0,0 +1,65 @@
+package gobt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCache(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	cache := newFileCache(2)
+
+	if _, err := cache.open(a, false); !os.IsNotExist(err) {
+		t.Errorf("open missing file for read %v", err)
+	}
+	fa, err := cache.open(a, true)
+	if err != nil {
+		t.Fatalf("open error: %v", err)
+	}
+	fb, _ := cache.open(b, true)
+	cache.release(fb)
+	again, _ := cache.open(a, false)
+	if again != fa {
+		t.Errorf("file not cached")
+	}
+	cache.release(again)
+
+	// b is the least recently used, a is in use
+	fc, _ := cache.open(c, true)
+	cache.release(fc)
+	if _, ok := cache.files[b]; ok || !fb.removed {
+		t.Errorf("b not closed")
+	}
+	if _, err := fb.f.Write([]byte("x")); err == nil {
+		t.Errorf("write to closed file")
+	}
+	cache.close([]string{a, c})
+	if len(cache.files) != 0 || !fa.removed {
+		t.Errorf("files %v", cache.files)
+	}
+	// closed after the last user
+	if _, err := fa.f.Write([]byte("x")); err != nil {
+		t.Errorf("file in use closed: %v", err)
+	}
+	cache.release(fa)
+	if _, err := fa.f.Write([]byte("x")); err == nil {
+		t.Errorf("write to closed file")
+	}
+}
+
+func TestPauseFlushFiles(t *testing.T) {
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", []byte("hello"), 5))
+	defer c.Close()
+	if _, err := tt.storage.WriteAt(0, []byte("hello"), 0); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if len(c.files.files) != 1 {
+		t.Errorf("open files %d", len(c.files.files))
+	}
+	tt.Pause()
+	if len(c.files.files) != 0 {
+		t.Errorf("open files %d after pause", len(c.files.files))
+	}
+}
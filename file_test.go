@@ -1,33 +1,34 @@
 package gobt
 
-import "testing"
-
-func init() {
-	DownloadRoot = ".debug"
-}
+import (
+	"context"
+	"testing"
+)
 
 func TestEnsureFile(t *testing.T) {
+	root := t.TempDir()
 	mi, err := NewMetainfoFromFile("a.txt.torrent")
 	if err != nil {
 		t.Errorf("parse file error: %v", err)
 	}
-	_, err = ensureOneFile(mi.Info)
+	err = ensureOneFile(root, mi.Info)
 	if err != nil {
 		t.Errorf("ensureFile error %s", err)
 	}
 
-	_, err = ensureFile(mi.Info)
+	err = ensureFile(context.Background(), root, mi.Info, nil)
 	if err != nil {
 		t.Errorf("ensureFile error %s", err)
 	}
 }
 func TestEnsureFiles(t *testing.T) {
+	root := t.TempDir()
 	mi, err := NewMetainfoFromFile("b.torrent")
 	if err != nil {
 		t.Errorf("parse file error: %v", err)
 	}
 
-	_, err = ensureFiles(mi.Info)
+	err = ensureFiles(context.Background(), root, mi.Info, nil)
 	if err != nil {
 		t.Errorf("ensureFile error %s", err)
 	}
@@ -0,0 +1,516 @@
+package gobt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// FUSE requests and replies, see linux/fuse.h
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseAccess      = 34
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+
+	fuseRootID        = 1
+	fuseInHeaderSize  = 40
+	fuseOutHeaderSize = 16
+	fuseMaxWrite      = 4096   // nothing is written, the least the kernel allows
+	fuseBufferSize    = 8192   // FUSE_MIN_READ_BUFFER
+	fuseKeepCache     = 1 << 1 // FOPEN_KEEP_CACHE, data never changes
+	fuseValid         = 60     // seconds the kernel may cache entries and attributes
+)
+
+var fuseEndian = binary.NativeEndian
+
+// fuseServer serves a fs.FS to the kernel
+type fuseServer struct {
+	fsys       fs.FS
+	dir        string
+	dev        *os.File
+	fusermount string // to unmount by, empty if mounted by us as root
+	done       chan struct{}
+
+	mu     sync.Mutex
+	paths  map[uint64]string // node ids to paths in fsys
+	ids    map[string]uint64
+	files  map[uint64]*fuseHandle
+	nextFh uint64
+}
+
+// fuseHandle a file opened, reads of a file not io.ReaderAt are serialized
+type fuseHandle struct {
+	mu sync.Mutex
+	f  fs.File
+}
+
+// Mount serves fsys read only at directory dir by FUSE, Close the result to unmount.
+// It mounts by the system call as root, or by fusermount.
+// Files in it are for other processes: opening one here may wait for the server forever,
+// as os.Open polls it without letting other goroutines run if GOMAXPROCS is 1.
+func Mount(fsys fs.FS, dir string) (io.Closer, error) {
+	s := &fuseServer{
+		fsys:  fsys,
+		dir:   dir,
+		done:  make(chan struct{}),
+		paths: map[uint64]string{fuseRootID: "."},
+		ids:   map[string]uint64{".": fuseRootID},
+		files: make(map[uint64]*fuseHandle),
+	}
+	err := s.mount()
+	if err != nil {
+		return nil, err
+	}
+	err = s.init()
+	if err != nil {
+		s.unmount()
+		s.dev.Close()
+		return nil, err
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *fuseServer) mount() error {
+	if os.Geteuid() == 0 {
+		dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+		if err == nil {
+			opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", dev.Fd())
+			err = syscall.Mount("gobt", s.dir, "fuse.gobt", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, opts)
+			if err == nil {
+				s.dev = dev
+				return nil
+			}
+			dev.Close()
+		}
+	}
+	bin, err := exec.LookPath("fusermount3")
+	if err != nil {
+		bin, err = exec.LookPath("fusermount")
+	}
+	if err != nil {
+		return errors.New("fusermount not found, is fuse installed?")
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+	defer remote.Close()
+	cmd := exec.Command(bin, "-o", "ro,nosuid,nodev,fsname=gobt,subtype=gobt", "--", s.dir)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", bin, err)
+	}
+	// fusermount sends the fd of /dev/fuse
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(fds[0], make([]byte, 1), oob, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return errors.New("no fd from fusermount")
+	}
+	devFds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(devFds) == 0 {
+		return errors.New("no fd from fusermount")
+	}
+	s.dev = os.NewFile(uintptr(devFds[0]), "/dev/fuse")
+	s.fusermount = bin
+	return nil
+}
+
+func (s *fuseServer) unmount() error {
+	if s.fusermount == "" {
+		return syscall.Unmount(s.dir, 0)
+	}
+	out, err := exec.Command(s.fusermount, "-u", s.dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
+
+// Close unmounts, files open in it are closed
+func (s *fuseServer) Close() error {
+	err := s.unmount()
+	if err != nil {
+		return err
+	}
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for fh, h := range s.files {
+		h.f.Close()
+		delete(s.files, fh)
+	}
+	return s.dev.Close()
+}
+
+// init answers the first request of the kernel
+func (s *fuseServer) init() error {
+	buf := make([]byte, fuseBufferSize)
+	n, err := syscall.Read(int(s.dev.Fd()), buf)
+	if err != nil {
+		return err
+	}
+	if n < fuseInHeaderSize+16 || fuseEndian.Uint32(buf[4:]) != fuseInit {
+		return errors.New("fuse: bad init request")
+	}
+	unique := fuseEndian.Uint64(buf[8:])
+	body := buf[fuseInHeaderSize:n]
+	major, minor := fuseEndian.Uint32(body), fuseEndian.Uint32(body[4:])
+	if major != 7 {
+		s.reply(unique, syscall.EPROTO, nil)
+		return fmt.Errorf("fuse: protocol %d.%d not supported", major, minor)
+	}
+	if minor > 31 {
+		minor = 31
+	}
+	out := make([]byte, 64)
+	if minor < 23 {
+		// fuse_init_out was shorter
+		out = out[:24]
+	}
+	fuseEndian.PutUint32(out, 7)
+	fuseEndian.PutUint32(out[4:], minor)
+	fuseEndian.PutUint32(out[8:], fuseEndian.Uint32(body[8:])) // max_readahead
+	fuseEndian.PutUint32(out[20:], fuseMaxWrite)
+	s.reply(unique, 0, out)
+	return nil
+}
+
+func (s *fuseServer) serve() {
+	defer close(s.done)
+	buf := make([]byte, fuseBufferSize)
+	for {
+		n, err := syscall.Read(int(s.dev.Fd()), buf)
+		if err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.ENOENT {
+			// ENOENT if the request was interrupted
+			continue
+		}
+		if err != nil {
+			// ENODEV when unmounted
+			return
+		}
+		if n < fuseInHeaderSize {
+			continue
+		}
+		req := make([]byte, n)
+		copy(req, buf)
+		// reads may wait for pieces
+		go s.handle(req)
+	}
+}
+
+func (s *fuseServer) reply(unique uint64, errno syscall.Errno, body []byte) {
+	if errno != 0 {
+		body = nil
+	}
+	out := make([]byte, fuseOutHeaderSize+len(body))
+	fuseEndian.PutUint32(out, uint32(len(out)))
+	fuseEndian.PutUint32(out[4:], uint32(-int32(errno)))
+	fuseEndian.PutUint64(out[8:], unique)
+	copy(out[fuseOutHeaderSize:], body)
+	// one write is one reply, so replies of goroutines do not mix
+	syscall.Write(int(s.dev.Fd()), out)
+}
+
+func (s *fuseServer) handle(req []byte) {
+	opcode := fuseEndian.Uint32(req[4:])
+	unique := fuseEndian.Uint64(req[8:])
+	node := fuseEndian.Uint64(req[16:])
+	body := req[fuseInHeaderSize:]
+	switch opcode {
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		// no reply, node ids are kept as the tree is small
+		return
+	case fuseInit, fuseDestroy, fuseFlush, fuseReleasedir:
+		s.reply(unique, 0, nil)
+		return
+	case fuseStatfs:
+		out := make([]byte, 80)
+		fuseEndian.PutUint32(out[40:], 4096) // bsize
+		fuseEndian.PutUint32(out[44:], 255)  // namelen
+		fuseEndian.PutUint32(out[48:], 4096) // frsize
+		s.reply(unique, 0, out)
+		return
+	case fuseAccess:
+		if fuseEndian.Uint32(body)&2 != 0 {
+			// W_OK
+			s.reply(unique, syscall.EROFS, nil)
+			return
+		}
+		s.reply(unique, 0, nil)
+		return
+	}
+
+	p, ok := s.path(node)
+	if !ok {
+		s.reply(unique, syscall.ENOENT, nil)
+		return
+	}
+	var out []byte
+	var err error
+	switch opcode {
+	case fuseLookup:
+		out, err = s.lookup(fsPath(p, cString(body)))
+	case fuseGetattr:
+		out, err = s.getattr(p)
+	case fuseOpen:
+		out, err = s.open(p, fuseEndian.Uint32(body))
+	case fuseRead:
+		out, err = s.read(fuseEndian.Uint64(body), int64(fuseEndian.Uint64(body[8:])), fuseEndian.Uint32(body[16:]))
+	case fuseRelease:
+		err = s.release(fuseEndian.Uint64(body))
+	case fuseOpendir:
+		out, err = s.opendir(p)
+	case fuseReaddir:
+		out, err = s.readdir(p, int(fuseEndian.Uint64(body[8:])), int(fuseEndian.Uint32(body[16:])))
+	default:
+		s.reply(unique, syscall.ENOSYS, nil)
+		return
+	}
+	s.reply(unique, fuseErrno(err), out)
+}
+
+func fuseErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	}
+	return syscall.EIO
+}
+
+// path of node id in fsys
+func (s *fuseServer) path(node uint64) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.paths[node]
+	return p, ok
+}
+
+// id of path in fsys, a new one if not yet
+func (s *fuseServer) id(p string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.ids[p]
+	if !ok {
+		id = uint64(len(s.ids) + 1)
+		s.ids[p] = id
+		s.paths[id] = p
+	}
+	return id
+}
+
+// fsPath the path of name in directory dir of a fs.FS
+func fsPath(dir, name string) string {
+	if dir == "." {
+		return name
+	}
+	return path.Join(dir, name)
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// putAttr fills fuse_attr
+func (s *fuseServer) putAttr(b []byte, id uint64, st fs.FileInfo) {
+	mode := uint32(st.Mode().Perm())
+	nlink := uint32(1)
+	if st.IsDir() {
+		mode |= syscall.S_IFDIR
+		nlink = 2
+	} else {
+		mode |= syscall.S_IFREG
+	}
+	fuseEndian.PutUint64(b, id)
+	fuseEndian.PutUint64(b[8:], uint64(st.Size()))
+	fuseEndian.PutUint64(b[16:], uint64(st.Size()+511)/512)
+	mtime := st.ModTime()
+	if !mtime.IsZero() {
+		for _, off := range []int{24, 32, 40} {
+			fuseEndian.PutUint64(b[off:], uint64(mtime.Unix()))
+			fuseEndian.PutUint32(b[48+(off-24)/2:], uint32(mtime.Nanosecond()))
+		}
+	}
+	fuseEndian.PutUint32(b[60:], mode)
+	fuseEndian.PutUint32(b[64:], nlink)
+	fuseEndian.PutUint32(b[68:], uint32(os.Getuid()))
+	fuseEndian.PutUint32(b[72:], uint32(os.Getgid()))
+	fuseEndian.PutUint32(b[80:], 4096)
+}
+
+func (s *fuseServer) lookup(p string) ([]byte, error) {
+	st, err := fs.Stat(s.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	id := s.id(p)
+	// fuse_entry_out
+	out := make([]byte, 40+88)
+	fuseEndian.PutUint64(out, id)
+	fuseEndian.PutUint64(out[16:], fuseValid)
+	fuseEndian.PutUint64(out[24:], fuseValid)
+	s.putAttr(out[40:], id, st)
+	return out, nil
+}
+
+func (s *fuseServer) getattr(p string) ([]byte, error) {
+	st, err := fs.Stat(s.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	// fuse_attr_out
+	out := make([]byte, 16+88)
+	fuseEndian.PutUint64(out, fuseValid)
+	s.putAttr(out[16:], s.id(p), st)
+	return out, nil
+}
+
+func (s *fuseServer) open(p string, flags uint32) ([]byte, error) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		return nil, syscall.EROFS
+	}
+	f, err := s.fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.nextFh++
+	fh := s.nextFh
+	s.files[fh] = &fuseHandle{f: f}
+	s.mu.Unlock()
+	// fuse_open_out
+	out := make([]byte, 16)
+	fuseEndian.PutUint64(out, fh)
+	fuseEndian.PutUint32(out[8:], fuseKeepCache)
+	return out, nil
+}
+
+func (s *fuseServer) read(fh uint64, off int64, size uint32) ([]byte, error) {
+	s.mu.Lock()
+	h := s.files[fh]
+	s.mu.Unlock()
+	if h == nil {
+		return nil, syscall.EBADF
+	}
+	b := make([]byte, size)
+	var n int
+	var err error
+	if r, ok := h.f.(io.ReaderAt); ok {
+		n, err = r.ReadAt(b, off)
+	} else if r, ok := h.f.(io.Seeker); ok {
+		h.mu.Lock()
+		_, err = r.Seek(off, io.SeekStart)
+		if err == nil {
+			n, err = io.ReadFull(h.f, b)
+		}
+		h.mu.Unlock()
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+	} else {
+		return nil, syscall.EIO
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+func (s *fuseServer) release(fh uint64) error {
+	s.mu.Lock()
+	h := s.files[fh]
+	delete(s.files, fh)
+	s.mu.Unlock()
+	if h == nil {
+		return syscall.EBADF
+	}
+	return h.f.Close()
+}
+
+func (s *fuseServer) opendir(p string) ([]byte, error) {
+	st, err := fs.Stat(s.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	return make([]byte, 16), nil
+}
+
+// readdir fuse_dirent of entries from offset off, as many as fit in size
+func (s *fuseServer) readdir(p string, off int, size int) ([]byte, error) {
+	entries, err := fs.ReadDir(s.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	type dirent struct {
+		id   uint64
+		name string
+		typ  uint32
+	}
+	parent := path.Dir(p)
+	list := []dirent{{s.id(p), ".", syscall.DT_DIR}, {s.id(parent), "..", syscall.DT_DIR}}
+	for _, e := range entries {
+		typ := uint32(syscall.DT_REG)
+		if e.IsDir() {
+			typ = syscall.DT_DIR
+		}
+		list = append(list, dirent{s.id(fsPath(p, e.Name())), e.Name(), typ})
+	}
+	var out []byte
+	for i := off; i < len(list); i++ {
+		e := list[i]
+		n := (24 + len(e.name) + 7) &^ 7
+		if len(out)+n > size {
+			break
+		}
+		b := make([]byte, n)
+		fuseEndian.PutUint64(b, e.id)
+		fuseEndian.PutUint64(b[8:], uint64(i+1))
+		fuseEndian.PutUint32(b[16:], uint32(len(e.name)))
+		fuseEndian.PutUint32(b[20:], e.typ)
+		copy(b[24:], e.name)
+		out = append(out, b...)
+	}
+	return out, nil
+}
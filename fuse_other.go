@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package gobt
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"runtime"
+)
+
+// Mount is only supported on linux
+func Mount(fsys fs.FS, dir string) (io.Closer, error) {
+	return nil, fmt.Errorf("mount is not supported on %s", runtime.GOOS)
+}
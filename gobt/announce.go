@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+
+	"github.com/picasso250/gobt"
+)
+
+// announce edits trackers of .torrent files, the info hash does not change
+func announce(args []string) error {
+	fs := flag.NewFlagSet("announce", flag.ExitOnError)
+	match := fs.String("match", "", "regexp of announce urls to rewrite")
+	replace := fs.String("replace", "", "replacement for -match, can use $1 etc.")
+	add := fs.String("add", "", "add a tracker")
+	remove := fs.String("remove", "", "remove a tracker")
+	out := fs.String("o", "", "output file, default rewrite in place (only one bt file)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("need bt file")
+	}
+	if *out != "" && fs.NArg() != 1 {
+		return errors.New("-o with more than one bt file")
+	}
+
+	var pattern *regexp.Regexp
+	if *match != "" {
+		var err error
+		pattern, err = regexp.Compile(*match)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, filename := range fs.Args() {
+		mi, err := gobt.NewMetainfoFromFile(filename)
+		if err != nil {
+			return err
+		}
+		if pattern != nil {
+			n := mi.RewriteAnnounce(pattern, *replace)
+			fmt.Printf("%s: %d urls rewritten\n", filename, n)
+		}
+		if *remove != "" && !mi.RemoveAnnounce(*remove) {
+			fmt.Printf("%s: no tracker %s\n", filename, *remove)
+		}
+		if *add != "" {
+			mi.AddAnnounce(*add)
+		}
+		if pattern == nil && *add == "" && *remove == "" {
+			fmt.Printf("%s:\n", filename)
+			urls := mi.AnnounceList
+			if len(urls) == 0 {
+				urls = []string{mi.Announce}
+			}
+			for _, u := range urls {
+				fmt.Printf("  %s\n", u)
+			}
+			continue
+		}
+		dst := filename
+		if *out != "" {
+			dst = *out
+		}
+		err = mi.WriteFile(dst)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
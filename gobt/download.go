@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/picasso250/gobt"
+)
+
+// configOverride is a flag for a config key, values are applied after the config file
+type configOverride struct {
+	key       string
+	overrides *[][2]string
+}
+
+func (f configOverride) String() string {
+	return ""
+}
+
+func (f configOverride) Set(value string) error {
+	*f.overrides = append(*f.overrides, [2]string{f.key, value})
+	return nil
+}
+
+// configFlags registers a flag for every config key, e.g. -max-peer-count for max_peer_count
+func configFlags(fs *flag.FlagSet) *[][2]string {
+	overrides := new([][2]string)
+	for _, key := range gobt.DefaultClientConfig().Keys() {
+		name := strings.Replace(key, "_", "-", -1)
+		fs.Var(configOverride{key, overrides}, name, "config "+key)
+	}
+	// shorthand
+	fs.Var(configOverride{"download_root", overrides}, "root", "download root directory")
+	return overrides
+}
+
+// loadConfig verbose logs to stderr
+func loadConfig(filename string, overrides [][2]string, verbose bool) (*gobt.ClientConfig, error) {
+	config := gobt.DefaultClientConfig()
+	if filename != "" {
+		var err error
+		config, err = gobt.LoadClientConfig(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, kv := range overrides {
+		err := config.Set(kv[0], kv[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if verbose {
+		config.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return config, nil
+}
+
+func download(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	configFile := fs.String("config", "", "config file, .json, .toml or .yaml")
+	verbose := fs.Bool("v", false, "log what peers and trackers do")
+	httpAddr := fs.String("http", "", "serve files of torrents over http at address, e.g. :8080")
+	overrides := configFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("need bt file")
+	}
+
+	config, err := loadConfig(*configFile, *overrides, *verbose)
+	if err != nil {
+		return err
+	}
+	client, err := gobt.NewClient(config)
+	if err != nil {
+		return err
+	}
+	var torrents []*gobt.Torrent
+	for _, filename := range fs.Args() {
+		t, err := client.AddTorrentFile(filename)
+		if err != nil {
+			return err
+		}
+		torrents = append(torrents, t)
+	}
+
+	if *httpAddr != "" {
+		go func() {
+			err := http.ListenAndServe(*httpAddr, gobt.NewHTTPHandler(client))
+			fmt.Printf("http: %s\n", err)
+		}()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go console(os.Stdin, client, torrents)
+	<-interrupt
+	fmt.Printf("stopping...\n")
+	return client.Close()
+}
+
+// console reads commands for the running torrents, one per line
+func console(f *os.File, client *gobt.Client, torrents []*gobt.Torrent) {
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		err := consoleCommand(fields, client, torrents)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+		}
+	}
+}
+
+func consoleCommand(fields []string, client *gobt.Client, torrents []*gobt.Torrent) error {
+	if len(fields) < 2 {
+		return errors.New(consoleUsage)
+	}
+	i, err := strconv.Atoi(fields[1])
+	if err != nil || i < 0 || i >= len(torrents) {
+		return fmt.Errorf("torrent index should be 0 to %d", len(torrents)-1)
+	}
+	t := torrents[i]
+	switch {
+	case fields[0] == "trackers" && len(fields) == 2:
+		for _, u := range t.Trackers() {
+			fmt.Println(u)
+		}
+		return nil
+	case fields[0] == "tracker" && len(fields) == 4 && fields[2] == "add":
+		return t.AddTracker(fields[3])
+	case fields[0] == "tracker" && len(fields) == 4 && fields[2] == "remove":
+		return t.RemoveTracker(fields[3])
+	case fields[0] == "tracker" && len(fields) == 5 && fields[2] == "replace":
+		return t.ReplaceTracker(fields[3], fields[4])
+	case fields[0] == "pause" && len(fields) == 2:
+		return t.Pause()
+	case fields[0] == "resume" && len(fields) == 2:
+		return t.Resume()
+	case fields[0] == "remove" && len(fields) == 2:
+		return client.RemoveTorrent(t)
+	case fields[0] == "verify" && len(fields) == 2:
+		report, err := t.Verify(nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("have %d/%d pieces\n", report.Have, report.Pieces)
+		return nil
+	case fields[0] == "files" && len(fields) == 2:
+		for _, f := range t.Files() {
+			fmt.Printf("%d %s %d/%d %s\n", f.Index(), f.Path, f.BytesCompleted(), f.Length, f.Priority())
+		}
+		return nil
+	case fields[0] == "priority" && len(fields) == 4:
+		f, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return err
+		}
+		p, err := gobt.ParsePiecePriority(fields[3])
+		if err != nil {
+			return err
+		}
+		return t.SetFilePriority(f, p)
+	case fields[0] == "move" && len(fields) == 3:
+		return t.MoveStorage(fields[2])
+	case fields[0] == "rename" && len(fields) == 4:
+		f, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return err
+		}
+		return t.RenameFile(f, fields[3])
+	}
+	return errors.New(consoleUsage)
+}
+
+const consoleUsage = `commands (n is the index of torrent in command line):
+  pause <n>
+  resume <n>
+  remove <n>
+  verify <n>
+  files <n>
+  priority <n> <file> skip|low|normal|high
+  move <n> <dir>
+  rename <n> <file> <path>
+  trackers <n>
+  tracker <n> add <url>
+  tracker <n> remove <url>
+  tracker <n> replace <old> <new>`
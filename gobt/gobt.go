@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"download", "download [-config file] [-root dir] [-http addr] [-<config-key> value]... <bt_file>...", download},
+	{"mount", "mount [-config file] [-root dir] [-<config-key> value]... <bt_file> <mount_point>", mount},
+	{"verify", "verify <bt_file> <dir>", verify},
+	{"announce", "announce [-match regexp -replace repl] [-add url] [-remove url] [-o out] <bt_file>...", announce},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", os.Args[0], c.usage)
+	}
+	os.Exit(1)
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			err := c.run(os.Args[2:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", c.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+}
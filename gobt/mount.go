@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/picasso250/gobt"
+)
+
+// mount downloads a torrent while its files are readable at the mount point
+func mount(args []string) error {
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	configFile := fs.String("config", "", "config file, .json, .toml or .yaml")
+	verbose := fs.Bool("v", false, "log what peers and trackers do")
+	overrides := configFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("need bt file and mount point")
+	}
+
+	config, err := loadConfig(*configFile, *overrides, *verbose)
+	if err != nil {
+		return err
+	}
+	client, err := gobt.NewClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	t, err := client.AddTorrentFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	m, err := gobt.Mount(t.FS(), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("mounted %s at %s\n", t.Metainfo.Info.Name, fs.Arg(1))
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	fmt.Printf("stopping...\n")
+	return m.Close()
+}
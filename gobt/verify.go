@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/picasso250/gobt"
+)
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("need bt file and download root directory")
+	}
+	mi, err := gobt.NewMetainfoFromFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	report, err := gobt.VerifyData(mi, fs.Arg(1), func(checked, total int) {
+		fmt.Printf("\rchecked %d/%d", checked, total)
+	})
+	fmt.Printf("\n")
+	if err != nil {
+		return err
+	}
+	for _, f := range report.Files {
+		switch {
+		case f.Corrupt:
+			fmt.Printf("corrupt    %s\n", f.Path)
+		case f.Missing:
+			fmt.Printf("missing    %s\n", f.Path)
+		case !f.Complete:
+			fmt.Printf("incomplete %s\n", f.Path)
+		}
+	}
+	fmt.Printf("have %d/%d pieces\n", report.Have, report.Pieces)
+	return nil
+}
@@ -0,0 +1,88 @@
+package gobt
+
+import (
+	"context"
+)
+
+const hashQueueSize = 64
+
+// hashJob a piece all blocks are written, to check hash of
+type hashJob struct {
+	t     *Torrent
+	index int
+}
+
+// startHashers starts config.HashWorkers goroutines checking hashes until ctx done
+func (c *Client) startHashers(ctx context.Context) {
+	n := c.config.HashWorkers
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		go c.hashWorker(ctx)
+	}
+}
+
+func (c *Client) hashWorker(ctx context.Context) {
+	for {
+		select {
+		case job := <-c.hashJobs:
+			job.t.verifyPiece(ctx, job.index)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// queueVerify queues a piece to check hash, false if ctx is done first
+func (t *Torrent) queueVerify(ctx context.Context, index int) bool {
+	select {
+	case t.client.hashJobs <- hashJob{t, index}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// verifyPiece checks hash of a written piece, it is downloaded again if wrong.
+// Nothing is done once the torrent is stopped, its storage may be closed.
+func (t *Torrent) verifyPiece(ctx context.Context, index int) {
+	t.hashMutex.RLock()
+	defer t.hashMutex.RUnlock()
+	if ctx.Err() != nil || t.ctx.Err() != nil {
+		return
+	}
+	info := t.Metainfo.Info
+	var h hash
+	copy(h[:], info.Pieces[index*hashSize:(index+1)*hashSize])
+	isValid, err := checkHash(t.storage, info, index, h)
+	if err == nil && isValid {
+		err = t.storage.MarkComplete(index)
+	}
+	if err == nil && isValid {
+		// before reset, so it is not picked again
+		err = t.bitfield.SetBit(index, 1)
+	}
+	from := t.resetPiece(index)
+	if ctx.Err() != nil || t.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		t.diskError(err)
+		return
+	}
+	if !isValid {
+		t.hashFailed(index, from)
+		return
+	}
+	t.havePiece()
+	t.saveResumeLater()
+}
+
+// resetPiece forgets blocks of a piece and lets it be picked, returns the peers which sent them
+func (t *Torrent) resetPiece(index int) []*peer {
+	from := t.blocks.verified(uint32(index))
+	t.pieces.setPartial(index, false)
+	t.pieces.release(index)
+	return from
+}
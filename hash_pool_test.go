@@ -0,0 +1,131 @@
+package gobt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+func TestCheckHash(t *testing.T) {
+	data := []byte("hello world")
+	info := testMetainfo("a", data, 4).Info
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "a"), data, 0664); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < info.piecesCount(); i++ {
+		var h hash
+		copy(h[:], info.Pieces[i*hashSize:])
+		if ok, err := checkHash(newFileStorage(info, root, newFileCache(1)), info, i, h); !ok || err != nil {
+			t.Errorf("single file piece %d %v %v", i, ok, err)
+		}
+	}
+
+	// pieces across files
+	multi, err := NewMetainfoInfoFromMap(map[string]interface{}{
+		"name":         []byte("m"),
+		"piece length": int64(4),
+		"pieces":       []byte(info.Pieces),
+		"files": []interface{}{
+			map[string]interface{}{"length": int64(6), "path": []interface{}{[]byte("x")}},
+			map[string]interface{}{"length": int64(5), "path": []interface{}{[]byte("y")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(root, "m"), 0775)
+	ioutil.WriteFile(filepath.Join(root, "m", "x"), data[:6], 0664)
+	ioutil.WriteFile(filepath.Join(root, "m", "y"), []byte("worlx"), 0664)
+	for i, want := range []bool{true, true, false} {
+		var h hash
+		copy(h[:], multi.Pieces[i*hashSize:])
+		if ok, err := checkHash(newFileStorage(multi, root, newFileCache(1)), multi, i, h); ok != want || err != nil {
+			t.Errorf("multi file piece %d %v %v", i, ok, err)
+		}
+	}
+}
+
+func TestBadPieceBan(t *testing.T) {
+	data := []byte("hello")
+	config := DefaultClientConfig()
+	config.RequestTimeout = 200 * time.Millisecond // ticks faster
+	c, tt := testTorrent(t, config, testMetainfo("a", data, len(data)))
+	defer c.Close()
+	conn := connectPeer(t, tt)
+	defer conn.Close()
+	writeMessages(t, conn,
+		&peerwire.Message{ID: peerwire.Bitfield, Bitfield: []byte{0x80}},
+		&peerwire.Message{ID: peerwire.Unchoke},
+	)
+
+	// the piece is downloaded again after each bad one
+	for i := 0; i < maxHashFailures; i++ {
+		nextMessage(t, conn, peerwire.Request)
+		writeMessages(t, conn, &peerwire.Message{ID: peerwire.Piece, Block: []byte("jello")})
+	}
+	timeout := time.After(5 * time.Second)
+	for banned := false; !banned; {
+		select {
+		case e := <-c.Events():
+			banned = e.Type == EventPeerBanned
+		case <-timeout:
+			t.Fatalf("not banned")
+		}
+	}
+	if !c.bans.banned("127.0.0.1") || tt.bitfield.Bit(0) != 0 {
+		t.Errorf("ban list %v, bitfield %x", c.bans.bans, tt.bitfield.BitData())
+	}
+	for {
+		if _, err := peerwire.ReadMessage(conn); err != nil {
+			break
+		}
+	}
+}
+
+func TestVerifyPiece(t *testing.T) {
+	data := []byte("hello")
+	config := DefaultClientConfig()
+	config.RequestTimeout = 200 * time.Millisecond // ticks faster
+	c, tt := testTorrent(t, config, testMetainfo("a", data, len(data)))
+	defer c.Close()
+	conn := connectPeer(t, tt)
+	defer conn.Close()
+	writeMessages(t, conn,
+		&peerwire.Message{ID: peerwire.Bitfield, Bitfield: []byte{0x80}},
+		&peerwire.Message{ID: peerwire.Unchoke},
+	)
+	nextMessage(t, conn, peerwire.Request)
+	writeMessages(t, conn, &peerwire.Message{ID: peerwire.Piece, Block: data})
+	// no more to want after the piece is verified
+	nextMessage(t, conn, peerwire.NotInterested)
+	if tt.bitfield.Bit(0) != 1 {
+		t.Errorf("piece not verified")
+	}
+}
+
+func TestVerifyPieceAfterStop(t *testing.T) {
+	data := []byte("hello")
+	config := DefaultClientConfig()
+	config.Storage = "mmap"
+	c, tt := testTorrent(t, config, testMetainfo("a", data, len(data)))
+	defer c.Close()
+	tt.Pause()
+	tt.storage.WriteAt(0, data, 0)
+	tt.Stop()
+	// a job queued before the storage is closed
+	tt.verifyPiece(context.Background(), 0)
+	if tt.bitfield.Bit(0) != 0 {
+		t.Errorf("piece verified after stop")
+	}
+	select {
+	case e := <-c.Events():
+		t.Errorf("event after stop: %v %v", e.Type, e.Err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,145 @@
+package gobt
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// httpHandler serves files of torrents of a client.
+// "/" lists torrents, "/<info hash>/<path>" is a file or a directory of a torrent.
+type httpHandler struct {
+	c *Client
+}
+
+// NewHTTPHandler serves files of torrents of the client while they are downloading,
+// with Range and If-Range. Pieces are downloaded first when read.
+func NewHTTPHandler(c *Client) http.Handler {
+	return &httpHandler{c}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if p == "" {
+		h.listTorrents(w)
+		return
+	}
+	ih, name := p, ""
+	if i := strings.IndexByte(p, '/'); i != -1 {
+		ih, name = p[:i], p[i+1:]
+	}
+	t := h.torrent(ih)
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, f := range t.Files() {
+		if filepath.ToSlash(f.Path) == name {
+			serveFile(w, r, t, f)
+			return
+		}
+	}
+	// a directory ends with /, as links in it are relative
+	entries := dirEntries(t, name)
+	if len(entries) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+		return
+	}
+	listDir(w, "/"+p+"/", entries)
+}
+
+func (h *httpHandler) torrent(infoHash string) *Torrent {
+	for _, t := range h.c.Torrents() {
+		if fmt.Sprintf("%x", t.InfoHash()) == strings.ToLower(infoHash) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (h *httpHandler) listTorrents(w http.ResponseWriter) {
+	torrents := h.c.Torrents()
+	entries := make([]dirEntry, len(torrents))
+	for i, t := range torrents {
+		entries[i] = dirEntry{fmt.Sprintf("%x/", t.InfoHash()), t.Metainfo.Info.Name}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].title < entries[j].title
+	})
+	listDir(w, "/", entries)
+}
+
+// dirEntry a link in a directory listing
+type dirEntry struct {
+	href  string // relative and escaped, ends with / for a directory
+	title string
+}
+
+// dirEntries files and directories in directory dir of a torrent, dir is "" for the top
+func dirEntries(t *Torrent, dir string) []dirEntry {
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+	seen := make(map[string]bool)
+	var entries []dirEntry
+	for _, f := range t.Files() {
+		name := filepath.ToSlash(f.Path)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		name = name[len(prefix):]
+		if i := strings.IndexByte(name, '/'); i != -1 {
+			name = name[:i+1]
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		// URL adds ./ if a name with : may be taken as a scheme
+		entries = append(entries, dirEntry{(&url.URL{Path: name}).String(), name})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].title < entries[j].title
+	})
+	return entries
+}
+
+func listDir(w http.ResponseWriter, dir string, entries []dirEntry) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<h1>%s</h1>\n<ul>\n", html.EscapeString(dir), html.EscapeString(dir))
+	for _, e := range entries {
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(e.href), html.EscapeString(e.title))
+	}
+	fmt.Fprintf(w, "</ul>\n")
+}
+
+// serveFile Content-Type is by extension, or sniffed from the first bytes
+func serveFile(w http.ResponseWriter, r *http.Request, t *Torrent, f *TorrentFile) {
+	reader := f.NewReader()
+	defer reader.Close()
+	go func() {
+		// a read waiting for pieces returns when the client is gone
+		<-r.Context().Done()
+		reader.Close()
+	}()
+	// data of a file never changes, so If-Range can be checked by it
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%d\"", t.InfoHash(), f.Index()))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, path.Base(filepath.ToSlash(f.Path)), time.Time{}, reader)
+}
@@ -0,0 +1,66 @@
+package gobt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	data := []byte("hello world")
+	mi := testFilesMetainfo("m", data, 4, []string{"x", "empty", "d/y.txt"}, []int64{3, 0, 8})
+	c, tt := testTorrent(t, DefaultClientConfig(), mi)
+	defer c.Close()
+	tt.Pause()
+	for i := 0; i < mi.Info.piecesCount(); i++ {
+		writePiece(t, tt, data, i)
+	}
+	server := httptest.NewServer(NewHTTPHandler(c))
+	defer server.Close()
+	ih := fmt.Sprintf("%x", tt.InfoHash())
+
+	get := func(path string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %s error: %v", path, err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	if _, body := get("/"); !strings.Contains(body, `href="`+ih+`/"`) {
+		t.Errorf("torrents %s", body)
+	}
+	// redirected to m/
+	res, body := get("/" + ih + "/m")
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `href="d/"`) || !strings.Contains(body, `href="x"`) || !strings.Contains(body, `href="empty"`) {
+		t.Errorf("listing %d %s", res.StatusCode, body)
+	}
+	res, body = get("/" + ih + "/m/d/y.txt")
+	if res.StatusCode != http.StatusOK || body != "lo world" || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("file %d %q %s", res.StatusCode, body, res.Header.Get("Content-Type"))
+	}
+	etag := res.Header.Get("ETag")
+	res, body = get("/"+ih+"/m/d/y.txt", "Range", "bytes=2-4", "If-Range", etag)
+	if res.StatusCode != http.StatusPartialContent || body != " wo" || res.Header.Get("Content-Range") != "bytes 2-4/8" {
+		t.Errorf("range %d %q %s", res.StatusCode, body, res.Header.Get("Content-Range"))
+	}
+	res, body = get("/"+ih+"/m/d/y.txt", "Range", "bytes=2-4", "If-Range", `"other"`)
+	if res.StatusCode != http.StatusOK || body != "lo world" {
+		t.Errorf("if-range %d %q", res.StatusCode, body)
+	}
+	if res, _ = get("/" + ih + "/m/z"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file %d", res.StatusCode)
+	}
+	if res, _ = get("/00/m/x"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing torrent %d", res.StatusCode)
+	}
+}
@@ -1,8 +1,11 @@
 package gobt
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"regexp"
 )
 
 // Metainfo Metainfo files (also known as .torrent files)
@@ -15,22 +18,166 @@ type Metainfo struct {
 }
 
 // NewMetainfoFromMap builds a Metainfo
-func NewMetainfoFromMap(m map[string]interface{}) *Metainfo {
-	info := m["info"].(map[string]interface{})
+func NewMetainfoFromMap(m map[string]interface{}) (*Metainfo, error) {
+	info, ok := m["info"].(map[string]interface{})
+	if !ok {
+		return nil, badMetainfo("info")
+	}
+	mii, err := NewMetainfoInfoFromMap(info)
+	if err != nil {
+		return nil, err
+	}
+	ih, err := infoHash(info)
+	if err != nil {
+		return nil, err
+	}
 	mi := Metainfo{
-		Info:       NewMetainfoInfoFromMap(info),
-		InfoHash:   infoHash(info),
+		Info:       mii,
+		InfoHash:   ih,
 		OriginData: m,
 	}
-	if m["announce"] != nil {
-		mi.Announce = string(m["announce"].([]byte))
+	err = mi.checkAnnounce()
+	if err != nil {
+		return nil, err
+	}
+	mi.loadAnnounce()
+	return &mi, nil
+}
+
+func badMetainfo(key string) error {
+	return fmt.Errorf("%w: %s", ErrBadMetainfo, key)
+}
+
+// checkAnnounce makes sure loadAnnounce will not panic
+func (m *Metainfo) checkAnnounce() error {
+	if a, ok := m.OriginData["announce"]; ok {
+		if _, ok := a.([]byte); !ok {
+			return badMetainfo("announce")
+		}
+	}
+	if l, ok := m.OriginData["announce-list"]; ok {
+		tiers, ok := l.([]interface{})
+		if !ok {
+			return badMetainfo("announce-list")
+		}
+		for _, a := range flat(tiers) {
+			if _, ok := a.([]byte); !ok {
+				return badMetainfo("announce-list")
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Metainfo) loadAnnounce() {
+	m.Announce = ""
+	m.AnnounceList = nil
+	if m.OriginData["announce"] != nil {
+		m.Announce = string(m.OriginData["announce"].([]byte))
+	}
+	if m.OriginData["announce-list"] != nil {
+		for _, a := range flat(m.OriginData["announce-list"].([]interface{})) {
+			m.AnnounceList = append(m.AnnounceList, string(a.([]byte)))
+		}
 	}
-	if m["announce-list"] != nil {
-		for _, a := range flat(m["announce-list"].([]interface{})) {
-			mi.AnnounceList = append(mi.AnnounceList, string(a.([]byte)))
+}
+
+// RewriteAnnounce replaces pattern with repl in every announce url, returns how many urls changed.
+// Only announce and announce-list are touched, so the info hash stays the same.
+func (m *Metainfo) RewriteAnnounce(pattern *regexp.Regexp, repl string) int {
+	n := 0
+	rewrite := func(v interface{}) interface{} {
+		old := v.([]byte)
+		b := pattern.ReplaceAll(old, []byte(repl))
+		if !bytes.Equal(b, old) {
+			n++
+		}
+		return b
+	}
+	if m.OriginData["announce"] != nil {
+		m.OriginData["announce"] = rewrite(m.OriginData["announce"])
+	}
+	if m.OriginData["announce-list"] != nil {
+		for _, tier := range m.OriginData["announce-list"].([]interface{}) {
+			if tier, ok := tier.([]interface{}); ok {
+				for i := range tier {
+					tier[i] = rewrite(tier[i])
+				}
+			}
 		}
 	}
-	return &mi
+	m.loadAnnounce()
+	return n
+}
+
+// AddAnnounce adds a tracker in a tier of its own
+func (m *Metainfo) AddAnnounce(announce string) {
+	if m.OriginData["announce"] == nil {
+		m.OriginData["announce"] = []byte(announce)
+	}
+	var list []interface{}
+	if m.OriginData["announce-list"] != nil {
+		list = m.OriginData["announce-list"].([]interface{})
+	} else if announce != m.Announce && m.Announce != "" {
+		// announce-list takes precedence, keep the old tracker in it
+		list = []interface{}{[]interface{}{[]byte(m.Announce)}}
+	}
+	m.OriginData["announce-list"] = append(list, []interface{}{[]byte(announce)})
+	m.loadAnnounce()
+}
+
+// RemoveAnnounce removes a tracker, returns false if there is no such tracker
+func (m *Metainfo) RemoveAnnounce(announce string) bool {
+	found := false
+	if m.OriginData["announce-list"] != nil {
+		var list []interface{}
+		for _, tier := range m.OriginData["announce-list"].([]interface{}) {
+			t, ok := tier.([]interface{})
+			if !ok {
+				continue
+			}
+			var left []interface{}
+			for _, a := range t {
+				if string(a.([]byte)) == announce {
+					found = true
+				} else {
+					left = append(left, a)
+				}
+			}
+			if len(left) != 0 {
+				list = append(list, left)
+			}
+		}
+		if len(list) == 0 {
+			delete(m.OriginData, "announce-list")
+		} else {
+			m.OriginData["announce-list"] = list
+		}
+	}
+	if m.Announce == announce {
+		found = true
+		delete(m.OriginData, "announce")
+		m.loadAnnounce()
+		if len(m.AnnounceList) != 0 {
+			m.OriginData["announce"] = []byte(m.AnnounceList[0])
+		}
+	}
+	m.loadAnnounce()
+	return found
+}
+
+// Bytes bencodes the metainfo
+func (m *Metainfo) Bytes() ([]byte, error) {
+	return Encode(m.OriginData)
+}
+
+// WriteFile writes the metainfo as a .torrent file
+func (m *Metainfo) WriteFile(filename string) error {
+	b, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0664)
 }
 
 // NewMetainfoFromFile read file and return metainfo
@@ -43,7 +190,11 @@ func NewMetainfoFromFile(filename string) (*Metainfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewMetainfoFromMap(vv.(map[string]interface{})), nil
+	m, ok := vv.(map[string]interface{})
+	if !ok {
+		return nil, badMetainfo("not a dictionary")
+	}
+	return NewMetainfoFromMap(m)
 }
 func (m *Metainfo) String() string {
 	return valueToString(m.OriginData, "pieces")
@@ -71,36 +222,80 @@ type MetainfoInfo struct {
 }
 
 // NewMetainfoInfoFromMap builds a map
-func NewMetainfoInfoFromMap(m map[string]interface{}) *MetainfoInfo {
+func NewMetainfoInfoFromMap(m map[string]interface{}) (*MetainfoInfo, error) {
+	name, ok := m["name"].([]byte)
+	if !ok || !pathPart(string(name)) {
+		return nil, badMetainfo("name")
+	}
+	pieceLength, ok := m["piece length"].(int64)
+	if !ok || pieceLength <= 0 {
+		return nil, badMetainfo("piece length")
+	}
+	pieces, ok := m["pieces"].([]byte)
+	if !ok || len(pieces)%hashSize != 0 {
+		return nil, badMetainfo("pieces")
+	}
 	mi := MetainfoInfo{
-		Name:        string(m["name"].([]byte)),
-		PieceLength: int(m["piece length"].(int64)),
-		Pieces:      m["pieces"].([]byte),
+		Name:        string(name),
+		PieceLength: int(pieceLength),
+		Pieces:      pieces,
 		OriginData:  m,
 	}
 	if m["length"] != nil {
-		mi.Length = m["length"].(int64)
+		mi.Length, ok = m["length"].(int64)
+		if !ok || mi.Length < 0 {
+			return nil, badMetainfo("length")
+		}
 	}
 	if m["files"] != nil {
-		for _, f := range m["files"].([]interface{}) {
-			mi.Files = append(mi.Files, NewFileFromMap(f.(map[string]interface{})))
+		files, ok := m["files"].([]interface{})
+		if !ok {
+			return nil, badMetainfo("files")
+		}
+		for _, f := range files {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, badMetainfo("files")
+			}
+			file, err := NewFileFromMap(fm)
+			if err != nil {
+				return nil, err
+			}
+			mi.Files = append(mi.Files, file)
 		}
 	}
+	// a piece of every piece length, the last one may be short
+	total := mi.totalLength()
+	if total < 0 || int64(mi.piecesCount()) != (total+pieceLength-1)/pieceLength {
+		return nil, badMetainfo("pieces")
+	}
 
-	return &mi
+	return &mi, nil
 }
 
 func (info *MetainfoInfo) piecesCount() int {
 	return len([]byte(info.Pieces)) / hashSize
 }
-func (info *MetainfoInfo) filename() string {
-	return buildPath(DownloadRoot, info.Name)
+
+// pieceSize length of piece index, the last piece may be short
+func (info *MetainfoInfo) pieceSize(index int) int {
+	if index == info.piecesCount()-1 {
+		return int(info.totalLength() - int64(index)*int64(info.PieceLength))
+	}
+	return info.PieceLength
 }
-func (info *MetainfoInfo) infoFilename() string {
-	return info.filename() + ".btinfo"
+func (info *MetainfoInfo) totalLength() int64 {
+	if len(info.Files) == 0 {
+		return info.Length
+	}
+	sum := int64(0)
+	for _, f := range info.Files {
+		sum += f.Length
+	}
+	return sum
 }
-func (info *MetainfoInfo) bitfield() (*bitfield, error) {
-	return bitfieldFromFile(info.infoFilename())
+func (info *MetainfoInfo) filename(root string) string {
+	return buildPath(root, info.Name)
 }
 
 type peerID [peerIDSize]byte
@@ -0,0 +1,147 @@
+package gobt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"testing"
+)
+
+func TestMetainfoBytes(t *testing.T) {
+	dat, err := ioutil.ReadFile("a.txt.torrent")
+	if err != nil {
+		t.Fatalf("read file error: %v", err)
+	}
+	mi, err := NewMetainfoFromFile("a.txt.torrent")
+	if err != nil {
+		t.Fatalf("metainfo %s", err)
+	}
+	b, err := mi.Bytes()
+	if err != nil {
+		t.Fatalf("encode error %s", err)
+	}
+	if !bytes.Equal(b, dat) {
+		t.Errorf("encode not same as file")
+	}
+}
+
+func TestRewriteAnnounce(t *testing.T) {
+	mi, err := NewMetainfoFromFile("a.txt.torrent")
+	if err != nil {
+		t.Fatalf("metainfo %s", err)
+	}
+	ih := mi.InfoHash
+
+	n := mi.RewriteAnnounce(regexp.MustCompile(`^https://1337\.abcvg\.info(:443)?/`), "https://tracker.example.com/passkey/")
+	if n != 3 {
+		t.Errorf("rewrite %d urls", n)
+	}
+	if mi.Announce != "https://tracker.example.com/passkey/announce" {
+		t.Errorf("announce %s", mi.Announce)
+	}
+
+	mi.AddAnnounce("udp://tracker.example.com:80")
+	if !mi.RemoveAnnounce("http://54.39.98.124:80/announce") {
+		t.Errorf("remove failed")
+	}
+	if mi.RemoveAnnounce("http://not.exists/announce") {
+		t.Errorf("remove not exists")
+	}
+
+	b, err := mi.Bytes()
+	if err != nil {
+		t.Fatalf("encode error %s", err)
+	}
+	v, err := Parse(b)
+	if err != nil {
+		t.Fatalf("parse error %s", err)
+	}
+	mi2, err := NewMetainfoFromMap(v.(map[string]interface{}))
+	if err != nil {
+		t.Fatalf("metainfo error %s", err)
+	}
+	if mi2.InfoHash != ih {
+		t.Errorf("info hash changed")
+	}
+	want := []string{
+		"https://tracker.example.com/passkey/announce",
+		"https://tracker.example.com/passkey/announce",
+		"udp://tracker.example.com:80",
+	}
+	if len(mi2.AnnounceList) != len(want) {
+		t.Fatalf("announce list %v", mi2.AnnounceList)
+	}
+	for i, a := range want {
+		if mi2.AnnounceList[i] != a {
+			t.Errorf("announce list %v", mi2.AnnounceList)
+		}
+	}
+}
+
+func TestMetainfoPaths(t *testing.T) {
+	info := func(name string, path ...string) map[string]interface{} {
+		var list []interface{}
+		for _, p := range path {
+			list = append(list, []byte(p))
+		}
+		return map[string]interface{}{
+			"name":         []byte(name),
+			"piece length": int64(4),
+			"pieces":       make([]byte, hashSize),
+			"files":        []interface{}{map[string]interface{}{"length": int64(4), "path": list}},
+		}
+	}
+	if _, err := NewMetainfoInfoFromMap(info("m", "d", "x")); err != nil {
+		t.Errorf("metainfo error %s", err)
+	}
+	bad := [][]string{
+		{"..", "x"},
+		{"m", "..", "..", "etc", "passwd"},
+		{"m", ""},
+		{"m", "."},
+		{"m", "/etc/passwd"},
+		{"m", "d/../../x"},
+		{"m", `..\x`},
+		{"/tmp", "x"},
+		{"", "x"},
+	}
+	for _, paths := range bad {
+		if _, err := NewMetainfoInfoFromMap(info(paths[0], paths[1:]...)); !errors.Is(err, ErrBadMetainfo) {
+			t.Errorf("path %q: %v", paths, err)
+		}
+	}
+}
+
+func TestMetainfoSizes(t *testing.T) {
+	single := func(length int64, hashes int) map[string]interface{} {
+		return map[string]interface{}{
+			"name":         []byte("a"),
+			"piece length": int64(16384),
+			"pieces":       make([]byte, hashes*hashSize),
+			"length":       length,
+		}
+	}
+	if _, err := NewMetainfoInfoFromMap(single(16385, 2)); err != nil {
+		t.Errorf("metainfo error %s", err)
+	}
+	if _, err := NewMetainfoInfoFromMap(single(10, 2)); !errors.Is(err, ErrBadMetainfo) {
+		t.Errorf("more hashes than pieces: %v", err)
+	}
+	if _, err := NewMetainfoInfoFromMap(single(16385, 1)); !errors.Is(err, ErrBadMetainfo) {
+		t.Errorf("fewer hashes than pieces: %v", err)
+	}
+	if _, err := NewMetainfoInfoFromMap(single(-1, 0)); !errors.Is(err, ErrBadMetainfo) {
+		t.Errorf("negative length: %v", err)
+	}
+
+	m := single(0, 1)
+	delete(m, "length")
+	m["files"] = []interface{}{
+		map[string]interface{}{"length": int64(20), "path": []interface{}{[]byte("x")}},
+		map[string]interface{}{"length": int64(-10), "path": []interface{}{[]byte("y")}},
+	}
+	if _, err := NewMetainfoInfoFromMap(m); !errors.Is(err, ErrBadMetainfo) {
+		t.Errorf("negative file length: %v", err)
+	}
+}
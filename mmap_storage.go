@@ -0,0 +1,319 @@
+package gobt
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+)
+
+// mmapRegionSize huge files are mapped in regions of it, a multiple of page size
+var mmapRegionSize int64 = 1 << 30
+
+// ErrStorageClosed reads and writes of mmap storage after it is closed, e.g. when the torrent is stopped
+var ErrStorageClosed = errors.New("storage closed")
+
+// errMmapFault a fault accessing a mapping, e.g. the file is truncated by another program
+var errMmapFault = errors.New("fault accessing memory mapped file")
+
+// ErrMmapSkip files of mmap storage are of full length, wanted or not,
+// adding a torrent or setting a file with PrioritySkip fails with it
+var ErrMmapSkip = errors.New("files can not be skipped in mmap storage")
+
+// pieceHasher a storage which hashes pieces itself, e.g. without copying them
+type pieceHasher interface {
+	hashPiece(index int) (hash, error)
+}
+
+// blockMapper a storage whose blocks are in memory, sent to peers without a copy.
+// Blocks stay valid until the storage is closed.
+type blockMapper interface {
+	// mappedBlock n bytes at off in piece index, nil if they are not in memory
+	mappedBlock(index int, off int64, n int) []byte
+}
+
+// mmapStorage files under download root mapped into memory, reads and writes are copies,
+// blocks sent to peers are the mapping itself.
+// Regions failed to map, e.g. out of address space, are read and written by pread and pwrite.
+// Files are sparse, a write to a hole faults if the disk is full, which is caught as ErrDiskFull.
+type mmapStorage struct {
+	mu     sync.RWMutex // write locked to close
+	info   *MetainfoInfo
+	root   string
+	files  []*mmapFile
+	closed bool
+}
+
+type mmapFile struct {
+	fileRange
+	f       *os.File
+	regions [][]byte // nil if failed to map
+}
+
+// NewMmapStorage a storage mapping files of the torrent into memory, files are created of full length
+func NewMmapStorage(info *MetainfoInfo, root string) (Storage, error) {
+	err := ensureFile(context.Background(), root, info, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &mmapStorage{info: info, root: root}
+	for _, r := range fileRanges(info) {
+		mf, err := openMmapFile(filepath.Join(root, r.path), r)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, mf)
+	}
+	return s, nil
+}
+
+func openMmapFile(filename string, r fileRange) (*mmapFile, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err == nil && st.Size() < r.length {
+		// a mapping past the end of file faults
+		err = f.Truncate(r.length)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	mf := &mmapFile{fileRange: r, f: f}
+	for off := int64(0); off < r.length; off += mmapRegionSize {
+		n := r.length - off
+		if n > mmapRegionSize {
+			n = mmapRegionSize
+		}
+		region, err := mmap(f, off, int(n))
+		if err != nil {
+			region = nil
+		}
+		mf.regions = append(mf.regions, region)
+	}
+	return mf, nil
+}
+
+// span calls fn for every part of n bytes at pos in data of the torrent,
+// region is the mapping of the part, or nil then fn reads or writes the file at off
+func (s *mmapStorage) span(pos int64, n int64, fn func(mf *mmapFile, region []byte, off int64, n int64) error) error {
+	for _, mf := range s.files {
+		if n == 0 {
+			break
+		}
+		if pos >= mf.offset+mf.length {
+			continue
+		}
+		off := pos - mf.offset
+		for n > 0 && off < mf.length {
+			i := off / mmapRegionSize
+			roff := off - i*mmapRegionSize
+			m := mmapRegionSize - roff
+			if m > mf.length-off {
+				m = mf.length - off
+			}
+			if m > n {
+				m = n
+			}
+			var region []byte
+			if mf.regions[i] != nil {
+				region = mf.regions[i][roff : roff+m]
+			}
+			err := fn(mf, region, off, m)
+			if err != nil {
+				return err
+			}
+			off += m
+			pos += m
+			n -= m
+		}
+	}
+	return nil
+}
+
+func (s *mmapStorage) ReadAt(index int, b []byte, off int64) (int, error) {
+	pos, err := pieceOffset(s.info, index, off, len(b))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+	buf := b
+	err = s.span(pos, int64(len(b)), func(mf *mmapFile, region []byte, off int64, n int64) error {
+		p := buf[:n]
+		buf = buf[n:]
+		if region != nil {
+			return catchFault(func() { copy(p, region) })
+		}
+		return mf.readAt(p, off)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readAt reads by pread, bytes not written yet are zero
+func (mf *mmapFile) readAt(p []byte, off int64) error {
+	m, err := mf.f.ReadAt(p, off)
+	if err == io.EOF {
+		for i := m; i < len(p); i++ {
+			p[i] = 0
+		}
+		err = nil
+	}
+	return err
+}
+
+func (s *mmapStorage) WriteAt(index int, b []byte, off int64) (int, error) {
+	pos, err := pieceOffset(s.info, index, off, len(b))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+	buf := b
+	err = s.span(pos, int64(len(b)), func(mf *mmapFile, region []byte, off int64, n int64) error {
+		p := buf[:n]
+		buf = buf[n:]
+		if region != nil {
+			return catchFault(func() { copy(region, p) })
+		}
+		_, err := mf.f.WriteAt(p, off)
+		return err
+	})
+	if err == errMmapFault {
+		// the system found no block for a page of a hole
+		return 0, fmt.Errorf("%w: %s", ErrDiskFull, err)
+	}
+	if err != nil {
+		return 0, diskFull(err)
+	}
+	return len(b), nil
+}
+
+// hashPiece hashes the mapping, only parts not mapped are copied
+func (s *mmapStorage) hashPiece(index int) (hash, error) {
+	var ih hash
+	size := s.info.pieceSize(index)
+	pos, err := pieceOffset(s.info, index, 0, size)
+	if err != nil {
+		return ih, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ih, ErrStorageClosed
+	}
+	h := sha1.New()
+	err = s.span(pos, int64(size), func(mf *mmapFile, region []byte, off int64, n int64) error {
+		if region == nil {
+			region = make([]byte, n)
+			err := mf.readAt(region, off)
+			if err != nil {
+				return err
+			}
+		}
+		return catchFault(func() { h.Write(region) })
+	})
+	copy(ih[:], h.Sum(nil))
+	return ih, err
+}
+
+// mappedBlock is in one region, so it is not copied
+func (s *mmapStorage) mappedBlock(index int, off int64, n int) []byte {
+	pos, err := pieceOffset(s.info, index, off, n)
+	if err != nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil
+	}
+	var block []byte
+	parts := 0
+	s.span(pos, int64(n), func(mf *mmapFile, region []byte, off int64, n int64) error {
+		block = region
+		parts++
+		return nil
+	})
+	if parts != 1 {
+		return nil
+	}
+	return block
+}
+
+// catchFault runs fn, a fault accessing a mapping in it is errMmapFault instead of a crash
+func catchFault(fn func()) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if _, ok := r.(interface{ Addr() uintptr }); !ok {
+			panic(r)
+		}
+		err = errMmapFault
+	}()
+	fn()
+	return nil
+}
+
+// allocate reserves disk space if full, files are of full length already, so none may be skipped
+func (s *mmapStorage) allocate(mode Allocation, skip []bool) error {
+	for _, v := range skip {
+		if v {
+			return ErrMmapSkip
+		}
+	}
+	if mode != AllocateFull {
+		return nil
+	}
+	return allocateFiles(s.root, fileRanges(s.info), mode, nil)
+}
+
+// MarkComplete does nothing, written data is in page cache and saved by the system
+func (s *mmapStorage) MarkComplete(index int) error {
+	return nil
+}
+
+// Close unmaps and closes all files
+func (s *mmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	for _, mf := range s.files {
+		for _, region := range mf.regions {
+			if region == nil {
+				continue
+			}
+			if err2 := munmap(region); err == nil {
+				err = err2
+			}
+		}
+		if err2 := mf.f.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
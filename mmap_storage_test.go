@@ -0,0 +1,188 @@
+package gobt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+func TestMmapStorage(t *testing.T) {
+	page := int64(os.Getpagesize())
+	defer func(size int64) { mmapRegionSize = size }(mmapRegionSize)
+	mmapRegionSize = page
+
+	data := make([]byte, 3*page+100)
+	rand.Read(data)
+	pieceLength := int(page / 2)
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[i:end])
+		pieces = append(pieces, h[:]...)
+	}
+	info, err := NewMetainfoInfoFromMap(map[string]interface{}{
+		"name":         []byte("m"),
+		"piece length": int64(pieceLength),
+		"pieces":       pieces,
+		"files": []interface{}{
+			map[string]interface{}{"length": int64(100), "path": []interface{}{[]byte("x")}},
+			map[string]interface{}{"length": int64(0), "path": []interface{}{[]byte("empty")}},
+			map[string]interface{}{"length": 3 * page, "path": []interface{}{[]byte("y")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	s, err := NewMmapStorage(info, root)
+	if err != nil {
+		t.Fatalf("new storage error: %v", err)
+	}
+	// a region failed to map is read and written by the file
+	y := s.(*mmapStorage).files[2]
+	munmap(y.regions[1])
+	y.regions[1] = nil
+
+	for i := 0; i < info.piecesCount(); i++ {
+		begin := i * pieceLength
+		if _, err := s.WriteAt(i, data[begin:begin+info.pieceSize(i)], 0); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	b := make([]byte, 2*page)
+	if _, err := s.ReadAt(1, b[:pieceLength], 0); err != nil || !bytes.Equal(b[:pieceLength], data[pieceLength:2*pieceLength]) {
+		t.Errorf("read across files %v", err)
+	}
+	for i := 0; i < info.piecesCount(); i++ {
+		var h hash
+		copy(h[:], info.Pieces[i*hashSize:])
+		if ok, err := checkHash(s, info, i, h); !ok || err != nil {
+			t.Errorf("piece %d %v %v", i, ok, err)
+		}
+	}
+
+	// blocks sent to peers
+	ms := s.(*mmapStorage)
+	if block := ms.mappedBlock(1, 10, 100); y.regions[0] != nil && !bytes.Equal(block, data[pieceLength+10:pieceLength+110]) {
+		t.Errorf("mapped block %d bytes", len(block))
+	}
+	if block := ms.mappedBlock(0, 0, 200); block != nil {
+		t.Errorf("block across files is mapped")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Errorf("close error: %v", err)
+	}
+	if _, err := s.ReadAt(0, b[:1], 0); err != ErrStorageClosed {
+		t.Errorf("read after close %v", err)
+	}
+	got, _ := ioutil.ReadFile(filepath.Join(root, "m", "y"))
+	if !bytes.Equal(got, data[100:]) {
+		t.Errorf("file content not written")
+	}
+}
+
+func TestMmapStorageConfig(t *testing.T) {
+	config := DefaultClientConfig()
+	config.Storage = "mmap"
+	c, tt := testTorrent(t, config, testMetainfo("a", []byte("hello"), 5))
+	defer c.Close()
+	if _, ok := tt.storage.(*mmapStorage); !ok {
+		t.Errorf("storage %T", tt.storage)
+	}
+
+	// blocks are sent from the mapping, after files of full length are verified
+	tt.Pause()
+	data := []byte("hello")
+	writePiece(t, tt, data, 0)
+	tt.Resume()
+	conn := connectPeer(t, tt)
+	defer conn.Close()
+	writeMessages(t, conn,
+		&peerwire.Message{ID: peerwire.Bitfield, Bitfield: []byte{0}},
+		&peerwire.Message{ID: peerwire.Interested},
+	)
+	nextMessage(t, conn, peerwire.Extended)
+	var p *peer
+	for p == nil || atomic.LoadUint32(&p.PeerInterested) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		tt.peersMutex.RLock()
+		for _, pp := range tt.peers {
+			p = pp
+		}
+		tt.peersMutex.RUnlock()
+	}
+	tt.rechoke(&choker{last: make(map[*peer]int64)}, time.Now())
+	nextMessage(t, conn, peerwire.Unchoke)
+	writeMessages(t, conn, &peerwire.Message{ID: peerwire.Request, Index: 0, Begin: 1, Length: 3})
+	if m := nextMessage(t, conn, peerwire.Piece); string(m.Block) != "ell" {
+		t.Errorf("block %q", m.Block)
+	}
+
+	config.Storage = "cloud"
+	if _, err := NewClient(config); err == nil {
+		t.Errorf("unknown storage")
+	}
+}
+
+func TestMmapStorageSkip(t *testing.T) {
+	mi := testFilesMetainfo("m", []byte("hello world"), 4, []string{"x", "y"}, []int64{3, 8})
+	config := DefaultClientConfig()
+	config.Storage = "mmap"
+	config.DownloadRoot = t.TempDir()
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.AddTorrentWithOptions(mi, TorrentOptions{FilePriorities: []PiecePriority{PrioritySkip, PriorityNormal}}); err != ErrMmapSkip {
+		t.Errorf("add torrent with a file skipped: %v", err)
+	}
+	tt, err := c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	if err := tt.SetFilePriority(1, PrioritySkip); err != ErrMmapSkip {
+		t.Errorf("skip file: %v", err)
+	}
+	if err := tt.SetFilePriority(1, PriorityHigh); err != nil || tt.FilePriority(1) != PriorityHigh {
+		t.Errorf("set file priority %s %v", tt.FilePriority(1), err)
+	}
+}
+
+func TestMmapStorageFault(t *testing.T) {
+	data := make([]byte, 3*os.Getpagesize())
+	mi := testMetainfo("a", data, len(data))
+	root := t.TempDir()
+	s, err := NewMmapStorage(mi.Info, root)
+	if err != nil {
+		t.Fatalf("new storage error: %v", err)
+	}
+	defer s.Close()
+	if s.(*mmapStorage).files[0].regions[0] == nil {
+		t.Skip("mmap not supported")
+	}
+	// pages past the end of file fault, as holes do when the disk is full
+	os.Truncate(filepath.Join(root, "a"), 0)
+	if _, err := s.WriteAt(0, []byte("hello"), 10); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("write error: %v", err)
+	}
+	if _, err := s.ReadAt(0, make([]byte, 5), 10); err != errMmapFault {
+		t.Errorf("read error: %v", err)
+	}
+	if _, err := s.(pieceHasher).hashPiece(0); err != errMmapFault {
+		t.Errorf("hash error: %v", err)
+	}
+}
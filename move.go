@@ -0,0 +1,166 @@
+package gobt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrStorageNotMovable data of the torrent is not in files which can be moved, e.g. mmap storage,
+// whose mappings are read by peers until the torrent is stopped
+var ErrStorageNotMovable = errors.New("storage of the torrent can not be moved")
+
+// MoveStorage moves data of the torrent, downloaded or partial, to directory dir.
+// Files are copied if dir is on another file system. Peers stay connected,
+// reads and writes of the data wait until it is moved.
+// Only file storage can be moved, others are ErrStorageNotMovable.
+func (t *Torrent) MoveStorage(dir string) error {
+	return t.moveFiles(func(root string, paths []string) (string, error) {
+		return dir, nil
+	})
+}
+
+// RenameFile changes where file index is on disk, path is relative to the directory of data.
+// The torrent is the same, other clients see the file at its path in metainfo.
+// Only files of file storage can be renamed, others are ErrStorageNotMovable.
+func (t *Torrent) RenameFile(index int, path string) error {
+	if index < 0 || index >= len(t.files) {
+		return fmt.Errorf("file index %d out of range", index)
+	}
+	path, ok := cleanRelative(path)
+	if !ok {
+		return fmt.Errorf("bad file path %q", path)
+	}
+	return t.moveFiles(func(root string, paths []string) (string, error) {
+		for i, p := range paths {
+			if i != index && p == path {
+				return "", fmt.Errorf("%s is file %d", path, i)
+			}
+		}
+		paths[index] = path
+		return root, nil
+	})
+}
+
+// moveFiles moves files to where fn tells by their root and paths now, fn may change paths.
+// Resume data is saved after. stateMutex is held so that Stop does not close storage during the move.
+func (t *Torrent) moveFiles(fn func(root string, paths []string) (string, error)) error {
+	m, ok := t.storage.(storageMover)
+	if !ok {
+		return ErrStorageNotMovable
+	}
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	if t.state == torrentStopped {
+		return errTorrentStopped
+	}
+	t.filesMutex.Lock()
+	root, files := m.layout()
+	paths := make([]string, len(files))
+	for i, r := range files {
+		paths[i] = r.path
+	}
+	newRoot, err := fn(root, paths)
+	if err == nil {
+		err = m.move(newRoot, paths)
+	}
+	if err == nil {
+		t.setFilePaths(paths)
+	}
+	t.filesMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.saveResume()
+}
+
+// setFilePaths must hold filesMutex or before used, files got by Files before keep their paths
+func (t *Torrent) setFilePaths(paths []string) {
+	for i, p := range paths {
+		if t.files[i].Path != p {
+			f := *t.files[i]
+			f.Path = p
+			t.files[i] = &f
+		}
+	}
+}
+
+// moveFile renames from to to, or copies it if they are on different file systems.
+// Nothing is done if from does not exist. to must not exist.
+func moveFile(from, to string) error {
+	if from == to {
+		return nil
+	}
+	if _, err := os.Lstat(from); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Lstat(to); err == nil {
+		return fmt.Errorf("%s already exists", to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0775); err != nil {
+		return err
+	}
+	if os.Rename(from, to) == nil {
+		return nil
+	}
+	// e.g. EXDEV, which is not the same on every system
+	err := copyFile(from, to)
+	if err != nil {
+		os.Remove(to)
+		return diskFull(err)
+	}
+	return os.Remove(from)
+}
+
+// copyFile copies data, mode and modification time of a file
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(to, st.ModTime(), st.ModTime())
+}
+
+// removeEmptyDirs removes dir and its parents while empty, up to root which is kept
+func removeEmptyDirs(root, dir string) {
+	for {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || outside(rel) || os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// cleanRelative cleans path, false if it is absolute or not under its base
+func cleanRelative(path string) (string, bool) {
+	path = filepath.Clean(path)
+	return path, !filepath.IsAbs(path) && filepath.VolumeName(path) == "" && !outside(path)
+}
+
+// outside tells if a clean relative path is not under its base
+func outside(rel string) bool {
+	return rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,156 @@
+package gobt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMoveStorage(t *testing.T) {
+	data := []byte("hello world")
+	mi := testFilesMetainfo("m", data, 4, []string{"x", "empty", "d/y"}, []int64{3, 0, 8})
+	c, tt := testTorrent(t, DefaultClientConfig(), mi)
+	tt.Pause()
+	for i := 0; i < mi.Info.piecesCount(); i++ {
+		writePiece(t, tt, data, i)
+	}
+	root := tt.root
+
+	if err := tt.RenameFile(2, filepath.Join("renamed", "y")); err != nil {
+		t.Fatalf("rename error: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(root, "renamed", "y")); string(b) != "lo world" {
+		t.Errorf("renamed file %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(root, "m", "d")); !os.IsNotExist(err) {
+		t.Errorf("empty directory left: %v", err)
+	}
+	if err := tt.RenameFile(1, filepath.Join("m", "x")); err == nil {
+		t.Errorf("renamed to another file")
+	}
+	if err := tt.RenameFile(1, filepath.Join("..", "z")); err == nil {
+		t.Errorf("renamed out of the directory")
+	}
+
+	// read while moving
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			b, err := readPiece(tt.storage, mi.Info, 2)
+			if err != nil || string(b) != "rld" {
+				t.Errorf("read while moving %q %v", b, err)
+				return
+			}
+		}
+	}()
+	dir := t.TempDir()
+	if err := tt.MoveStorage(dir); err != nil {
+		t.Fatalf("move error: %v", err)
+	}
+	<-done
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "m", "x")); string(b) != "hel" {
+		t.Errorf("moved file %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(root, "m")); !os.IsNotExist(err) {
+		t.Errorf("data left: %v", err)
+	}
+	if f := tt.Files()[2]; f.Path != filepath.Join("renamed", "y") {
+		t.Errorf("file path %s", f.Path)
+	}
+	c.Close()
+
+	// found by resume data
+	config := DefaultClientConfig()
+	config.DownloadRoot = root
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	tt, err = c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	tt.Pause()
+	if tt.bitfield.copyData()[0] != 0xe0 {
+		t.Errorf("bitfield %x", tt.bitfield.copyData())
+	}
+	if f := tt.Files()[2]; f.Path != filepath.Join("renamed", "y") {
+		t.Errorf("file path after restart %s", f.Path)
+	}
+	if b, err := readPiece(tt.storage, mi.Info, 1); err != nil || string(b) != "o wo" {
+		t.Errorf("read after restart %q %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "m")); !os.IsNotExist(err) {
+		t.Errorf("files created at old place: %v", err)
+	}
+}
+
+func TestMoveStop(t *testing.T) {
+	data := []byte("hello world")
+	mi := testFilesMetainfo("m", data, 4, []string{"x", "y"}, []int64{3, 8})
+	c, tt := testTorrent(t, DefaultClientConfig(), mi)
+	defer c.Close()
+	tt.Pause()
+	for i := 0; i < mi.Info.piecesCount(); i++ {
+		writePiece(t, tt, data, i)
+	}
+
+	// moved wholly or not at all
+	stopped := make(chan error)
+	go func() {
+		stopped <- tt.Stop()
+	}()
+	dir := t.TempDir()
+	err := tt.MoveStorage(dir)
+	if err := <-stopped; err != nil {
+		t.Errorf("stop error: %v", err)
+	}
+	if err == nil {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, "m", "y")); string(b) != "lo world" {
+			t.Errorf("moved file %q", b)
+		}
+	} else if err != errTorrentStopped {
+		t.Errorf("move error: %v", err)
+	}
+	if err := tt.MoveStorage(t.TempDir()); err != errTorrentStopped {
+		t.Errorf("move after stop: %v", err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	ioutil.WriteFile(from, []byte("hello"), 0664)
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(from, mtime, mtime)
+	if err := copyFile(from, to); err != nil {
+		t.Fatalf("copy error: %v", err)
+	}
+	st, err := os.Stat(to)
+	if b, _ := ioutil.ReadFile(to); string(b) != "hello" || err != nil || !st.ModTime().Equal(mtime) {
+		t.Errorf("copied %q %v", b, st.ModTime())
+	}
+	if err := copyFile(from, to); err == nil {
+		t.Errorf("copied over a file")
+	}
+}
+
+func TestMoveMmapStorage(t *testing.T) {
+	config := DefaultClientConfig()
+	config.Storage = "mmap"
+	c, tt := testTorrent(t, config, testMetainfo("a", []byte("hello"), 5))
+	defer c.Close()
+	if err := tt.MoveStorage(t.TempDir()); err != ErrStorageNotMovable {
+		t.Errorf("move error: %v", err)
+	}
+	if err := tt.RenameFile(0, "b"); err != ErrStorageNotMovable {
+		t.Errorf("rename error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tt.root, "a")); err != nil {
+		t.Errorf("file moved: %v", err)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -34,19 +33,19 @@ func readUint32(conn io.Reader) (uint32, error) {
 	}
 	return i, nil
 }
-func read2Byte(conn *net.UDPConn) (uint16, error) {
+func read2Byte(conn io.Reader) (uint16, error) {
 	var i uint16
 	err := binary.Read(conn, binary.BigEndian, &i)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	return i, nil
 }
-func availablePort() (net.Listener, uint16, error) {
-	for port := 6881; port <= 6889; port++ {
+func availablePort(start, end int) (net.Listener, uint16, error) {
+	for port := start; port <= end; port++ {
 		ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 		if err != nil {
-			return nil, 0, err
+			continue
 		}
 		return ln, uint16(port), nil
 
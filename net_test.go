@@ -3,7 +3,7 @@ package gobt
 import "testing"
 
 func testAvailablePort(t *testing.T) {
-	ln, port, err := availablePort()
+	ln, port, err := availablePort(6881, 6889)
 	if err != nil {
 		t.Errorf("port error: %v", err)
 	}
@@ -0,0 +1,226 @@
+// Package peerwire encodes and decodes messages of the BitTorrent peer wire protocol.
+//
+// A message is a 4 byte big-endian length, then 1 byte of message id and the payload.
+// A message of length zero is a keepalive and has no id.
+package peerwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ID the type of a message
+type ID byte
+
+// message ids
+const (
+	Choke ID = iota
+	Unchoke
+	Interested
+	NotInterested
+	Have
+	Bitfield
+	Request
+	Piece
+	Cancel
+	Port // DHT port, BEP 5
+
+	Extended ID = 20 // extension protocol, BEP 10, the first byte of Payload is the extended message id
+)
+
+// MaxMessageSize the largest length ReadMessage accepts and WriteTo writes,
+// enough for a 128 KiB block or a bitfield of 8M pieces
+const MaxMessageSize = 1 << 20
+
+// errors of ReadMessage and WriteTo
+var (
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrBadLength       = errors.New("bad message length")
+)
+
+// Message a peer wire message, only the fields used by its ID are read or written
+type Message struct {
+	Keepalive bool // no ID and no payload
+	ID        ID
+
+	Index    uint32 // have, request, piece, cancel
+	Begin    uint32 // request, piece, cancel
+	Length   uint32 // request, cancel
+	Bitfield []byte // bitfield
+	Block    []byte // piece
+	Port     uint16 // port
+	Payload  []byte // messages of other ids, e.g. extensions
+}
+
+var idNames = map[ID]string{
+	Choke:         "choke",
+	Unchoke:       "unchoke",
+	Interested:    "interested",
+	NotInterested: "not interested",
+	Have:          "have",
+	Bitfield:      "bitfield",
+	Request:       "request",
+	Piece:         "piece",
+	Cancel:        "cancel",
+	Port:          "port",
+	Extended:      "extended",
+}
+
+func (id ID) String() string {
+	if name, ok := idNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", byte(id))
+}
+
+func (m *Message) String() string {
+	if m.Keepalive {
+		return "keepalive"
+	}
+	switch m.ID {
+	case Have:
+		return fmt.Sprintf("have %d", m.Index)
+	case Request, Cancel:
+		return fmt.Sprintf("%s %d %d %d", m.ID, m.Index, m.Begin, m.Length)
+	case Piece:
+		return fmt.Sprintf("piece %d %d len %d", m.Index, m.Begin, len(m.Block))
+	case Bitfield:
+		return fmt.Sprintf("bitfield len %d", len(m.Bitfield))
+	case Port:
+		return fmt.Sprintf("port %d", m.Port)
+	}
+	return m.ID.String()
+}
+
+// payloadLength the length of payload after the id, -1 if any length is ok
+func payloadLength(id ID) int {
+	switch id {
+	case Choke, Unchoke, Interested, NotInterested:
+		return 0
+	case Have:
+		return 4
+	case Request, Cancel:
+		return 12
+	case Port:
+		return 2
+	}
+	return -1
+}
+
+// Len the length of the message, not counting the 4 bytes of length itself
+func (m *Message) Len() int {
+	if m.Keepalive {
+		return 0
+	}
+	if n := payloadLength(m.ID); n >= 0 {
+		return 1 + n
+	}
+	switch m.ID {
+	case Bitfield:
+		return 1 + len(m.Bitfield)
+	case Piece:
+		return 1 + 8 + len(m.Block)
+	}
+	return 1 + len(m.Payload)
+}
+
+// MarshalBinary encodes the message with its length
+func (m *Message) MarshalBinary() ([]byte, error) {
+	n := m.Len()
+	if n > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d", ErrMessageTooLarge, n)
+	}
+	b := make([]byte, 4+n)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	if m.Keepalive {
+		return b, nil
+	}
+	b[4] = byte(m.ID)
+	p := b[5:]
+	switch m.ID {
+	case Have:
+		binary.BigEndian.PutUint32(p, m.Index)
+	case Request, Cancel:
+		binary.BigEndian.PutUint32(p, m.Index)
+		binary.BigEndian.PutUint32(p[4:], m.Begin)
+		binary.BigEndian.PutUint32(p[8:], m.Length)
+	case Piece:
+		binary.BigEndian.PutUint32(p, m.Index)
+		binary.BigEndian.PutUint32(p[4:], m.Begin)
+		copy(p[8:], m.Block)
+	case Bitfield:
+		copy(p, m.Bitfield)
+	case Port:
+		binary.BigEndian.PutUint16(p, m.Port)
+	case Choke, Unchoke, Interested, NotInterested:
+	default:
+		copy(p, m.Payload)
+	}
+	return b, nil
+}
+
+// WriteTo writes the message with one Write call
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadMessage reads one message, keepalives included.
+// A message shorter than its id needs is ErrBadLength.
+func ReadMessage(r io.Reader) (*Message, error) {
+	var lb [4]byte
+	_, err := io.ReadFull(r, lb[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lb[:])
+	if n == 0 {
+		return &Message{Keepalive: true}, nil
+	}
+	if n > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d", ErrMessageTooLarge, n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{ID: ID(b[0])}
+	p := b[1:]
+	if want := payloadLength(m.ID); want >= 0 && len(p) != want {
+		return nil, fmt.Errorf("%w: %s of %d bytes", ErrBadLength, m.ID, len(p))
+	}
+	switch m.ID {
+	case Have:
+		m.Index = binary.BigEndian.Uint32(p)
+	case Request, Cancel:
+		m.Index = binary.BigEndian.Uint32(p)
+		m.Begin = binary.BigEndian.Uint32(p[4:])
+		m.Length = binary.BigEndian.Uint32(p[8:])
+	case Piece:
+		if len(p) < 8 {
+			return nil, fmt.Errorf("%w: piece of %d bytes", ErrBadLength, len(p))
+		}
+		m.Index = binary.BigEndian.Uint32(p)
+		m.Begin = binary.BigEndian.Uint32(p[4:])
+		m.Block = p[8:]
+	case Bitfield:
+		m.Bitfield = p
+	case Port:
+		m.Port = binary.BigEndian.Uint16(p)
+	case Choke, Unchoke, Interested, NotInterested:
+	default:
+		m.Payload = p
+	}
+	return m, nil
+}
@@ -0,0 +1,142 @@
+package peerwire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var encodings = []struct {
+	msg Message
+	hex string
+}{
+	{Message{Keepalive: true}, "00000000"},
+	{Message{ID: Choke}, "0000000100"},
+	{Message{ID: Unchoke}, "0000000101"},
+	{Message{ID: Interested}, "0000000102"},
+	{Message{ID: NotInterested}, "0000000103"},
+	{Message{ID: Have, Index: 0x01020304}, "000000050401020304"},
+	{Message{ID: Bitfield, Bitfield: []byte{0xff, 0x80}}, "0000000305ff80"},
+	{Message{ID: Request, Index: 1, Begin: 0x4000, Length: 0x4000}, "0000000d06000000010000400000004000"},
+	{Message{ID: Piece, Index: 2, Begin: 3, Block: []byte("abc")}, "0000000c070000000200000003616263"},
+	{Message{ID: Cancel, Index: 1, Begin: 2, Length: 3}, "0000000d08000000010000000200000003"},
+	{Message{ID: Port, Port: 6881}, "00000003091ae1"},
+	{Message{ID: Extended, Payload: []byte{0, 'd', 'e'}}, "0000000414006465"},
+	{Message{ID: 30, Payload: []byte{}}, "000000011e"},
+}
+
+func TestEncode(t *testing.T) {
+	for _, e := range encodings {
+		buf := new(bytes.Buffer)
+		n, err := e.msg.WriteTo(buf)
+		if err != nil {
+			t.Errorf("%s: write error %v", &e.msg, err)
+			continue
+		}
+		if got := hex.EncodeToString(buf.Bytes()); got != e.hex {
+			t.Errorf("%s: got %s, want %s", &e.msg, got, e.hex)
+		}
+		if int(n) != buf.Len() || e.msg.Len() != buf.Len()-4 {
+			t.Errorf("%s: n %d len %d of %d bytes", &e.msg, n, e.msg.Len(), buf.Len())
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, e := range encodings {
+		b, _ := hex.DecodeString(e.hex)
+		m, err := ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: read error %v", &e.msg, err)
+			continue
+		}
+		if !reflect.DeepEqual(*m, e.msg) {
+			t.Errorf("got %+v, want %+v", *m, e.msg)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, e := range encodings {
+		e.msg.WriteTo(buf)
+	}
+	for _, e := range encodings {
+		m, err := ReadMessage(buf)
+		if err != nil {
+			t.Fatalf("read error %v", err)
+		}
+		if m.String() != e.msg.String() {
+			t.Errorf("got %s, want %s", m, &e.msg)
+		}
+	}
+	if _, err := ReadMessage(buf); err != io.EOF {
+		t.Errorf("end of stream: %v", err)
+	}
+}
+
+func TestBadLength(t *testing.T) {
+	bad := []string{
+		"0000000200ff",                         // choke with payload
+		"0000000104",                           // have without index
+		"000000060401020304ff",                 // have too long
+		"0000000c060000000100004000000040",     // request too short
+		"0000000e0800000001000000020000000300", // cancel too long
+		"0000000707000000010000",               // piece without begin
+		"000000020900",                         // port too short
+	}
+	for _, h := range bad {
+		b, _ := hex.DecodeString(h)
+		_, err := ReadMessage(bytes.NewReader(b))
+		if !errors.Is(err, ErrBadLength) {
+			t.Errorf("%s: %v", h, err)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, e := range encodings {
+		b, _ := hex.DecodeString(e.hex)
+		for i := 1; i < len(b); i++ {
+			_, err := ReadMessage(bytes.NewReader(b[:i]))
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("%s cut at %d: %v", &e.msg, i, err)
+			}
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	b, _ := hex.DecodeString("00100001")
+	_, err := ReadMessage(io.MultiReader(bytes.NewReader(b), strings.NewReader("never read")))
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("read: %v", err)
+	}
+
+	m := &Message{ID: Piece, Block: make([]byte, MaxMessageSize)}
+	buf := new(bytes.Buffer)
+	_, err = m.WriteTo(buf)
+	if !errors.Is(err, ErrMessageTooLarge) || buf.Len() != 0 {
+		t.Errorf("write: %v", err)
+	}
+
+	m.Block = m.Block[:MaxMessageSize-9]
+	_, err = m.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("write max: %v", err)
+	}
+	m2, err := ReadMessage(buf)
+	if err != nil || len(m2.Block) != len(m.Block) {
+		t.Errorf("read max: %v", err)
+	}
+}
+
+func TestIDString(t *testing.T) {
+	if NotInterested.String() != "not interested" || ID(99).String() != "unknown(99)" {
+		t.Errorf("id names")
+	}
+}
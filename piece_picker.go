@@ -0,0 +1,276 @@
+package gobt
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// PiecePriority how much we want a piece
+type PiecePriority int
+
+// piece priorities
+const (
+	PrioritySkip PiecePriority = iota // do not download
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+	PriorityReadahead // just ahead of a reader, set by readers only
+	PriorityNow       // a reader waits for it, set by readers only
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high", "readahead", "now"}
+
+func (p PiecePriority) String() string {
+	if p < PrioritySkip || p > PriorityNow {
+		return fmt.Sprintf("PiecePriority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePiecePriority parses skip, low, normal or high
+func ParsePiecePriority(s string) (PiecePriority, error) {
+	for i, name := range priorityNames[:PriorityHigh+1] {
+		if s == name {
+			return PiecePriority(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
+
+func checkPriority(p PiecePriority) error {
+	if p < PrioritySkip || p > PriorityHigh {
+		return fmt.Errorf("unknown priority %d", p)
+	}
+	return nil
+}
+
+const defaultRandomFirst = 4 // pieces got randomly before rarest first, so we soon have something to share
+
+// PieceInfo what a PiecePicker knows about a piece
+type PieceInfo struct {
+	Index        int
+	Availability int // how many connected peers have it
+	Priority     PiecePriority
+	Partial      bool // some blocks are downloaded
+}
+
+// PiecePicker chooses the piece to download next from a peer.
+// Candidates are pieces the peer has, we lack, nobody is downloading and not skipped;
+// have is how many pieces we have. It returns an index of candidates, -1 for none.
+type PiecePicker interface {
+	Pick(candidates []PieceInfo, have int) int
+}
+
+// Sequential picks pieces of highest priority in order, e.g. to stream
+type Sequential struct{}
+
+// Pick implements PiecePicker
+func (Sequential) Pick(candidates []PieceInfo, have int) int {
+	best := -1
+	for i, c := range candidates {
+		if best == -1 || c.Priority > candidates[best].Priority || c.Priority == candidates[best].Priority && c.Index < candidates[best].Index {
+			best = i
+		}
+	}
+	return best
+}
+
+// RarestFirst picks pieces of highest priority, partial pieces first,
+// then randomly until we have RandomFirst pieces, then the rarest.
+type RarestFirst struct {
+	RandomFirst int
+}
+
+// NewRarestFirst the default picker
+func NewRarestFirst() *RarestFirst {
+	return &RarestFirst{RandomFirst: defaultRandomFirst}
+}
+
+// Pick implements PiecePicker
+func (r *RarestFirst) Pick(candidates []PieceInfo, have int) int {
+	best := -1
+	ties := 0
+	for i, c := range candidates {
+		cmp := 1
+		if best != -1 {
+			cmp = r.compare(c, candidates[best], have)
+		}
+		switch {
+		case cmp > 0:
+			best = i
+			ties = 1
+		case cmp == 0:
+			// pick one of equals randomly
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// compare > 0 if a is better than b
+func (r *RarestFirst) compare(a, b PieceInfo, have int) int {
+	if a.Priority != b.Priority {
+		return int(a.Priority - b.Priority)
+	}
+	if a.Partial != b.Partial {
+		if a.Partial {
+			return 1
+		}
+		return -1
+	}
+	if have < r.RandomFirst {
+		return 0
+	}
+	return b.Availability - a.Availability
+}
+
+// pieceTracker what a torrent knows about its pieces, shared by peers
+type pieceTracker struct {
+	mu           sync.Mutex
+	picker       PiecePicker
+	availability []int
+	priorities   []PiecePriority
+	downloading  []bool // picked by a peer
+	partial      []bool // some blocks are written, not verified yet
+	reading      []int  // readers waiting for it
+	readahead    []int  // readers just before it
+}
+
+func newPieceTracker(count int) *pieceTracker {
+	pt := &pieceTracker{
+		picker:       NewRarestFirst(),
+		availability: make([]int, count),
+		priorities:   make([]PiecePriority, count),
+		downloading:  make([]bool, count),
+		partial:      make([]bool, count),
+		reading:      make([]int, count),
+		readahead:    make([]int, count),
+	}
+	for i := range pt.priorities {
+		pt.priorities[i] = PriorityNormal
+	}
+	return pt
+}
+
+// addBitfield counts pieces of a peer, delta is -1 when the peer is gone
+func (pt *pieceTracker) addBitfield(bf *bitfield, delta int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for i := range pt.availability {
+		if bf.Bit(i) == 1 {
+			pt.availability[i] += delta
+		}
+	}
+}
+
+// have a peer got a piece
+func (pt *pieceTracker) have(index int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.availability[index]++
+}
+
+// pick chooses a piece to download from a peer and marks it downloading, -1 if none
+func (pt *pieceTracker) pick(have *bitfield, peerHas *bitfield) int {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	var candidates []PieceInfo
+	haveCount := 0
+	for i := range pt.availability {
+		if have.Bit(i) == 1 {
+			haveCount++
+			continue
+		}
+		priority := pt.priority(i)
+		if peerHas.Bit(i) == 0 || pt.downloading[i] || priority == PrioritySkip {
+			continue
+		}
+		candidates = append(candidates, PieceInfo{i, pt.availability[i], priority, pt.partial[i]})
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+	c := pt.picker.Pick(candidates, haveCount)
+	if c < 0 || c >= len(candidates) {
+		return -1
+	}
+	index := candidates[c].Index
+	pt.downloading[index] = true
+	return index
+}
+
+// priority of a piece, raised by readers, must hold mu
+func (pt *pieceTracker) priority(index int) PiecePriority {
+	switch {
+	case pt.reading[index] > 0:
+		return PriorityNow
+	case pt.readahead[index] > 0:
+		return PriorityReadahead
+	}
+	return pt.priorities[index]
+}
+
+// addReading a reader waits for a piece, delta is -1 when it is done
+func (pt *pieceTracker) addReading(index int, delta int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.reading[index] += delta
+}
+
+// addReadahead pieces first to last are just ahead of a reader, delta is -1 when it moves away
+func (pt *pieceTracker) addReadahead(first, last int, delta int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for i := first; i <= last; i++ {
+		pt.readahead[i] += delta
+	}
+}
+
+// release a piece picked is done, or the peer downloading it is gone
+func (pt *pieceTracker) release(index int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.downloading[index] = false
+}
+
+// setPartial marks if a piece has blocks written but not verified
+func (pt *pieceTracker) setPartial(index int, partial bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.partial[index] = partial
+}
+
+// SetPiecePicker changes the strategy of choosing pieces, nil for the default
+func (t *Torrent) SetPiecePicker(picker PiecePicker) {
+	if picker == nil {
+		picker = NewRarestFirst()
+	}
+	t.pieces.mu.Lock()
+	defer t.pieces.mu.Unlock()
+	t.pieces.picker = picker
+}
+
+// SetPiecePriority sets the priority of piece index, PrioritySkip to not download it
+func (t *Torrent) SetPiecePriority(index int, priority PiecePriority) error {
+	if index < 0 || index >= len(t.pieces.priorities) {
+		return fmt.Errorf("piece index %d out of range", index)
+	}
+	if err := checkPriority(priority); err != nil {
+		return err
+	}
+	t.pieces.mu.Lock()
+	defer t.pieces.mu.Unlock()
+	t.pieces.priorities[index] = priority
+	return nil
+}
+
+// PiecePriority the priority of piece index
+func (t *Torrent) PiecePriority(index int) PiecePriority {
+	t.pieces.mu.Lock()
+	defer t.pieces.mu.Unlock()
+	return t.pieces.priorities[index]
+}
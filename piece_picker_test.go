@@ -0,0 +1,113 @@
+package gobt
+
+import "testing"
+
+func TestRarestFirst(t *testing.T) {
+	r := &RarestFirst{RandomFirst: 2}
+	candidates := []PieceInfo{
+		{Index: 0, Availability: 3, Priority: PriorityNormal},
+		{Index: 1, Availability: 1, Priority: PriorityNormal},
+		{Index: 2, Availability: 5, Priority: PriorityNormal},
+	}
+	if c := r.Pick(candidates, 2); c != 1 {
+		t.Errorf("rarest got %d", c)
+	}
+
+	candidates[2].Partial = true
+	if c := r.Pick(candidates, 2); c != 2 {
+		t.Errorf("partial got %d", c)
+	}
+
+	candidates[0].Priority = PriorityHigh
+	if c := r.Pick(candidates, 2); c != 0 {
+		t.Errorf("high priority got %d", c)
+	}
+
+	// random first
+	candidates = candidates[1:]
+	candidates[1].Partial = false
+	got := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		got[r.Pick(candidates, 0)] = true
+	}
+	if !got[0] || !got[1] {
+		t.Errorf("random first got %v", got)
+	}
+
+	if c := r.Pick(nil, 0); c != -1 {
+		t.Errorf("no candidate got %d", c)
+	}
+}
+
+type firstPicker struct{}
+
+func (firstPicker) Pick(candidates []PieceInfo, have int) int {
+	return 0
+}
+
+func TestPieceTracker(t *testing.T) {
+	pt := newPieceTracker(4)
+	have := allZeroBitField(4)
+	have.SetBit(0, 1)
+	a := allZeroBitField(4)
+	a.SetBitData([]byte{0xf0})
+	b := allZeroBitField(4)
+	b.SetBitData([]byte{0x60})
+	pt.addBitfield(a, 1)
+	pt.addBitfield(b, 1)
+	pt.have(1)
+	if pt.availability[0] != 1 || pt.availability[1] != 3 || pt.availability[2] != 2 || pt.availability[3] != 1 {
+		t.Errorf("availability %v", pt.availability)
+	}
+	pt.addBitfield(b, -1)
+	if pt.availability[1] != 2 || pt.availability[2] != 1 {
+		t.Errorf("availability after peer gone %v", pt.availability)
+	}
+
+	pt.picker = firstPicker{}
+	pt.priorities[1] = PrioritySkip
+	// 0 we have, 1 skipped
+	if i := pt.pick(have, a); i != 2 {
+		t.Errorf("pick %d", i)
+	}
+	// 2 is downloading
+	if i := pt.pick(have, a); i != 3 {
+		t.Errorf("pick %d", i)
+	}
+	if i := pt.pick(have, a); i != -1 {
+		t.Errorf("pick %d", i)
+	}
+	pt.release(2)
+	if i := pt.pick(have, a); i != 2 {
+		t.Errorf("pick released %d", i)
+	}
+}
+
+func TestSetPiecePriority(t *testing.T) {
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", []byte("hello"), 4))
+	defer c.Close()
+	if tt.PiecePriority(1) != PriorityNormal {
+		t.Errorf("default priority %d", tt.PiecePriority(1))
+	}
+	if err := tt.SetPiecePriority(1, PriorityHigh); err != nil || tt.PiecePriority(1) != PriorityHigh {
+		t.Errorf("set priority %v", err)
+	}
+	if tt.SetPiecePriority(2, PriorityHigh) == nil || tt.SetPiecePriority(0, PiecePriority(9)) == nil {
+		t.Errorf("bad priority accepted")
+	}
+	tt.SetPiecePicker(firstPicker{})
+	tt.SetPiecePicker(nil)
+	if _, ok := tt.pieces.picker.(*RarestFirst); !ok {
+		t.Errorf("default picker not restored")
+	}
+}
+
+func TestSequential(t *testing.T) {
+	candidates := []PieceInfo{{1, 5, PriorityNormal, false}, {2, 1, PriorityHigh, false}, {3, 1, PriorityHigh, true}}
+	if c := (Sequential{}).Pick(candidates, 0); c != 1 {
+		t.Errorf("picked %d", c)
+	}
+	if c := (Sequential{}).Pick(candidates[:1], 0); c != 0 {
+		t.Errorf("picked %d", c)
+	}
+}
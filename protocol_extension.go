@@ -0,0 +1,58 @@
+package gobt
+
+import (
+	"errors"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+// extension protocol, BEP 10, we only use the handshake for reqq
+const (
+	extensionByte        = 5
+	extensionBit         = 0x10
+	extendedHandshakeID  = 0
+	maxPeerRequests      = 250 // reqq we tell peers
+	extendedClientString = "gobt"
+)
+
+// reservedBits the 8 reserved bytes of a handshake
+type reservedBits [8]byte
+
+func ourReservedBits() reservedBits {
+	var r reservedBits
+	r[extensionByte] |= extensionBit
+	return r
+}
+
+func (r reservedBits) extensions() bool {
+	return r[extensionByte]&extensionBit != 0
+}
+
+func extendedHandshakeMessage() (*peerwire.Message, error) {
+	b, err := Encode(map[string]interface{}{
+		"m":    map[string]interface{}{},
+		"reqq": maxPeerRequests,
+		"v":    extendedClientString,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &peerwire.Message{ID: peerwire.Extended, Payload: append([]byte{extendedHandshakeID}, b...)}, nil
+}
+
+// parseExtendedHandshake returns reqq of the peer, 0 if not told
+func parseExtendedHandshake(payload []byte) (int, error) {
+	v, err := Parse(payload)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return 0, errors.New("extended handshake is not a dictionary")
+	}
+	reqq, _ := m["reqq"].(int64)
+	if reqq < 0 {
+		reqq = 0
+	}
+	return int(reqq), nil
+}
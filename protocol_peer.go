@@ -3,69 +3,72 @@ package gobt
 import (
 	"bufio"
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
 	"net"
+	"sync/atomic"
 	"time"
-)
 
-const requestLength = uint32(1 << 14) // All current implementations use 2^14 (16 kiB)
-const chanWaitTimeout = time.Millisecond * 10
-
-// non-keepalive messages start with a single byte which gives their type
-const (
-	typeChoke uint32 = iota
-	typeUnchoke
-	typeInterested
-	typeNotInterested
-	typeHave
-	typeBitfield
-	typeRequest
-	typePiece
-	typeCancel
+	"github.com/picasso250/gobt/peerwire"
 )
 
+const requestLength = uint32(1 << 14)    // All current implementations use 2^14 (16 kiB)
+const maxRequestLength = 1 << 17         // larger requests drop the peer
+const requestCheckInterval = time.Second // how often timed out requests are looked for
+
 type peer struct {
+	t      *Torrent
+	ctx    context.Context // done when the peer is dropped
+	cancel context.CancelFunc
 	Addr   net.Addr
 	PeerID peerID
-	// state
+	// state, atomic but PeerChoking which is only used by the message loop
 	AmChoking      uint32 // 本客户端正在choke远程peer。
 	AmInterested   uint32 // 本客户端对远程peer感兴趣。
 	PeerChoking    uint32 // 远程peer正choke本客户端。
 	PeerInterested uint32 // 远程peer对本客户端感兴趣。
 
-	Conn           net.Conn
-	Bitfield       *bitfield
-	Cancel         chan iblPack
-	WillCancel     []iblPack
-	PieceOffsetMap map[uint32]int     // piece start 0----piece offset----piece end
-	ToSend         chan messageToSend // send to peer
-	Error          chan error
-}
-type messageToSend struct {
-	Request iblPack
-	Message []byte
-}
+	Conn       net.Conn
+	Reserved   reservedBits // reserved bytes in handshake of the peer
+	Bitfield   *bitfield
+	Cancel     chan *peerwire.Message // cancel messages of the peer
+	WillCancel []*peerwire.Message
+	ToSend     chan *peerwire.Message // send to peer
+
+	chokeChanged chan struct{} // AmChoking changed, startSend tells the peer
 
-type iblPack []byte // pack index, begin, and length to bytes
+	ready      int32     // message loop is running, atomic
+	downloaded int64     // bytes of blocks got, atomic
+	uploaded   int64     // bytes of blocks sent, atomic
+	lastBlock  int64     // unix nano of the last block got, atomic
+	announced  *bitfield // pieces we told the peer we have
 
-func newPeer(addr net.Addr, pid peerID) *peer {
+	limiters  rateLimiters
+	reqq      int // how many requests the peer queues, 0 if not told
+	requests  *requestQueue
+	elsewhere chan blockRequest // blocks we asked for but got from other peers
+}
+
+func newPeer(t *Torrent, addr net.Addr) *peer {
 	return &peer{
-		Addr:   addr,
-		PeerID: pid,
+		t:    t,
+		Addr: addr,
 		// 客户端连接开始时状态是choke和not interested(不感兴趣)。换句话就是：
 		AmChoking:      1,
 		AmInterested:   0,
 		PeerChoking:    1,
 		PeerInterested: 0,
 
-		Conn:     nil, // Multiple goroutines may invoke methods on a Conn simultaneously
-		Bitfield: allZeroBitField(gBitField.Len()),
-		Cancel:   make(chan iblPack, 10),
-		ToSend:   make(chan messageToSend), // for simplicity, make it sync
+		Conn:      nil, // Multiple goroutines may invoke methods on a Conn simultaneously
+		Bitfield:  allZeroBitField(t.Metainfo.Info.piecesCount()),
+		Cancel:    make(chan *peerwire.Message, 10),
+		ToSend:    make(chan *peerwire.Message), // for simplicity, make it sync
+		requests:  newRequestQueue(),
+		limiters:  newRateLimiters(t.client.config.PeerUploadRate, t.client.config.PeerDownloadRate),
+		elsewhere: make(chan blockRequest, gotElsewhereBufferSize),
+
+		chokeChanged: make(chan struct{}, 1),
 	}
 }
 
@@ -73,88 +76,185 @@ func (p *peer) String() string {
 	return p.Addr.String()
 }
 
-func (p *peer) handleConnection(metainfo *Metainfo) {
-	defer p.Conn.Close()
-	p.startListen(metainfo)
-}
-func (p *peer) startHandle(metainfo *Metainfo) {
-	var err error
-
-	// maybe we don't need to lock here, but who knows
-	peersMapMutex.Lock()
-	// todo tcp v6
-	p.Conn, err = net.Dial("tcp4", p.Addr.String())
-	peersMapMutex.Unlock()
+// run talks to the peer until error or ctx done, the error is sent to client events
+func (p *peer) run() {
+	defer p.cancel()
+	err := p.talk()
+	p.forget()
 	if err != nil {
-		fmt.Printf("dial tcp %s error: %s\n", p.Addr.String(), err)
-		return
+		err = &PeerError{p.String(), err}
+		p.t.client.config.logf("%s", err)
+		p.t.client.emit(Event{
+			Type:    EventPeerDropped,
+			Torrent: p.t,
+			Peer:    p.String(),
+			Err:     err,
+		})
 	}
+}
 
-	p.handleConnection(metainfo)
+// forget removes what the torrent knows from the peer
+func (p *peer) forget() {
+	p.t.pieces.addBitfield(p.Bitfield, -1)
+	p.releaseRequests(false)
+}
 
+// releaseRequests gives up blocks requested from the peer and the pieces it picked, cancel tells the peer
+func (p *peer) releaseRequests(cancel bool) {
+	for b := range p.requests.outstanding {
+		p.t.blocks.remove(b, p)
+		if cancel {
+			p.send(b.message(peerwire.Cancel))
+		}
+	}
+	for _, index := range p.requests.clear() {
+		p.t.pieces.release(int(index))
+	}
+}
+
+// snubbed the peer sent no block for long though we want some
+func (p *peer) snubbed(now time.Time) bool {
+	lastBlock := time.Unix(0, atomic.LoadInt64(&p.lastBlock))
+	return atomic.LoadUint32(&p.AmInterested) == 1 && now.Sub(lastBlock) > snubTimeout
 }
-func (p *peer) startListen(metainfo *Metainfo) {
+
+// talk connects to the peer if it is not an incoming connection, and exchanges messages
+func (p *peer) talk() error {
 	var err error
+	outgoing := p.Conn == nil
+	if outgoing {
+		// todo tcp v6
+		d := net.Dialer{Timeout: p.t.client.config.DialTimeout}
+		p.Conn, err = d.DialContext(p.ctx, "tcp4", p.Addr.String())
+		if err != nil {
+			return err
+		}
+	}
+	p.Conn = p.limitConn(p.Conn)
+	defer p.Conn.Close()
+	go func() {
+		// unblock reads and writes
+		<-p.ctx.Done()
+		p.Conn.Close()
+	}()
 
-	err = handshake(p, metainfo)
-	if err != nil {
-		fmt.Printf("%s handshake error: %s", p, err)
-		return
+	if outgoing {
+		err = p.Conn.SetDeadline(time.Now().Add(p.t.client.config.HandshakeTimeout))
+		if err != nil {
+			return err
+		}
+		err = handshake(p, p.t.Metainfo, p.t.client.peerID)
+		if err != nil {
+			return err
+		}
+		err = p.Conn.SetDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
 	}
 
-	heartBeatWillStop := make(chan int)
-	go p.heartBeat(heartBeatWillStop)
-	defer func() {
-		// inform heart beat to stop
-		heartBeatWillStop <- 1
-	}()
+	go p.heartBeat(p.t.client.config.KeepAliveInterval)
 
-	err = p.peerMessages(metainfo.Info)
-	if err != nil {
-		fmt.Printf("peer messages error: %s\n", err)
-		return
+	err = p.peerMessages(p.t.Metainfo.Info)
+	if p.ctx.Err() != nil {
+		// closed by us
+		return p.ctx.Err()
 	}
+	return err
 }
 
 func (p *peer) peerMessages(info *MetainfoInfo) error {
 
-	// start to send
-	go p.startSend()
+	// start to send, it is done before we return as blocks sent may be memory of the storage,
+	// which is closed once peers are done
+	stop, sent := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(sent)
+		p.startSend(stop)
+	}()
+	defer func() {
+		close(stop)
+		<-sent
+	}()
 
-	msg, err := buildPeerMessageBitfield(info)
-	if err != nil {
-		return err
+	p.announced = allZeroBitFieldByte(p.t.bitfield.Len())
+	p.announced.SetBitData(p.t.bitfield.copyData())
+	p.send(bitfieldMessage(p.announced))
+	if p.Reserved.extensions() {
+		msg, err := extendedHandshakeMessage()
+		if err != nil {
+			return err
+		}
+		p.send(msg)
 	}
-	p.ToSend <- messageToSend{nil, msg}
 
-	// for simplicity we are interested in every one and do not choke anyone
-	p.sendCmd(typeUnchoke)
-	p.AmChoking = 0
-
-	p.sendCmd(typeInterested)
-	p.AmInterested = 1
+	// the choker unchokes us, we get interested when we know what the peer has
+	atomic.StoreInt64(&p.lastBlock, time.Now().UnixNano())
+	atomic.StoreInt32(&p.ready, 1)
 
 	return p.loop(info)
 }
 
-func (p *peer) startSend() {
+// send queues a message, dropped if the peer is done
+func (p *peer) send(msg *peerwire.Message) {
+	select {
+	case p.ToSend <- msg:
+	case <-p.ctx.Done():
+	}
+}
+
+func (p *peer) startSend(stop <-chan struct{}) {
 	// these two are goroutine safe
 	conn := p.Conn
+	choking := uint32(1) // what the peer was told last
+
+	write := func(msg *peerwire.Message) bool {
+		var err error
+		if ferr := catchFault(func() { _, err = msg.WriteTo(conn) }); ferr != nil {
+			err = ferr
+		}
+		if err != nil {
+			// the reading side will fail
+			conn.Close()
+			return false
+		}
+		return true
+	}
+	// writeChoke tells the peer AmChoking if it changed, before messages queued after it
+	writeChoke := func() bool {
+		c := atomic.LoadUint32(&p.AmChoking)
+		if c == choking {
+			return true
+		}
+		choking = c
+		if c == 1 {
+			return write(&peerwire.Message{ID: peerwire.Choke})
+		}
+		return write(&peerwire.Message{ID: peerwire.Unchoke})
+	}
 
 	for {
 
 		select {
+		case <-p.ctx.Done():
+			return
+		case <-stop:
+			return
+
+		case <-p.chokeChanged:
+			if !writeChoke() {
+				return
+			}
 
 		case msg := <-p.ToSend:
-			if is, willCancel := inCancel(msg.Request, p.WillCancel); is {
+			if !writeChoke() {
+				return
+			}
+			if is, willCancel := inCancel(msg, p.WillCancel); is {
 				// drop this message
 				p.WillCancel = willCancel
-			} else {
-				err := writeMessage(conn, msg.Message)
-				if err != nil {
-					p.Error <- err
-					return
-				}
+			} else if !write(msg) {
+				return
 			}
 
 		case c := <-p.Cancel:
@@ -164,464 +264,391 @@ func (p *peer) startSend() {
 	}
 }
 
-func writeMessage(conn net.Conn, msg []byte) error {
-	b := msgWrap(msg)
-	return writeAll(conn, b)
-}
-func inCancel(elem iblPack, list []iblPack) (bool, []iblPack) {
-	for i, v := range list {
-		if bytes.Equal(v, elem) {
+// inCancel tells if msg is a piece the peer has canceled, and removes the cancel from list
+func inCancel(msg *peerwire.Message, list []*peerwire.Message) (bool, []*peerwire.Message) {
+	if msg.Keepalive || msg.ID != peerwire.Piece {
+		return false, list
+	}
+	for i, c := range list {
+		if c.Index == msg.Index && c.Begin == msg.Begin && int(c.Length) == len(msg.Block) {
 			return true, append(list[:i], list[i+1:]...)
 		}
 	}
 	return false, list
 }
 
-func packCancel(index int32, begin int32, length int32) []byte {
-	return packMessage(nil, index, begin, length)
-}
-func msgWrap(msg []byte) []byte {
-	buf := new(bytes.Buffer)
-	err := writeAll(buf, msg)
-	if err != nil {
-		log.Fatal(err)
+func (p *peer) loop(info *MetainfoInfo) error {
+	msgs := make(chan *peerwire.Message)
+	errc := make(chan error, 1)
+	go p.readMessages(msgs, errc)
+
+	timeout := p.t.client.config.RequestTimeout
+	interval := requestCheckInterval
+	if timeout > 0 && timeout/2 < interval {
+		interval = timeout / 2
 	}
-	return buf.Bytes()
-}
-func (p *peer) loop(info *MetainfoInfo) (err error) {
-	errOccur := make(chan error)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case err := <-errOccur:
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		case err := <-errc:
 			return err
-		case <-time.After(chanWaitTimeout):
-			// go on
-		}
-
-		if p.PeerChoking == 0 {
-			// send him message for request
-			// it is safe to goroutine
-			go func() {
-				// todo tit-for-tat-ish algorithm
-				err = requestPeer(p, info)
-				if err != nil {
-					errOccur <- err
-				}
-			}()
-		}
-
-		if p.AmInterested == 0 {
-			time.Sleep(time.Second)
-			continue
-		}
-		t, b, err := readNextMsg(p.Conn)
-		if err != nil {
-			return err
-		}
-		switch t {
-		default:
-			return errors.New("unknown message type")
-		case typeChoke:
-			p.PeerChoking = 1
-		case typeUnchoke:
-			p.PeerChoking = 0
-		case typeInterested:
-			p.PeerInterested = 1
-		case typeNotInterested:
-			p.PeerInterested = 0
-		case typeHave:
-			err = p.doHave(b)
+		case msg := <-msgs:
+			err := p.handleMessage(msg, info)
 			if err != nil {
 				return err
 			}
-		case typeBitfield:
-			err = p.doBitfield(b)
-		case typeRequest:
-			err = p.doRequest(b, info, errOccur)
-		case typeCancel:
-			p.doCancel(b)
-		case typePiece:
-			err = p.doPiece(b, info)
-		}
-		if err != nil {
-			return err
+		case b := <-p.elsewhere:
+			p.doGotElsewhere(b)
+		case now := <-ticker.C:
+			if timeout > 0 {
+				p.cancelExpired(now.Add(-timeout))
+			}
+			if p.snubbed(now) && len(p.requests.pieces) > 1 {
+				// all requests are released to faster peers, fillRequests asks this one for a block again
+				p.releaseRequests(true)
+			}
+			p.sendHaves(info)
+			p.updateInterest()
 		}
+		p.fillRequests(info)
 	}
 }
 
-func (p *peer) doPiece(b []byte, info *MetainfoInfo) (err error) {
-
-	buf := bytes.NewBuffer(b)
-
-	index, err := readUint32(buf)
-	if err != nil {
-		return err
-	}
-
-	begin, err := readUint32(buf)
-	if err != nil {
-		return err
-	}
-
-	piece := buf.Bytes()
-
-	if gBitField.Bit(int(index)) == 1 {
-		fmt.Printf("duplicate piece\n")
-		return nil
-	}
-
-	err = writeToFile(info, int(index), int64(begin), piece)
-	if err != nil {
-		return err
-	}
-
-	p.PieceOffsetMap[index] = int(begin + uint32(len(piece)))
-	if int(begin)+len(piece) == info.PieceLength {
-		// 校验
-		var h hash
-		n := copy(h[:], info.Pieces[index*hashSize:(index+1)*hashSize])
-		if n != hashSize {
-			log.Fatal("copy hash size error")
-		}
-		isValid, err := checkHash(info, int(index), h)
+// readMessages reads until error, messages are handled by loop
+func (p *peer) readMessages(msgs chan<- *peerwire.Message, errc chan<- error) {
+	r := bufio.NewReader(p.Conn)
+	for {
+		msg, err := peerwire.ReadMessage(r)
 		if err != nil {
-			return err
+			errc <- err
+			return
 		}
-		if isValid {
-			gBitField.SetBit(int(index), 1)
-			err = gBitField.ToFile(info.infoFilename())
-			if err != nil {
-				return err
-			}
+		if msg.Keepalive {
+			continue
+		}
+		select {
+		case msgs <- msg:
+		case <-p.ctx.Done():
+			return
 		}
 	}
-	return nil
 }
 
-func (p *peer) doCancel(b []byte) {
-	p.Cancel <- b
+func (p *peer) handleMessage(msg *peerwire.Message, info *MetainfoInfo) error {
+	switch msg.ID {
+	default:
+		// e.g. port or extensions we did not ask for
+		p.t.client.config.logf("ignore %s from %s", msg, p)
+	case peerwire.Choke:
+		// our requests are discarded, others may download the pieces meanwhile
+		p.PeerChoking = 1
+		p.releaseRequests(false)
+	case peerwire.Unchoke:
+		p.PeerChoking = 0
+	case peerwire.Interested:
+		atomic.StoreUint32(&p.PeerInterested, 1)
+	case peerwire.NotInterested:
+		atomic.StoreUint32(&p.PeerInterested, 0)
+	case peerwire.Have:
+		return p.doHave(msg)
+	case peerwire.Bitfield:
+		return p.doBitfield(msg)
+	case peerwire.Request:
+		return p.doRequest(msg, info)
+	case peerwire.Cancel:
+		p.doCancel(msg)
+	case peerwire.Piece:
+		return p.doPiece(msg, info)
+	case peerwire.Extended:
+		return p.doExtended(msg)
+	}
+	return nil
 }
-func (p *peer) doRequest(b []byte, info *MetainfoInfo, errOccur chan error) error {
-	cancelFlag := b[:3*4]
 
-	buf := bytes.NewBuffer(b)
-	index, err := readUint32(buf)
-	if err != nil {
-		return err
+// maxRequests how many requests we keep outstanding
+func (p *peer) maxRequests() int {
+	n := p.t.client.config.RequestQueueDepth
+	if p.snubbed(time.Now()) {
+		return 1
 	}
-	begin, err := readUint32(buf)
-	if err != nil {
-		return err
+	if p.reqq > 0 && p.reqq < n {
+		n = p.reqq
 	}
-	length, err := readUint32(buf)
-	if err != nil {
-		return err
+	if n < 1 {
+		n = 1
 	}
-
-	// if we have
-	if gBitField.Bit(int(index)) == 1 {
-
-		piece, err := readSomeFileContent(info, int(index), int64(begin), int64(length))
-		if err != nil {
-			return err
-		}
-		// 'piece' messages contain an index, begin, and piece
-		b := packMessage(piece, int32(typePiece), int32(begin), int32(length))
-
-		p.ToSend <- messageToSend{cancelFlag, b}
-
-		//todo delete this
-		go func() {
-			err = p.sendTypeMessageWhile(typePiece, (b))
-			if err != nil {
-				errOccur <- err
-			}
-		}()
-
-	}
-
-	return nil
+	return n
 }
 
-func (p *peer) sendTypeMessageWhile(t uint32, msg []byte) error {
-
-	// these two are goroutine safe
-	conn := p.Conn
-	willCancel := p.Cancel
-
-	err := writeIntegers(conn, uint32(len(msg)+4), t)
-	if err != nil {
-		return err
+// fillRequests keeps the request queue of an unchoking peer full
+func (p *peer) fillRequests(info *MetainfoInfo) {
+	if p.PeerChoking == 1 || atomic.LoadUint32(&p.AmInterested) == 0 {
+		return
 	}
-
-	for {
-
-		select {
-		case <-willCancel:
-			return nil
-		case <-time.After(chanWaitTimeout):
-			// we go on
-		}
-
-		err = conn.SetDeadline(time.Now().Add(time.Millisecond * 100))
-		if err != nil {
-			return err
-		}
-
-		n, err := conn.Write(msg)
-		if err != nil {
-			if oe, ok := err.(net.Error); ok {
-				if !oe.Timeout() {
-					return err
-				}
-			} else {
-				return err
-			}
-		}
-
-		msg = msg[n:]
-		if len(msg) == 0 {
+	n := p.maxRequests() - len(p.requests.outstanding)
+	for n > len(p.requests.pending) {
+		index := p.t.pieces.pick(p.t.bitfield, p.Bitfield)
+		if index == -1 {
 			break
 		}
+		p.requests.pick(p.t.blocks.missing(pieceBlocks(info, index)))
+	}
+	if n > len(p.requests.pending) {
+		// all pieces of the peer are being downloaded, help the others
+		p.requests.addEndgame(p.t.blocks.endgame(p, n-len(p.requests.pending)))
+	}
+	for _, b := range p.requests.next(n, time.Now()) {
+		p.t.blocks.add(b, p)
+		p.send(b.message(peerwire.Request))
 	}
-
-	return nil
 }
 
-func (p *peer) doBitfield(b []byte) error {
-	if len(b) != (gBitField.Len()) {
-		return errors.New("bitfield length mismatch")
+// cancelExpired cancels requests sent before deadline, fillRequests sends them again
+func (p *peer) cancelExpired(deadline time.Time) {
+	for _, b := range p.requests.expired(deadline) {
+		p.t.blocks.remove(b, p)
+		p.t.client.config.logf("request %d %d timed out on %s", b.Index, b.Begin, p)
+		p.send(b.message(peerwire.Cancel))
 	}
-	p.Bitfield.SetBitData(b)
-	return nil
 }
-func (p *peer) doHave(b []byte) error {
-	buf := bytes.NewBuffer(b)
-	index, err := readUint32(buf)
-	if err != nil {
-		return err
+
+func (p *peer) doPiece(msg *peerwire.Message, info *MetainfoInfo) (err error) {
+	index, begin, piece := msg.Index, msg.Begin, msg.Block
+
+	if int(index) >= info.piecesCount() {
+		return badMessage("piece index %d out of range", index)
 	}
-	p.Bitfield.SetBit(int(index), 1)
-	return nil
-}
-func readNextMsg(conn net.Conn) (uint32, []byte, error) {
-	// Messages of length zero are keepalives, and ignored
-	size := 0
-	for {
-		size, err := readUint32(conn)
-		if err != nil {
-			return 0, nil, err
-		}
-		if size != 0 {
-			break
-		}
+	b := blockRequest{index, begin, uint32(len(piece))}
+	if ok, _ := p.requests.received(b); !ok {
+		p.t.client.config.logf("unrequested block %d %d from %s", index, begin, p)
+		return nil
+	}
+	p.countPayload(len(piece), 0)
+	atomic.StoreInt64(&p.lastBlock, time.Now().UnixNano())
+	if p.t.bitfield.Bit(int(index)) == 1 {
+		p.t.client.config.logf("piece %d we have from %s", index, p)
+		return nil
 	}
 
-	t, err := readUint32(conn)
+	others, ok := p.t.blocks.received(b, p)
+	if !ok {
+		p.t.client.config.logf("duplicate block %d %d from %s", index, begin, p)
+		return nil
+	}
+	_, err = p.t.storage.WriteAt(int(index), piece, int64(begin))
 	if err != nil {
-		return 0, nil, err
+		p.t.blocks.unreceived(b)
+		return p.t.diskError(err)
 	}
-
-	b := make([]byte, size-4)
-	if size-4 > 0 {
-		_, err = io.ReadFull(conn, b)
-		if err != nil {
-			return 0, nil, err
-		}
+	for _, other := range others {
+		other.gotElsewhere(b)
 	}
-	return t, b, nil
-}
-func (p *peer) sendCmd(t uint32) {
-	msg := packMessage(nil, int32(t))
-	p.ToSend <- messageToSend{nil, msg}
-}
-
-func requestPeer(p *peer, info *MetainfoInfo) error {
-	// randomly pick a pieace to download
-	index := randIndex(info)
-	sendMessage(p.Conn, requestMessage(int32(index)))
+	p.t.pieces.setPartial(int(index), true)
+	if p.t.blocks.written(b) {
+		p.pieceDone(index)
+	}
+	p.t.saveResumeLater()
 	return nil
 }
 
-// return -1 if all bit set
-func randIndex(info *MetainfoInfo) int {
-	cnt := info.piecesCount()
-	start := rand.Intn(cnt)
-	for i := 0; i < cnt; i++ {
-		ii := (start + i) % cnt
-		if gBitField.Bit(ii) == 0 {
-			return ii
-		}
+// doGotElsewhere cancels a block another peer sent us
+func (p *peer) doGotElsewhere(b blockRequest) {
+	_, requested := p.requests.outstanding[b]
+	if ok, _ := p.requests.received(b); ok && requested {
+		p.send(b.message(peerwire.Cancel))
 	}
-	return -1
 }
 
-// var pieceInnerIndex int32 = 0
-
-func requestMessage(index int32) *bytes.Buffer {
-	b := new(bytes.Buffer)
-
-	err := writeInteger(b, index)
-	if err != nil {
-		log.Fatal(err)
-	}
-	pieceInnerIndex := 0
-	err = writeInteger(b, pieceInnerIndex)
-	if err != nil {
-		log.Fatal(err)
+// pieceDone queues a piece all blocks are written to check hash, whichever peers sent them
+func (p *peer) pieceDone(index uint32) {
+	if !p.t.queueVerify(p.ctx, int(index)) {
+		// dropped first, download it again
+		p.t.resetPiece(int(index))
 	}
+}
 
-	err = writeInteger(b, requestLength)
-	if err != nil {
-		log.Fatal(err)
+func (p *peer) doExtended(msg *peerwire.Message) error {
+	if len(msg.Payload) == 0 {
+		return badMessage("empty extended message")
 	}
-	return b
-}
-func sendMessage(conn net.Conn, msg *bytes.Buffer) error {
-	err := writeInteger(conn, uint32(msg.Len()))
-	if err != nil {
-		return err
+	if msg.Payload[0] != extendedHandshakeID {
+		// we tell no extended messages in handshake, so should not get any
+		return nil
 	}
-	n, err := msg.WriteTo(conn)
+	reqq, err := parseExtendedHandshake(msg.Payload[1:])
 	if err != nil {
-		return err
-	}
-	if int(n) != msg.Len() {
-		log.Fatal("write message length not enough")
+		return badMessage("extended handshake: %s", err)
 	}
+	p.reqq = reqq
 	return nil
 }
 
-// pack ints and bytes
-func packMessage(b []byte, is ...int32) []byte {
-	buf := bytes.NewBuffer(b)
-	err := writeIntegers(buf, is)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = writeAll(buf, b)
-	if err != nil {
-		log.Fatal(err)
+func (p *peer) doCancel(msg *peerwire.Message) {
+	select {
+	case p.Cancel <- msg:
+	case <-p.ctx.Done():
 	}
-	return buf.Bytes()
 }
 
-func sendTypeMessage(conn net.Conn, t uint32, msg *bytes.Buffer) error {
-	err := writeIntegers(conn, uint32(msg.Len()+4), t)
-	if err != nil {
-		return err
+func (p *peer) doRequest(msg *peerwire.Message, info *MetainfoInfo) error {
+	if int(msg.Index) >= info.piecesCount() {
+		return badMessage("request index %d out of range", msg.Index)
 	}
-	n, err := msg.WriteTo(conn)
-	if err != nil {
-		return err
+	if msg.Length > maxRequestLength || int64(msg.Begin)+int64(msg.Length) > int64(info.pieceSize(int(msg.Index))) {
+		return badMessage("request %d %d %d", msg.Index, msg.Begin, msg.Length)
 	}
-	if int(n) != msg.Len() {
-		log.Fatal("write message length not enough")
+	// if we have, requests of choked peers are discarded
+	if atomic.LoadUint32(&p.AmChoking) == 0 && p.t.bitfield.Bit(int(msg.Index)) == 1 {
+		var piece []byte
+		if m, ok := p.t.storage.(blockMapper); ok {
+			piece = m.mappedBlock(int(msg.Index), int64(msg.Begin), int(msg.Length))
+		}
+		if piece == nil {
+			piece = make([]byte, msg.Length)
+			_, err := p.t.storage.ReadAt(int(msg.Index), piece, int64(msg.Begin))
+			if err != nil {
+				return p.t.diskError(err)
+			}
+		}
+		// 'piece' messages contain an index, begin, and piece
+		p.send(&peerwire.Message{ID: peerwire.Piece, Index: msg.Index, Begin: msg.Begin, Block: piece})
+		p.countPayload(0, len(piece))
 	}
+
 	return nil
 }
-func buildPeerMessageBitfield(info *MetainfoInfo) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := writeInteger(buf, uint32(typeBitfield))
-	if err != nil {
-		return nil, err
+
+func (p *peer) doBitfield(msg *peerwire.Message) error {
+	if len(msg.Bitfield) != (p.t.bitfield.Len()) {
+		return badMessage("bitfield length %d", len(msg.Bitfield))
 	}
-	b, err := info.bitfield()
-	if err != nil {
-		return nil, err
+	p.t.pieces.addBitfield(p.Bitfield, -1)
+	p.Bitfield.SetBitData(msg.Bitfield)
+	p.t.pieces.addBitfield(p.Bitfield, 1)
+	p.updateInterest()
+	return nil
+}
+func (p *peer) doHave(msg *peerwire.Message) error {
+	if int(msg.Index) >= p.t.Metainfo.Info.piecesCount() {
+		return badMessage("have index %d out of range", msg.Index)
 	}
-	n, err := buf.Write(b.BitData())
+	if p.Bitfield.Bit(int(msg.Index)) == 1 {
+		return nil
+	}
+	p.t.pieces.have(int(msg.Index))
+	err := p.Bitfield.SetBit(int(msg.Index), 1)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if n != b.Len() {
-		log.Fatal("write not enough bytes")
+	p.updateInterest()
+	return nil
+}
+func (p *peer) sendCmd(id peerwire.ID) {
+	p.send(&peerwire.Message{ID: id})
+}
+
+// sendHaves tells the peer pieces we got since last time
+func (p *peer) sendHaves(info *MetainfoInfo) {
+	for i := 0; i < info.piecesCount(); i++ {
+		if p.announced.Bit(i) == 0 && p.t.bitfield.Bit(i) == 1 {
+			p.announced.SetBit(i, 1)
+			p.send(&peerwire.Message{ID: peerwire.Have, Index: uint32(i)})
+		}
 	}
-	return buf.Bytes(), nil
 }
 
-func handshake(p *peer, metainfo *Metainfo) error {
-	fmt.Printf("handshake with peer %s\n", p.Addr.String())
+func bitfieldMessage(b *bitfield) *peerwire.Message {
+	return &peerwire.Message{ID: peerwire.Bitfield, Bitfield: b.copyData()}
+}
+
+func handshake(p *peer, metainfo *Metainfo, myPeerID peerID) error {
 	conn := p.Conn
 
 	// The handshake starts with character ninteen (decimal) followed by the string 'BitTorrent protocol'
 	err := protocol(conn)
 	if err != nil {
-		fmt.Printf("%s protocol error: %s", p, err)
 		return err
 	}
 
-	err = reservedBytes(conn)
+	p.Reserved, err = reservedBytes(conn)
 	if err != nil {
-		fmt.Printf("%s reserved bytes error: %s", p, err)
 		return err
 	}
 
 	err = exchangeSha1Hash(conn, metainfo.InfoHash[:])
 	if err != nil {
-		fmt.Printf("%s exchange hash error: %s", p, err)
 		return err
 	}
 
-	err = exchangePeerID(conn, myPeerID[:])
+	p.PeerID, err = exchangePeerID(conn, myPeerID[:])
 	if err != nil {
-		fmt.Printf("%s exchange peer id error: %s", p, err)
 		return err
 	}
 
 	return nil
 }
 
-func exchangePeerID(conn net.Conn, peerID []byte) error {
+// acceptHandshake reads the handshake of an incoming connection up to the info hash,
+// we answer the info hash only if we have the torrent.
+func acceptHandshake(conn net.Conn) (ih hash, reserved reservedBits, err error) {
+	err = protocol(conn)
+	if err != nil {
+		return ih, reserved, err
+	}
+	reserved, err = reservedBytes(conn)
+	if err != nil {
+		return ih, reserved, err
+	}
+	_, err = io.ReadFull(conn, ih[:])
+	return ih, reserved, err
+}
 
-	n, err := conn.Write(peerID)
+// finishHandshake completes the handshake started by acceptHandshake
+func finishHandshake(conn net.Conn, ih hash, myPeerID peerID) (peerID, error) {
+	err := writeAll(conn, ih[:])
 	if err != nil {
-		return err
+		return peerID{}, err
 	}
-	if n != len(peerID) {
-		log.Fatal("write reserved bytes length error")
+	return exchangePeerID(conn, myPeerID[:])
+}
+
+func exchangePeerID(conn net.Conn, myPeerID []byte) (peerID, error) {
+	var pid peerID
+
+	err := writeAll(conn, myPeerID)
+	if err != nil {
+		return pid, err
 	}
 
-	br := make([]byte, peerIDSize)
-	_, err = io.ReadFull(conn, br)
-	return err
+	_, err = io.ReadFull(conn, pid[:])
+	return pid, err
 }
 func protocol(conn net.Conn) error {
 	s := "BitTorrent protocol"
-	n, err := fmt.Fprintf(conn, "%c%s", 19, s)
-	if err != nil {
-		return err
-	}
-	if n != len(s)+1 {
-		log.Fatal("handshake write failed")
-	}
-	rd := bufio.NewReader(conn)
-	len, err := rd.ReadByte()
+	_, err := fmt.Fprintf(conn, "%c%s", 19, s)
 	if err != nil {
 		return err
 	}
-	if len != 19 {
-		log.Fatal("unknown handshake version")
-	}
-	b := make([]byte, 19)
-	_, err = io.ReadFull(rd, b)
+	b := make([]byte, 20)
+	_, err = io.ReadFull(conn, b)
 	if err != nil {
 		return err
 	}
-	if string(b) != s {
-		log.Fatalf("unknown version: %s", string(b))
+	if b[0] != 19 || string(b[1:]) != s {
+		return ErrProtocolMismatch
 	}
 	return nil
 }
 
 func exchangeSha1Hash(conn net.Conn, infoHash []byte) error {
-	n, err := conn.Write(infoHash)
+	err := writeAll(conn, infoHash)
 	if err != nil {
 		return err
 	}
-	if n != len(infoHash) {
-		log.Fatal("write reserved bytes length error")
-	}
 
 	br := make([]byte, hashSize)
 	_, err = io.ReadFull(conn, br)
@@ -629,40 +656,32 @@ func exchangeSha1Hash(conn net.Conn, infoHash []byte) error {
 		return err
 	}
 	if bytes.Compare(br, infoHash) != 0 {
-		log.Fatal("info hash not equal")
+		return ErrInfoHashMismatch
 	}
 
 	return nil
 }
-func reservedBytes(conn net.Conn) error {
-	b := make([]byte, 8)
-	n, err := conn.Write(b)
-	if err != nil {
-		return err
-	}
-	if n != len(b) {
-		log.Fatal("write reserved bytes length error")
-	}
 
-	br := make([]byte, 8)
-	_, err = io.ReadFull(conn, br)
+// reservedBytes sends our reserved bytes and reads those of the peer
+func reservedBytes(conn net.Conn) (reservedBits, error) {
+	var r reservedBits
+	ours := ourReservedBits()
+	err := writeAll(conn, ours[:])
 	if err != nil {
-		return err
-	}
-	if bytes.Compare(br, b) != 0 {
-		log.Fatal("reserved bytes not 0")
+		return r, err
 	}
 
-	return nil
+	_, err = io.ReadFull(conn, r[:])
+	return r, err
 }
 
-func (p *peer) heartBeat(willStop chan int) {
+func (p *peer) heartBeat(interval time.Duration) {
 	for {
 		select {
-		case <-time.After(2 * time.Minute):
-			p.ToSend <- messageToSend{nil, nil}
+		case <-time.After(interval):
+			p.send(&peerwire.Message{Keepalive: true})
 
-		case <-willStop:
+		case <-p.ctx.Done():
 			return
 		}
 	}
@@ -0,0 +1,213 @@
+package gobt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+// connectPeer makes the torrent connect to a fake peer, returns the connection of the fake peer
+func connectPeer(t *testing.T, tt *Torrent) net.Conn {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	tt.addPeer(newPeer(tt, ln.Addr()))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	ih, _, err := acceptHandshake(conn)
+	if err != nil {
+		t.Fatalf("handshake error: %v", err)
+	}
+	_, err = finishHandshake(conn, ih, peerID{})
+	if err != nil {
+		t.Fatalf("handshake error: %v", err)
+	}
+	return conn
+}
+
+func writeMessages(t *testing.T, conn net.Conn, msgs ...*peerwire.Message) {
+	for _, m := range msgs {
+		if _, err := m.WriteTo(conn); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+}
+
+// readMessage reads the next message which is not a keepalive
+func readMessage(t *testing.T, conn net.Conn) *peerwire.Message {
+	for {
+		m, err := peerwire.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if !m.Keepalive {
+			return m
+		}
+	}
+}
+
+func testTorrent(t *testing.T, config *ClientConfig, mi *Metainfo) (*Client, *Torrent) {
+	config.DownloadRoot = t.TempDir()
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	tt, err := c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	return c, tt
+}
+
+func TestPeerMessages(t *testing.T) {
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", []byte("hello world"), 4))
+	defer c.Close()
+	conn := connectPeer(t, tt)
+	defer conn.Close()
+
+	// a seeder which unchokes us
+	writeMessages(t, conn,
+		&peerwire.Message{Keepalive: true},
+		&peerwire.Message{ID: peerwire.Bitfield, Bitfield: []byte{0xe0}},
+		&peerwire.Message{ID: peerwire.Port, Port: 6881},
+		&peerwire.Message{ID: peerwire.Unchoke},
+	)
+
+	// not unchoked as it is not interested
+	want := []peerwire.ID{peerwire.Bitfield, peerwire.Extended, peerwire.Interested}
+	for _, id := range want {
+		m := readMessage(t, conn)
+		if m.ID != id {
+			t.Fatalf("got %s, want %s", m, id)
+		}
+		switch id {
+		case peerwire.Bitfield:
+			if len(m.Bitfield) != 1 || m.Bitfield[0] != 0 {
+				t.Errorf("bitfield %x", m.Bitfield)
+			}
+		case peerwire.Extended:
+			reqq, err := parseExtendedHandshake(m.Payload[1:])
+			if err != nil || reqq != maxPeerRequests {
+				t.Errorf("extended handshake reqq %d %v", reqq, err)
+			}
+		}
+	}
+
+	// every piece, the last one is short
+	got := make(map[uint32]uint32)
+	for len(got) < 3 {
+		m := readMessage(t, conn)
+		if m.ID != peerwire.Request || m.Begin != 0 {
+			t.Fatalf("got %s", m)
+		}
+		got[m.Index] = m.Length
+	}
+	if got[0] != 4 || got[1] != 4 || got[2] != 3 {
+		t.Errorf("requests %v", got)
+	}
+}
+
+func TestPeerRequestQueue(t *testing.T) {
+	config := DefaultClientConfig()
+	config.RequestTimeout = 200 * time.Millisecond
+	data := make([]byte, 2*requestLength+100)
+	c, tt := testTorrent(t, config, testMetainfo("a", data, len(data)))
+	defer c.Close()
+	conn := connectPeer(t, tt)
+	defer conn.Close()
+
+	handshake, _ := Encode(map[string]interface{}{"reqq": 2})
+	writeMessages(t, conn,
+		&peerwire.Message{ID: peerwire.Bitfield, Bitfield: []byte{0x80}},
+		&peerwire.Message{ID: peerwire.Extended, Payload: append([]byte{extendedHandshakeID}, handshake...)},
+		&peerwire.Message{ID: peerwire.Unchoke},
+	)
+	readRequest := func(id peerwire.ID) *peerwire.Message {
+		for {
+			m := readMessage(t, conn)
+			if m.ID == id {
+				return m
+			}
+			if m.ID == peerwire.Request || m.ID == peerwire.Cancel {
+				t.Fatalf("got %s, want %s", m, id)
+			}
+		}
+	}
+
+	// at most reqq outstanding
+	first := readRequest(peerwire.Request)
+	second := readRequest(peerwire.Request)
+	if first.Begin != 0 || second.Begin != requestLength {
+		t.Errorf("requests %s, %s", first, second)
+	}
+	writeMessages(t, conn, &peerwire.Message{ID: peerwire.Piece, Index: 0, Begin: 0, Block: data[:requestLength]})
+	third := readRequest(peerwire.Request)
+	if third.Begin != 2*requestLength || third.Length != 100 {
+		t.Errorf("last block %s", third)
+	}
+
+	// the peer discards requests when it chokes
+	writeMessages(t, conn, &peerwire.Message{ID: peerwire.Choke}, &peerwire.Message{ID: peerwire.Unchoke})
+	again := readRequest(peerwire.Request)
+	if again.Begin != requestLength {
+		t.Errorf("request after unchoke %s", again)
+	}
+	readRequest(peerwire.Request)
+
+	// no answer, canceled and requested again
+	cancel := readRequest(peerwire.Cancel)
+	if cancel.Index != 0 {
+		t.Errorf("cancel %s", cancel)
+	}
+}
+
+func TestPeerChokeReleasesPieces(t *testing.T) {
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", []byte("hello world"), 4))
+	defer c.Close()
+	seeder := func() net.Conn {
+		conn := connectPeer(t, tt)
+		writeMessages(t, conn,
+			&peerwire.Message{ID: peerwire.Bitfield, Bitfield: []byte{0xe0}},
+			&peerwire.Message{ID: peerwire.Unchoke},
+		)
+		return conn
+	}
+	readRequests := func(conn net.Conn, n int) {
+		for got := 0; got < n; {
+			if m := readMessage(t, conn); m.ID == peerwire.Request {
+				got++
+			}
+		}
+	}
+
+	// a seeder picks every piece, then chokes us without sending any
+	a := seeder()
+	defer a.Close()
+	readRequests(a, 3)
+	writeMessages(t, a, &peerwire.Message{ID: peerwire.Choke})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tt.pieces.mu.Lock()
+		released := !tt.pieces.downloading[0] && !tt.pieces.downloading[1] && !tt.pieces.downloading[2]
+		tt.pieces.mu.Unlock()
+		if released {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pieces not released after choke")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// another seeder gets them
+	b := seeder()
+	defer b.Close()
+	readRequests(b, 3)
+}
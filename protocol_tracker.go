@@ -1,9 +1,11 @@
 package gobt
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -12,6 +14,11 @@ import (
 	"time"
 )
 
+const trackerRetryInterval = time.Minute
+
+// minTrackerInterval announces are not sooner than it, whatever interval trackers tell
+const minTrackerInterval = trackerRetryInterval
+
 // TrackerRequest Tracker GET requests
 type TrackerRequest struct {
 	InfoHash   hash
@@ -36,21 +43,6 @@ type TrackerResponse struct {
 	IPPort        []ipPort
 }
 
-// NewTrackerRequest new a tracker request with current bt file
-func NewTrackerRequest(mi *Metainfo, port uint16) *TrackerRequest {
-	r := TrackerRequest{
-		InfoHash:   mi.InfoHash,
-		PeerID:     myPeerID,
-		Port:       port,
-		Uploaded:   0,
-		Downloaded: 0,
-		Left:       gBitField.left() * uint64(mi.Info.PieceLength),
-		// Key        uint32
-		// NumWant: -1,
-	}
-	return &r
-}
-
 // Query return http query
 func (r *TrackerRequest) Query() url.Values {
 	v := url.Values{}
@@ -60,35 +52,218 @@ func (r *TrackerRequest) Query() url.Values {
 	v.Set("uploaded", strconv.Itoa(int(r.Uploaded)))
 	v.Set("downloaded", strconv.Itoa(int(r.Downloaded)))
 	v.Set("left", strconv.Itoa(int(r.Left)))
+	switch r.Event {
+	case eventStarted:
+		v.Set("event", "started")
+	case eventCompleted:
+		v.Set("event", "completed")
+	case eventStopped:
+		v.Set("event", "stopped")
+	}
 	return v
 }
 
-var trackerMap map[string]bool // state of tracker
-var trackerMapMutex sync.RWMutex
+// trackerList announce urls of a torrent, can be changed while running
+type trackerList struct {
+	mu      sync.Mutex
+	urls    []string
+	changed chan struct{} // closed and replaced on every change
+}
 
-func trackerProtocol(metainfo *Metainfo, port uint16) {
-	allAnnounce := getAllAnnounce(metainfo)
-	for _, announce := range allAnnounce {
-		u, err := url.Parse(announce)
-		if err != nil {
-			fmt.Printf("parse announce url error: %s\n", err)
+func newTrackerList(urls []string) *trackerList {
+	return &trackerList{
+		urls:    unique(urls),
+		changed: make(chan struct{}),
+	}
+}
+
+// snapshot returns current urls and a channel closed on next change
+func (l *trackerList) snapshot() ([]string, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.urls...), l.changed
+}
+
+func (l *trackerList) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *trackerList) index(announce string) int {
+	for i, u := range l.urls {
+		if u == announce {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *trackerList) add(announce string) error {
+	_, err := url.Parse(announce)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.index(announce) != -1 {
+		return errors.New("tracker already exists")
+	}
+	l.urls = append(l.urls, announce)
+	l.notify()
+	return nil
+}
+
+func (l *trackerList) remove(announce string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.index(announce)
+	if i == -1 {
+		return errors.New("no such tracker")
+	}
+	l.urls = append(l.urls[:i], l.urls[i+1:]...)
+	l.notify()
+	return nil
+}
+
+func (l *trackerList) replace(old, announce string) error {
+	_, err := url.Parse(announce)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.index(old)
+	if i == -1 {
+		return errors.New("no such tracker")
+	}
+	if l.index(announce) != -1 {
+		return errors.New("tracker already exists")
+	}
+	l.urls[i] = announce
+	l.notify()
+	return nil
+}
+
+// runTrackers keeps one announce loop per tracker, following changes of the list.
+// It returns after all trackers are told we stopped.
+func runTrackers(ctx context.Context, t *Torrent) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	running := make(map[string]context.CancelFunc)
+	for {
+		urls, changed := t.trackers.snapshot()
+		want := make(map[string]bool, len(urls))
+		for _, announce := range urls {
+			want[announce] = true
+			if running[announce] == nil {
+				trackerCtx, cancel := context.WithCancel(ctx)
+				running[announce] = cancel
+				wg.Add(1)
+				go func(announce string) {
+					defer wg.Done()
+					keepAliveWithTracker(trackerCtx, t, announce)
+				}(announce)
+			}
+		}
+		for announce, cancel := range running {
+			if !want[announce] {
+				t.client.config.logf("stop tracker %s", announce)
+				cancel()
+				delete(running, announce)
+			}
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
 			return
 		}
-		// fmt.Println(u)
-		if u.Scheme != "http" {
-			fmt.Printf("unsupported tracker scheme yet: %s\n", announce)
-			continue
+	}
+}
+
+func keepAliveWithTracker(ctx context.Context, t *Torrent, announce string) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		t.client.config.logf("parse announce url error: %s", err)
+		return
+	}
+	switch {
+	case u.Scheme == "udp" && t.client.config.NoUDPTrackers:
+		t.client.config.logf("udp trackers disabled: %s", announce)
+		return
+	case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp":
+		t.client.config.logf("unsupported tracker scheme yet: %s", announce)
+		return
+	}
+
+	event := eventStarted
+	for {
+		interval, pl, err := announceTracker(ctx, t, u, event)
+		if err != nil {
+			err = &TrackerError{URL: announce, Err: err}
+			t.client.config.logf("%s", err)
+			t.client.emit(Event{Type: EventTrackerError, Torrent: t, Tracker: announce, Err: err})
+			interval = trackerRetryInterval
+		} else {
+			event = eventNone
+		}
+		if interval < minTrackerInterval {
+			interval = minTrackerInterval
 		}
+		t.client.config.logf("got %d peers from %s", len(pl), announce)
+
+		// todo limit the number of peers
+		for _, pp := range pl {
+			select {
+			case t.peersToStart <- pp:
+			case <-ctx.Done():
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			if event != eventStarted {
+				t.announceStopped(u)
+			}
+			return
+		}
+	}
+}
+
+// announceStopped tells the tracker we are leaving, the run of torrent is done already
+func (t *Torrent) announceStopped(u *url.URL) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.client.config.TrackerTimeout)
+	defer cancel()
+	_, _, err := announceTracker(ctx, t, u, eventStopped)
+	if err != nil {
+		t.client.config.logf("tracker %s stopped error: %s", u, err)
+	}
+}
 
-		go keepAliveWithTracker(u, metainfo, port)
+func announceTracker(ctx context.Context, t *Torrent, u *url.URL, event uint32) (time.Duration, []net.Addr, error) {
+	req := t.trackerRequest(event)
+	if u.Scheme == "udp" {
+		resp, err := udpTracker(ctx, u.Host, req, t.client.config.TrackerTimeout)
+		if err != nil {
+			return 0, nil, err
+		}
+		return time.Duration(resp.Interval) * time.Second, ipPortAddrList(resp.IPPort), nil
 	}
+	seconds, pl, err := httpTracker(ctx, *u, req, &t.client.config)
+	return time.Duration(seconds) * time.Second, pl, err
 }
-func keepAliveWithTracker(u *url.URL, metainfo *Metainfo, port uint16) {
-	fmt.Printf("connect to tracker %s\n", u.String())
-	q := NewTrackerRequest(metainfo, port).Query()
+
+func httpTracker(ctx context.Context, u url.URL, req *TrackerRequest, config *ClientConfig) (int, []net.Addr, error) {
+	config.logf("connect to tracker %s", u.String())
+	q := req.Query()
 	u.RawQuery = q.Encode()
+	client := http.Client{Timeout: config.TrackerTimeout}
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return 0, nil, err
+	}
 	var body []byte
-	if doNotBotherTracker { // for debug
+	if config.DebugTrackerCache { // for debug
 		debugRoot := ".debug"
 		cacheFile := buildPath(debugRoot, (u.Hostname()))
 		if _, err := os.Stat(cacheFile); err != nil {
@@ -96,93 +271,77 @@ func keepAliveWithTracker(u *url.URL, metainfo *Metainfo, port uint16) {
 			if _, err := os.Stat(errFile); err == nil {
 				errBytes, err := ioutil.ReadFile(errFile)
 				if err != nil {
-					log.Fatal(err)
+					return 0, nil, err
 				}
-				fmt.Printf("last error of %s: %s\n", u.String(), string(errBytes))
-				return
+				return 0, nil, fmt.Errorf("last error: %s", errBytes)
 			}
-			resp, err := http.Get(u.String())
+			resp, err := client.Do(httpReq)
 			if err != nil {
-				fmt.Printf("GET %s error: %s\n", u.String(), err)
-				err = ioutil.WriteFile(errFile, []byte(err.Error()), 0664)
-				if err != nil {
-					log.Fatal(err)
+				err2 := ioutil.WriteFile(errFile, []byte(err.Error()), 0664)
+				if err2 != nil {
+					config.logf("write tracker cache error: %s", err2)
 				}
-				return
+				return 0, nil, err
 			}
 			defer resp.Body.Close()
 			body, err = ioutil.ReadAll(resp.Body)
 			if err != nil {
-				fmt.Printf("GET %s read error: %s\n", u.String(), err)
-				return
+				return 0, nil, err
 			}
 			err = ioutil.WriteFile(cacheFile, body, 0664)
 			if err != nil {
-				log.Fatal(err)
+				config.logf("write tracker cache error: %s", err)
 			}
 		} else {
-			fmt.Printf("cache hit %s\n", u.String())
+			config.logf("cache hit %s", u.String())
 			body, err = ioutil.ReadFile(cacheFile)
 			if err != nil {
-				log.Fatal(err)
+				return 0, nil, err
 			}
 		}
 	} else {
-		resp, err := http.Get(u.String())
+		resp, err := client.Do(httpReq)
 		if err != nil {
-			fmt.Printf("GET %s error: %s\n", u.String(), err)
-			return
+			return 0, nil, err
 		}
 		defer resp.Body.Close()
 		body, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
-			fmt.Printf("GET %s read error: %s\n", u.String(), err)
-			return
+			return 0, nil, err
 		}
 	}
 
 	r, err := Parse(body)
 	if err != nil {
-		fmt.Printf("GET %s get %s parse error: %s\n", u.String(), string(body), err)
-		return
+		return 0, nil, fmt.Errorf("get %s parse error: %s", string(body), err)
+	}
+	res, ok := r.(map[string]interface{})
+	if !ok {
+		return 0, nil, errors.New("response is not a dictionary")
 	}
-	res := r.(map[string]interface{})
 	if res["failure reason"] != nil {
-		fmt.Printf("GET %s failure reason: %s\n", u.String(), res["failure reason"].([]byte))
-		return
+		return 0, nil, fmt.Errorf("failure reason: %s", res["failure reason"])
+	}
+	interval, ok := res["interval"].(int64)
+	if !ok {
+		return 0, nil, errors.New("no interval")
 	}
-	interval := res["interval"].(int)
-	fmt.Printf("interval: %d\t(%s)\n", interval, u.String())
+	config.logf("interval: %d\t(%s)", interval, u.String())
 
-	peers := res["peers"]
-	pl := make([]*peer, 0)
-	piecesCount := metainfo.Info.piecesCount()
-	switch t := peers.(type) {
+	var pl []net.Addr
+	switch peers := res["peers"].(type) {
 	default:
-		fmt.Printf("unexpected type %T\n", t) // %T prints whatever type t has
-		return
-	case string:
-		pl, err = compactPeerList(peers.([]byte), piecesCount)
+		return 0, nil, fmt.Errorf("unexpected type %T", peers) // %T prints whatever type t has
+	case []byte:
+		pl, err = compactPeerList(peers)
 		if err != nil {
-			fmt.Printf("parse compact peer list error: %v\n", err)
-			return
+			return 0, nil, fmt.Errorf("parse compact peer list error: %v", err)
 		}
-	case map[string]interface{}:
-		pl, err = peerList(peers.(map[string]interface{}), piecesCount)
+	case []interface{}:
+		pl, err = peerList(peers)
 		if err != nil {
-			fmt.Printf("parse compact peer list error: %v\n", err)
-			return
+			return 0, nil, fmt.Errorf("parse peer list error: %v", err)
 		}
 	}
-	fmt.Printf("got %d peers\n", len(pl))
-
-	// todo limit the number of peers
-	if len(pl) != 0 {
-		for _, pp := range pl {
-			gPeersToStart <- pp
-		}
-	}
-
-	time.Sleep(time.Duration(interval) * (time.Second))
-	go keepAliveWithTracker(u, metainfo, port)
+	return int(interval), pl, nil
 }
@@ -0,0 +1,75 @@
+package gobt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrackerList(t *testing.T) {
+	l := newTrackerList([]string{"http://a/announce", "http://b/announce", "http://a/announce"})
+	urls, changed := l.snapshot()
+	if len(urls) != 2 {
+		t.Errorf("urls not unique: %v", urls)
+	}
+
+	err := l.add("http://c/announce")
+	if err != nil {
+		t.Errorf("add error %s", err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Errorf("add not notified")
+	}
+
+	_, changed = l.snapshot()
+	err = l.replace("http://a/announce", "http://a/announce?passkey=1")
+	if err != nil {
+		t.Errorf("replace error %s", err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Errorf("replace not notified")
+	}
+
+	err = l.remove("http://b/announce")
+	if err != nil {
+		t.Errorf("remove error %s", err)
+	}
+	if l.remove("http://b/announce") == nil {
+		t.Errorf("remove twice")
+	}
+	if l.add("http://c/announce") == nil {
+		t.Errorf("add twice")
+	}
+
+	urls, _ = l.snapshot()
+	if len(urls) != 2 || urls[0] != "http://a/announce?passkey=1" || urls[1] != "http://c/announce" {
+		t.Errorf("urls %v", urls)
+	}
+}
+
+func TestTrackerZeroInterval(t *testing.T) {
+	var announces int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("event") != "stopped" {
+			atomic.AddInt32(&announces, 1)
+		}
+		w.Write([]byte("d8:intervali0e5:peers0:e"))
+	}))
+	defer ts.Close()
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", []byte("hello"), 5))
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	keepAliveWithTracker(ctx, tt, ts.URL+"/announce")
+	if n := atomic.LoadInt32(&announces); n != 1 {
+		t.Errorf("%d announces", n)
+	}
+}
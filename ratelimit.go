@@ -0,0 +1,224 @@
+package gobt
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const minRateBurst = 1 << 15 // a block and some messages pass at once
+
+// rateLimiter a token bucket of bytes, safe for concurrent use.
+// Tokens may go below zero, who takes more than there are waits for the debt.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second, 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	l := &rateLimiter{last: time.Now()}
+	l.SetRate(rate)
+	l.tokens = l.burst()
+	return l
+}
+
+func (l *rateLimiter) burst() float64 {
+	if l.rate < minRateBurst {
+		return minRateBurst
+	}
+	return float64(l.rate)
+}
+
+// SetRate changes the rate, 0 for no limit
+func (l *rateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+// Rate bytes per second, 0 for no limit
+func (l *rateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// reserve takes n bytes, returns how long to wait before using them
+func (l *rateLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		l.last = now
+		return 0
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// waitLimiters takes n bytes of every limiter, nil ones are skipped
+func waitLimiters(ctx context.Context, n int, limiters ...*rateLimiter) error {
+	now := time.Now()
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if d := l.reserve(n, now); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimiters upload and download limiters of a level, client, torrent or peer
+type rateLimiters struct {
+	up   *rateLimiter
+	down *rateLimiter
+}
+
+func newRateLimiters(upload, download int64) rateLimiters {
+	return rateLimiters{newRateLimiter(upload), newRateLimiter(download)}
+}
+
+func (r rateLimiters) set(upload, download int64) {
+	r.up.SetRate(upload)
+	r.down.SetRate(download)
+}
+
+// TransferStats bytes moved, payload is piece data, overhead is the rest of the protocol
+type TransferStats struct {
+	Downloaded         int64
+	Uploaded           int64
+	DownloadedOverhead int64
+	UploadedOverhead   int64
+}
+
+// transferCounter counts bytes atomically
+type transferCounter struct {
+	downloaded int64 // payload
+	uploaded   int64 // payload
+	read       int64 // all bytes
+	written    int64 // all bytes
+}
+
+func (c *transferCounter) stats() TransferStats {
+	downloaded := atomic.LoadInt64(&c.downloaded)
+	uploaded := atomic.LoadInt64(&c.uploaded)
+	return TransferStats{
+		Downloaded:         downloaded,
+		Uploaded:           uploaded,
+		DownloadedOverhead: atomic.LoadInt64(&c.read) - downloaded,
+		UploadedOverhead:   atomic.LoadInt64(&c.written) - uploaded,
+	}
+}
+
+// limitedConn a peer connection whose reads and writes wait for rate limiters and are counted
+type limitedConn struct {
+	net.Conn
+	ctx      context.Context
+	up       []*rateLimiter
+	down     []*rateLimiter
+	counters []*transferCounter
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		for _, tc := range c.counters {
+			atomic.AddInt64(&tc.read, int64(n))
+		}
+		if werr := waitLimiters(c.ctx, n, c.down...); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	err := waitLimiters(c.ctx, len(b), c.up...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	for _, tc := range c.counters {
+		atomic.AddInt64(&tc.written, int64(n))
+	}
+	return n, err
+}
+
+// limitConn wraps the connection of a peer with limiters of client, torrent and peer
+func (p *peer) limitConn(conn net.Conn) net.Conn {
+	c := p.t.client
+	return &limitedConn{
+		Conn:     conn,
+		ctx:      p.ctx,
+		up:       []*rateLimiter{c.limiters.up, p.t.limiters.up, p.limiters.up},
+		down:     []*rateLimiter{c.limiters.down, p.t.limiters.down, p.limiters.down},
+		counters: []*transferCounter{&c.transfer, &p.t.transfer},
+	}
+}
+
+// countPayload counts bytes of blocks got and sent
+func (p *peer) countPayload(downloaded, uploaded int) {
+	for _, n := range []*int64{&p.downloaded, &p.t.transfer.downloaded, &p.t.client.transfer.downloaded} {
+		atomic.AddInt64(n, int64(downloaded))
+	}
+	for _, n := range []*int64{&p.uploaded, &p.t.transfer.uploaded, &p.t.client.transfer.uploaded} {
+		atomic.AddInt64(n, int64(uploaded))
+	}
+}
+
+// SetRateLimits changes the rates of the client in bytes per second, 0 for no limit.
+// When alternative speed is on, they are used after it ends.
+func (c *Client) SetRateLimits(upload, download int64) {
+	c.altMutex.Lock()
+	defer c.altMutex.Unlock()
+	c.config.UploadRate = upload
+	c.config.DownloadRate = download
+	if !c.altActive {
+		c.limiters.set(upload, download)
+	}
+}
+
+// Stats bytes moved by all torrents
+func (c *Client) Stats() TransferStats {
+	return c.transfer.stats()
+}
+
+// SetRateLimits changes the rates of the torrent in bytes per second, 0 for no limit
+func (t *Torrent) SetRateLimits(upload, download int64) {
+	t.limiters.set(upload, download)
+}
+
+// Stats bytes moved by the torrent
+func (t *Torrent) Stats() TransferStats {
+	return t.transfer.stats()
+}
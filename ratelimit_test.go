@@ -0,0 +1,67 @@
+package gobt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(1 << 16)
+	l.last = now
+	if d := l.reserve(1<<16, now); d != 0 {
+		t.Errorf("first burst waits %v", d)
+	}
+	if d := l.reserve(1<<15, now); d != 500*time.Millisecond {
+		t.Errorf("debt waits %v", d)
+	}
+	if d := l.reserve(0, now.Add(time.Second)); d != 0 {
+		t.Errorf("paid debt waits %v", d)
+	}
+
+	// at runtime
+	l.SetRate(0)
+	if d := l.reserve(1<<30, now.Add(time.Second)); d != 0 || l.Rate() != 0 {
+		t.Errorf("no limit waits %v", d)
+	}
+	l.SetRate(1 << 15)
+	if d := l.reserve(1<<16, now.Add(2*time.Second)); d != time.Second {
+		t.Errorf("after set rate waits %v", d)
+	}
+}
+
+func TestLimitedConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	var counter transferCounter
+	up := newRateLimiter(minRateBurst)
+	conn := &limitedConn{Conn: a, ctx: context.Background(), up: []*rateLimiter{up, nil}, counters: []*transferCounter{&counter}}
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	start := time.Now()
+	data := make([]byte, minRateBurst/2)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write(data); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("written too fast in %v", d)
+	}
+
+	counter.uploaded = minRateBurst
+	stats := counter.stats()
+	if stats.Uploaded != minRateBurst || stats.UploadedOverhead != minRateBurst/2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
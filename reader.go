@@ -0,0 +1,198 @@
+package gobt
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+const defaultReadahead = 4 << 20
+
+var errReaderClosed = errors.New("reader closed")
+
+// Reader reads data of a torrent or of a file of it, waiting for pieces to be verified.
+// Pieces at and just ahead of the read position are downloaded first.
+// Read and Seek must not be called at once, ReadAt and Close may be called any time.
+type Reader struct {
+	t      *Torrent
+	offset int64 // in data of the torrent
+	length int64
+	pos    int64
+
+	mu        sync.Mutex // guards the fields below
+	readahead int64
+	first     int // pieces raised for readahead, last < first for none
+	last      int
+	closed    chan struct{}
+}
+
+// NewReader a reader of all data of the torrent, call Close after use
+func (t *Torrent) NewReader() *Reader {
+	return newReader(t, 0, t.Metainfo.Info.totalLength())
+}
+
+// NewReader a reader of the file, call Close after use
+func (f *TorrentFile) NewReader() *Reader {
+	return newReader(f.t, f.Offset, f.Length)
+}
+
+func newReader(t *Torrent, offset, length int64) *Reader {
+	return &Reader{
+		t:         t,
+		offset:    offset,
+		length:    length,
+		readahead: defaultReadahead,
+		first:     0,
+		last:      -1,
+		closed:    make(chan struct{}),
+	}
+}
+
+// SetReadahead sets how many bytes after the read position are downloaded first, not at once with Read
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	r.readahead = n
+	r.mu.Unlock()
+	r.moveWindow(r.pos)
+}
+
+// moveWindow raises priority of pieces after pos instead of those before
+func (r *Reader) moveWindow(pos int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	first, last := 0, -1
+	select {
+	case <-r.closed:
+	default:
+		if pos < r.length && r.readahead > 0 {
+			end := pos + r.readahead
+			if end > r.length {
+				end = r.length
+			}
+			pieceLength := int64(r.t.Metainfo.Info.PieceLength)
+			first = int((r.offset + pos) / pieceLength)
+			last = int((r.offset + end - 1) / pieceLength)
+		}
+	}
+	if first == r.first && last == r.last {
+		return
+	}
+	r.t.pieces.addReadahead(r.first, r.last, -1)
+	r.t.pieces.addReadahead(first, last, 1)
+	r.first, r.last = first, last
+}
+
+// Read reads from one piece at most, so it returns as soon as the piece is verified
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	r.moveWindow(r.pos)
+	n, err := r.readPiece(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt, it does not move the read position
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off+int64(n) >= r.length {
+			return n, io.EOF
+		}
+		m, err := r.readPiece(p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readPiece reads bytes at off in the piece there, waiting for it
+func (r *Reader) readPiece(p []byte, off int64) (int, error) {
+	info := r.t.Metainfo.Info
+	pos := r.offset + off
+	index := int(pos / int64(info.PieceLength))
+	begin := pos - int64(index)*int64(info.PieceLength)
+	n := int64(info.pieceSize(index)) - begin
+	if n > int64(len(p)) {
+		n = int64(len(p))
+	}
+	if n > r.length-off {
+		n = r.length - off
+	}
+	if err := r.t.waitPiece(index, r.closed); err != nil {
+		return 0, err
+	}
+	return r.t.storage.ReadAt(index, p[:n], begin)
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	r.moveWindow(r.pos)
+	return offset, nil
+}
+
+// Close stops raising priority of pieces, reads waiting return an error
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+	r.t.pieces.addReadahead(r.first, r.last, -1)
+	r.first, r.last = 0, -1
+	return nil
+}
+
+// waitPiece waits until piece index is verified, or cancel is closed
+func (t *Torrent) waitPiece(index int, cancel <-chan struct{}) error {
+	if t.bitfield.Bit(index) == 1 {
+		return nil
+	}
+	t.pieces.addReading(index, 1)
+	defer t.pieces.addReading(index, -1)
+	for {
+		t.waitMutex.Lock()
+		wait := t.pieceWait
+		t.waitMutex.Unlock()
+		if t.bitfield.Bit(index) == 1 {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-cancel:
+			return errReaderClosed
+		case <-t.stopped:
+			return errTorrentStopped
+		}
+	}
+}
+
+// havePiece wakes readers waiting for pieces
+func (t *Torrent) havePiece() {
+	t.waitMutex.Lock()
+	defer t.waitMutex.Unlock()
+	close(t.pieceWait)
+	t.pieceWait = make(chan struct{})
+}
@@ -0,0 +1,124 @@
+package gobt
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// writePiece writes a piece to the storage of a torrent and verifies it
+func writePiece(t *testing.T, tt *Torrent, data []byte, index int) {
+	info := tt.Metainfo.Info
+	begin := index * info.PieceLength
+	if _, err := tt.storage.WriteAt(index, data[begin:begin+info.pieceSize(index)], 0); err != nil {
+		t.Fatalf("write piece %d error: %v", index, err)
+	}
+	tt.verifyPiece(context.Background(), index)
+	if tt.bitfield.Bit(index) != 1 {
+		t.Fatalf("piece %d not verified", index)
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := []byte("hello world")
+	mi := testFilesMetainfo("m", data, 4, []string{"x", "empty", "d/y"}, []int64{3, 0, 8})
+	c, tt := testTorrent(t, DefaultClientConfig(), mi)
+	defer c.Close()
+	tt.Pause()
+	for i := 0; i < mi.Info.piecesCount(); i++ {
+		writePiece(t, tt, data, i)
+	}
+
+	r := tt.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "hello world" {
+		t.Errorf("read all %q %v", b, err)
+	}
+
+	f := tt.Files()[2].NewReader()
+	defer f.Close()
+	if pos, err := f.Seek(-3, io.SeekEnd); pos != 5 || err != nil {
+		t.Errorf("seek %d %v", pos, err)
+	}
+	b, err = ioutil.ReadAll(f)
+	if err != nil || string(b) != "rld" {
+		t.Errorf("read %q %v", b, err)
+	}
+	b = make([]byte, 4)
+	if n, err := f.ReadAt(b, 1); n != 4 || err != nil || string(b) != "o wo" {
+		t.Errorf("read at %d %q %v", n, b, err)
+	}
+	if n, err := f.ReadAt(b, 6); n != 2 || err != io.EOF || string(b[:n]) != "ld" {
+		t.Errorf("read at end %d %q %v", n, b[:n], err)
+	}
+	if n, err := tt.Files()[1].NewReader().Read(b); n != 0 || err != io.EOF {
+		t.Errorf("read empty file %d %v", n, err)
+	}
+}
+
+func TestReaderWaits(t *testing.T) {
+	data := []byte("hello world")
+	mi := testMetainfo("a", data, 4)
+	c, tt := testTorrent(t, DefaultClientConfig(), mi)
+	defer c.Close()
+	tt.Pause()
+
+	r := tt.NewReader()
+	r.SetReadahead(6)
+	if _, err := r.Seek(4, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string)
+	go func() {
+		b := make([]byte, 10)
+		n, err := r.Read(b)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		done <- string(b[:n])
+	}()
+	// waiting for piece 1, and piece 2 is ahead
+	for i := 0; i < 100; i++ {
+		tt.pieces.mu.Lock()
+		p := tt.pieces.priority(1)
+		tt.pieces.mu.Unlock()
+		if p == PriorityNow {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tt.pieces.mu.Lock()
+	priorities := []PiecePriority{tt.pieces.priority(0), tt.pieces.priority(1), tt.pieces.priority(2)}
+	tt.pieces.mu.Unlock()
+	if priorities[0] != PriorityNormal || priorities[1] != PriorityNow || priorities[2] != PriorityReadahead {
+		t.Errorf("priorities %v", priorities)
+	}
+	writePiece(t, tt, data, 1)
+	select {
+	case s := <-done:
+		if s != "o wo" {
+			t.Errorf("read %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read not done")
+	}
+
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		done <- err.Error()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	if s := <-done; s != errReaderClosed.Error() {
+		t.Errorf("read after close %s", s)
+	}
+	tt.pieces.mu.Lock()
+	defer tt.pieces.mu.Unlock()
+	if tt.pieces.priority(2) != PriorityNormal {
+		t.Errorf("priority after close %s", tt.pieces.priority(2))
+	}
+}
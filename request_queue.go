@@ -0,0 +1,156 @@
+package gobt
+
+import (
+	"sort"
+	"time"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+// blockRequest a block of a piece, as in request and cancel messages
+type blockRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+func (b blockRequest) message(id peerwire.ID) *peerwire.Message {
+	return &peerwire.Message{ID: id, Index: b.Index, Begin: b.Begin, Length: b.Length}
+}
+
+// pieceBlocks all blocks of a piece, the last one may be short
+func pieceBlocks(info *MetainfoInfo, index int) []blockRequest {
+	size := uint32(info.pieceSize(index))
+	blocks := make([]blockRequest, 0, (size+requestLength-1)/requestLength)
+	for begin := uint32(0); begin < size; begin += requestLength {
+		length := requestLength
+		if size-begin < length {
+			length = size - begin
+		}
+		blocks = append(blocks, blockRequest{uint32(index), begin, length})
+	}
+	return blocks
+}
+
+// requestQueue blocks we want from a peer, only used by the goroutine reading the peer
+type requestQueue struct {
+	pending     []blockRequest             // picked, not requested yet
+	outstanding map[blockRequest]time.Time // requested, and when
+	pieces      map[uint32]int             // picked pieces => blocks not received yet
+	endgame     map[blockRequest]bool      // blocks of pieces picked by other peers
+}
+
+func newRequestQueue() *requestQueue {
+	return &requestQueue{
+		outstanding: make(map[blockRequest]time.Time),
+		pieces:      make(map[uint32]int),
+		endgame:     make(map[blockRequest]bool),
+	}
+}
+
+// pick adds blocks of a piece to request
+func (q *requestQueue) pick(blocks []blockRequest) {
+	if len(blocks) == 0 {
+		return
+	}
+	q.pieces[blocks[0].Index] += len(blocks)
+	q.pending = append(q.pending, blocks...)
+}
+
+// addEndgame adds blocks other peers are downloading, done is never true for them
+func (q *requestQueue) addEndgame(blocks []blockRequest) {
+	for _, b := range blocks {
+		q.endgame[b] = true
+	}
+	q.pending = append(q.pending, blocks...)
+}
+
+func (q *requestQueue) picked(index uint32) bool {
+	return q.pieces[index] > 0
+}
+
+// next moves at most n pending blocks to outstanding and returns them
+func (q *requestQueue) next(n int, now time.Time) []blockRequest {
+	if n > len(q.pending) {
+		n = len(q.pending)
+	}
+	if n <= 0 {
+		return nil
+	}
+	blocks := make([]blockRequest, n)
+	copy(blocks, q.pending)
+	q.pending = q.pending[n:]
+	for _, b := range blocks {
+		q.outstanding[b] = now
+	}
+	return blocks
+}
+
+// received removes a block we got, ok is false if we did not ask for it or gave it up,
+// done is true if it is the last block of its piece
+func (q *requestQueue) received(b blockRequest) (ok bool, done bool) {
+	if _, ok = q.outstanding[b]; ok {
+		delete(q.outstanding, b)
+	} else {
+		// late, after time out
+		for i, p := range q.pending {
+			if p == b {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		return false, false
+	}
+	if q.endgame[b] {
+		delete(q.endgame, b)
+		return true, false
+	}
+	q.pieces[b.Index]--
+	if q.pieces[b.Index] > 0 {
+		return true, false
+	}
+	delete(q.pieces, b.Index)
+	return true, true
+}
+
+// expired returns the requests sent before deadline, they are requested again first
+func (q *requestQueue) expired(deadline time.Time) []blockRequest {
+	var blocks []blockRequest
+	for b, sent := range q.outstanding {
+		if sent.Before(deadline) {
+			blocks = append(blocks, b)
+		}
+	}
+	q.requeue(blocks)
+	return blocks
+}
+
+// clear gives up all blocks, e.g. the peer discards our requests when it chokes us.
+// It returns the pieces picked, to be released for other peers.
+func (q *requestQueue) clear() []uint32 {
+	pieces := make([]uint32, 0, len(q.pieces))
+	for index := range q.pieces {
+		pieces = append(pieces, index)
+	}
+	q.pending = nil
+	q.outstanding = make(map[blockRequest]time.Time)
+	q.pieces = make(map[uint32]int)
+	q.endgame = make(map[blockRequest]bool)
+	return pieces
+}
+
+func (q *requestQueue) requeue(blocks []blockRequest) {
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Index != blocks[j].Index {
+			return blocks[i].Index < blocks[j].Index
+		}
+		return blocks[i].Begin < blocks[j].Begin
+	})
+	for _, b := range blocks {
+		delete(q.outstanding, b)
+	}
+	q.pending = append(blocks, q.pending...)
+}
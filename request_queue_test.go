@@ -0,0 +1,59 @@
+package gobt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPieceBlocks(t *testing.T) {
+	info := testMetainfo("a", make([]byte, 3*requestLength+10), int(2*requestLength)).Info
+	blocks := pieceBlocks(info, 0)
+	if len(blocks) != 2 || blocks[1].Begin != requestLength || blocks[1].Length != requestLength {
+		t.Errorf("piece 0 blocks %v", blocks)
+	}
+	blocks = pieceBlocks(info, 1)
+	if len(blocks) != 2 || blocks[1].Length != 10 {
+		t.Errorf("last piece blocks %v", blocks)
+	}
+}
+
+func TestRequestQueue(t *testing.T) {
+	info := testMetainfo("a", make([]byte, 3*requestLength), int(3*requestLength)).Info
+	q := newRequestQueue()
+	q.pick(pieceBlocks(info, 0))
+	if !q.picked(0) {
+		t.Errorf("piece not picked")
+	}
+
+	now := time.Now()
+	sent := q.next(2, now)
+	if len(sent) != 2 || len(q.pending) != 1 || len(q.outstanding) != 2 {
+		t.Fatalf("next %v", sent)
+	}
+	if ok, _ := q.received(blockRequest{0, 1, 2}); ok {
+		t.Errorf("unrequested block accepted")
+	}
+	if ok, done := q.received(sent[0]); !ok || done {
+		t.Errorf("received %v %v", ok, done)
+	}
+
+	q.next(1, now.Add(time.Second))
+	expired := q.expired(now.Add(time.Millisecond))
+	if len(expired) != 1 || expired[0] != sent[1] || q.pending[0] != sent[1] {
+		t.Errorf("expired %v, pending %v", expired, q.pending)
+	}
+
+	// late blocks are still welcome
+	if ok, done := q.received(sent[1]); !ok || done {
+		t.Errorf("late block %v %v", ok, done)
+	}
+
+	q.next(1, now)
+	pieces := q.clear()
+	if len(pieces) != 1 || pieces[0] != 0 || len(q.outstanding) != 0 || len(q.pending) != 0 || q.picked(0) {
+		t.Errorf("after clear pieces %v, pending %v", pieces, q.pending)
+	}
+	if ok, _ := q.received(sent[1]); ok {
+		t.Errorf("block given up accepted")
+	}
+}
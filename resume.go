@@ -0,0 +1,465 @@
+package gobt
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const resumeVersion = 1
+
+// maxResumePeers peers saved in resume data, the latest connected
+const maxResumePeers = 50
+
+// ErrBadResume resume data of a torrent is not valid, all pieces are checked instead
+var ErrBadResume = errors.New("bad resume data")
+
+func badResume(key string) error {
+	return fmt.Errorf("%w: %s", ErrBadResume, key)
+}
+
+// resumeData state of a torrent saved in <name>.resume next to the download, to continue after restart
+type resumeData struct {
+	infoHash   hash
+	bitfield   []byte
+	partial    map[int][]bool // blocks on disk of pieces not verified yet
+	files      []resumeFile   // nil if data is not in files
+	priorities []PiecePriority
+	trackers   []string // nil for those of metainfo
+	peers      []string
+	root       string   // where data is, empty if not in files
+	paths      []string // of files relative to root, may be renamed
+	uploaded   int64
+	downloaded int64
+}
+
+// resumeFile a file when resume data is saved, to tell if it is changed after
+type resumeFile struct {
+	size  int64 // -1 if missing
+	mtime int64 // unix seconds
+}
+
+func (info *MetainfoInfo) resumeFilename(root string) string {
+	return info.filename(root) + ".resume"
+}
+
+func (r *resumeData) encode() ([]byte, error) {
+	indexes := make([]int, 0, len(r.partial))
+	for index := range r.partial {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	partial := make([]interface{}, len(indexes))
+	for j, index := range indexes {
+		done := r.partial[index]
+		bf := allZeroBitField(len(done))
+		for i, d := range done {
+			if d {
+				bf.SetBit(i, 1)
+			}
+		}
+		partial[j] = map[string]interface{}{"piece": index, "blocks": bf.bitData}
+	}
+	files := make([]interface{}, len(r.files))
+	for i, f := range r.files {
+		files[i] = map[string]interface{}{"size": f.size, "mtime": f.mtime}
+	}
+	priorities := make([]interface{}, len(r.priorities))
+	for i, p := range r.priorities {
+		priorities[i] = int(p)
+	}
+	m := map[string]interface{}{
+		"version":    resumeVersion,
+		"info-hash":  r.infoHash[:],
+		"pieces":     r.bitfield,
+		"partial":    partial,
+		"files":      files,
+		"priorities": priorities,
+		"peers":      r.peers,
+		"uploaded":   r.uploaded,
+		"downloaded": r.downloaded,
+	}
+	if r.trackers != nil {
+		m["trackers"] = r.trackers
+	}
+	if r.root != "" {
+		m["root"] = r.root
+		m["paths"] = r.paths
+	}
+	return Encode(m)
+}
+
+// parseResumeData checks resume data is of the torrent
+func parseResumeData(b []byte, mi *Metainfo) (*resumeData, error) {
+	v, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadResume, err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, badResume("not a dictionary")
+	}
+	if version, _ := m["version"].(int64); version != resumeVersion {
+		return nil, badResume("version")
+	}
+	info := mi.Info
+	r := &resumeData{partial: make(map[int][]bool)}
+	ih, _ := m["info-hash"].([]byte)
+	if len(ih) != hashSize || string(ih) != string(mi.InfoHash[:]) {
+		return nil, badResume("info hash")
+	}
+	copy(r.infoHash[:], ih)
+	r.bitfield, _ = m["pieces"].([]byte)
+	if len(r.bitfield) != allZeroBitField(info.piecesCount()).Len() {
+		return nil, badResume("pieces")
+	}
+	partial, _ := m["partial"].([]interface{})
+	for _, p := range partial {
+		pm, _ := p.(map[string]interface{})
+		index, ok := pm["piece"].(int64)
+		blocks, _ := pm["blocks"].([]byte)
+		if !ok || index < 0 || index >= int64(info.piecesCount()) {
+			return nil, badResume("partial piece")
+		}
+		n := len(pieceBlocks(info, int(index)))
+		if len(blocks) != allZeroBitField(n).Len() {
+			return nil, badResume("partial blocks")
+		}
+		bf := allZeroBitFieldByte(len(blocks))
+		bf.SetBitData(blocks)
+		done := make([]bool, n)
+		for i := range done {
+			done[i] = bf.Bit(i) == 1
+		}
+		r.partial[int(index)] = done
+	}
+	count := len(fileRanges(info))
+	files, _ := m["files"].([]interface{})
+	if len(files) != 0 && len(files) != count {
+		return nil, badResume("files")
+	}
+	for _, f := range files {
+		fm, _ := f.(map[string]interface{})
+		size, ok1 := fm["size"].(int64)
+		mtime, ok2 := fm["mtime"].(int64)
+		if !ok1 || !ok2 {
+			return nil, badResume("file")
+		}
+		r.files = append(r.files, resumeFile{size, mtime})
+	}
+	priorities, _ := m["priorities"].([]interface{})
+	if len(priorities) != 0 && len(priorities) != count {
+		return nil, badResume("priorities")
+	}
+	for _, p := range priorities {
+		priority, _ := p.(int64)
+		if checkPriority(PiecePriority(priority)) != nil {
+			return nil, badResume("priority")
+		}
+		r.priorities = append(r.priorities, PiecePriority(priority))
+	}
+	if trackers, ok := m["trackers"].([]interface{}); ok {
+		r.trackers = make([]string, 0, len(trackers))
+		for _, u := range trackers {
+			if _, ok := u.([]byte); !ok {
+				return nil, badResume("tracker")
+			}
+			r.trackers = append(r.trackers, string(u.([]byte)))
+		}
+	}
+	peers, _ := m["peers"].([]interface{})
+	for _, p := range peers {
+		if _, ok := p.([]byte); !ok {
+			return nil, badResume("peer")
+		}
+		r.peers = append(r.peers, string(p.([]byte)))
+	}
+	r.uploaded, _ = m["uploaded"].(int64)
+	r.downloaded, _ = m["downloaded"].(int64)
+	if root, ok := m["root"].([]byte); ok {
+		r.root = string(root)
+		paths, _ := m["paths"].([]interface{})
+		if len(paths) != count {
+			return nil, badResume("paths")
+		}
+		for _, p := range paths {
+			b, _ := p.([]byte)
+			path, ok := cleanRelative(string(b))
+			if !ok {
+				// e.g. moved out of the directory of data
+				return nil, badResume("path")
+			}
+			r.paths = append(r.paths, path)
+		}
+	}
+	return r, nil
+}
+
+// readResumeData reads resume data of a torrent, the error is os.IsNotExist if there is none
+func readResumeData(filename string, mi *Metainfo) (*resumeData, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseResumeData(b, mi)
+}
+
+// writeResumeData writes a temporary file renamed to filename, so a crash leaves the old or the new one
+func writeResumeData(filename string, r *resumeData) error {
+	b, err := r.encode()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return diskFull(err)
+	}
+	return nil
+}
+
+// statFiles sizes and modification times of files under root
+func statFiles(root string, ranges []fileRange) []resumeFile {
+	files := make([]resumeFile, len(ranges))
+	for i, r := range ranges {
+		files[i].size = -1
+		if st, err := os.Stat(filepath.Join(root, r.path)); err == nil {
+			files[i] = resumeFile{st.Size(), st.ModTime().Unix()}
+		}
+	}
+	return files
+}
+
+// check tells why resume data can not be trusted, empty if it can.
+// A file with pieces we have or blocks written must not be changed after saved.
+func (r *resumeData) check(info *MetainfoInfo, root string, files []fileRange) string {
+	bf := &bitfield{new(sync.RWMutex), r.bitfield}
+	now := statFiles(root, files)
+	for i, fr := range files {
+		first, last := fr.pieces(info)
+		hasData := false
+		for p := first; p <= last; p++ {
+			if bf.Bit(p) == 1 || r.partial[p] != nil {
+				hasData = true
+				break
+			}
+		}
+		if !hasData {
+			continue
+		}
+		// a file skipped is missing, the blocks of it are in the part file
+		switch {
+		case r.files == nil:
+			return "no files in resume data"
+		case now[i].size == -1 && r.files[i].size != -1:
+			return fmt.Sprintf("%s is missing", fr.path)
+		case now[i].size != r.files[i].size:
+			return fmt.Sprintf("%s is %d bytes, was %d", fr.path, now[i].size, r.files[i].size)
+		case now[i].mtime != r.files[i].mtime:
+			return fmt.Sprintf("%s changed after resume data saved", fr.path)
+		}
+	}
+	return ""
+}
+
+// hasData tells if any file under root is not empty
+func hasData(root string, files []fileRange) bool {
+	for _, f := range statFiles(root, files) {
+		if f.size > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dataFiles where files of the torrent are, false if data is not in files
+func (t *Torrent) dataFiles() (string, []fileRange, bool) {
+	switch s := t.storage.(type) {
+	case storageMover:
+		root, files := s.layout()
+		return root, files, true
+	case *mmapStorage:
+		return s.root, fileRanges(t.Metainfo.Info), true
+	}
+	return "", nil, false
+}
+
+// loadResume restores the torrent from its resume data before it runs.
+// It tells why the data on disk should be checked, empty if it need not.
+// Priorities saved are used unless priorities are given when added.
+func (t *Torrent) loadResume(priorities bool) string {
+	info := t.Metainfo.Info
+	r, err := readResumeData(info.resumeFilename(t.root), t.Metainfo)
+	if m, ok := t.storage.(storageMover); ok && err == nil && r.root != "" {
+		m.relocate(r.root, r.paths)
+		t.setFilePaths(r.paths)
+	}
+	root, files, inFiles := t.dataFiles()
+	if os.IsNotExist(err) {
+		if inFiles && hasData(root, files) {
+			return "no resume data"
+		}
+		return ""
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if r.trackers != nil {
+		t.trackers = newTrackerList(r.trackers)
+	}
+	t.seenPeers = r.peers
+	t.previous = TransferStats{Uploaded: r.uploaded, Downloaded: r.downloaded}
+	if priorities && r.priorities != nil {
+		copy(t.filePriorities, r.priorities)
+		t.updatePiecePriorities(0, info.piecesCount()-1)
+	}
+	reason := ""
+	if inFiles {
+		reason = r.check(info, root, files)
+	}
+	if reason != "" {
+		// pieces are not trusted until verified
+		return reason
+	}
+	t.bitfield.SetBitData(r.bitfield)
+	for index, done := range r.partial {
+		if t.bitfield.Bit(index) == 0 && t.blocks.restore(index, done) {
+			t.pieces.setPartial(index, true)
+		}
+	}
+	return ""
+}
+
+// resumeData the state of the torrent to save
+func (t *Torrent) resumeData() *resumeData {
+	t.filesMutex.Lock()
+	priorities := append([]PiecePriority(nil), t.filePriorities...)
+	t.filesMutex.Unlock()
+	t.seenMutex.Lock()
+	peers := append([]string(nil), t.seenPeers...)
+	t.seenMutex.Unlock()
+	stats := t.TotalStats()
+	r := &resumeData{
+		infoHash:   t.Metainfo.InfoHash,
+		bitfield:   t.bitfield.copyData(),
+		partial:    t.blocks.partial(),
+		priorities: priorities,
+		trackers:   t.Trackers(),
+		peers:      peers,
+		uploaded:   stats.Uploaded,
+		downloaded: stats.Downloaded,
+	}
+	if root, files, ok := t.dataFiles(); ok {
+		r.files = statFiles(root, files)
+		r.root = root
+		for _, f := range files {
+			r.paths = append(r.paths, f.path)
+		}
+	}
+	return r
+}
+
+// saveResume writes resume data now
+func (t *Torrent) saveResume() error {
+	t.saveMutex.Lock()
+	defer t.saveMutex.Unlock()
+	return writeResumeData(t.Metainfo.Info.resumeFilename(t.root), t.resumeData())
+}
+
+// saveResumeLater saves resume data after config.ResumeDelay, changes until then are saved together
+func (t *Torrent) saveResumeLater() {
+	t.resumeMutex.Lock()
+	defer t.resumeMutex.Unlock()
+	if t.resumeClosed || t.resumeTimer != nil {
+		return
+	}
+	t.resumeTimer = time.AfterFunc(t.client.config.ResumeDelay, func() {
+		t.resumeMutex.Lock()
+		t.resumeTimer = nil
+		t.resumeMutex.Unlock()
+		t.saveMutex.Lock()
+		defer t.saveMutex.Unlock()
+		// not after closeResume
+		if t.resumeClosed {
+			return
+		}
+		err := writeResumeData(t.Metainfo.Info.resumeFilename(t.root), t.resumeData())
+		if err != nil {
+			t.diskError(err)
+		}
+	})
+}
+
+// closeResume saves resume data for the last time when the torrent stops
+func (t *Torrent) closeResume() error {
+	t.saveMutex.Lock()
+	defer t.saveMutex.Unlock()
+	t.resumeMutex.Lock()
+	t.resumeClosed = true
+	if t.resumeTimer != nil {
+		t.resumeTimer.Stop()
+		t.resumeTimer = nil
+	}
+	t.resumeMutex.Unlock()
+	return writeResumeData(t.Metainfo.Info.resumeFilename(t.root), t.resumeData())
+}
+
+// seePeer remembers a peer connected to, saved in resume data
+func (t *Torrent) seePeer(addr net.Addr) {
+	t.seenMutex.Lock()
+	defer t.seenMutex.Unlock()
+	s := addr.String()
+	for i, p := range t.seenPeers {
+		if p == s {
+			t.seenPeers = append(t.seenPeers[:i], t.seenPeers[i+1:]...)
+			break
+		}
+	}
+	t.seenPeers = append(t.seenPeers, s)
+	if len(t.seenPeers) > maxResumePeers {
+		t.seenPeers = t.seenPeers[len(t.seenPeers)-maxResumePeers:]
+	}
+}
+
+// startSeenPeers connects to the peers saved in resume data
+func (t *Torrent) startSeenPeers() {
+	t.seenMutex.Lock()
+	peers := append([]string(nil), t.seenPeers...)
+	t.seenMutex.Unlock()
+	for _, s := range peers {
+		addr, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			continue
+		}
+		t.addPeer(newPeer(t, addr))
+	}
+}
+
+// TotalStats payload bytes moved by the torrent since added, including earlier runs of the program.
+// Stats are of this run only, which are sent to trackers.
+func (t *Torrent) TotalStats() TransferStats {
+	return TransferStats{
+		Uploaded:   t.previous.Uploaded + atomic.LoadInt64(&t.transfer.uploaded),
+		Downloaded: t.previous.Downloaded + atomic.LoadInt64(&t.transfer.downloaded),
+	}
+}
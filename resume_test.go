@@ -0,0 +1,143 @@
+package gobt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeDataEncode(t *testing.T) {
+	mi := testMetainfo("a", bytes.Repeat([]byte("x"), 40000), 32768)
+	r := &resumeData{
+		infoHash:   mi.InfoHash,
+		bitfield:   []byte{0x40},
+		partial:    map[int][]bool{0: {true, false}},
+		files:      []resumeFile{{40000, 1234}},
+		priorities: []PiecePriority{PriorityHigh},
+		trackers:   []string{},
+		peers:      []string{"127.0.0.1:6881"},
+		uploaded:   5,
+		downloaded: 6,
+	}
+	b, err := r.encode()
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	r2, err := parseResumeData(b, mi)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if r2.bitfield[0] != 0x40 || !r2.partial[0][0] || r2.partial[0][1] || r2.files[0] != r.files[0] ||
+		r2.priorities[0] != PriorityHigh || r2.trackers == nil || len(r2.trackers) != 0 ||
+		r2.peers[0] != "127.0.0.1:6881" || r2.uploaded != 5 || r2.downloaded != 6 {
+		t.Errorf("parsed %+v", r2)
+	}
+
+	other := testMetainfo("b", []byte("hello"), 4)
+	if _, err := parseResumeData(b, other); !errors.Is(err, ErrBadResume) {
+		t.Errorf("resume data of another torrent: %v", err)
+	}
+	if _, err := parseResumeData(b[:len(b)-1], mi); !errors.Is(err, ErrBadResume) {
+		t.Errorf("truncated resume data: %v", err)
+	}
+
+	// paths of files moved stay in the directory of data
+	for path, ok := range map[string]bool{"b": true, filepath.Join("d", "..", "b"): true, filepath.Join("..", "b"): false, "": false, filepath.Join(os.TempDir(), "b"): false} {
+		r.root, r.paths = "/data", []string{path}
+		b, _ := r.encode()
+		r2, err := parseResumeData(b, mi)
+		if ok && (err != nil || r2.paths[0] != "b") {
+			t.Errorf("path %q: %v", path, err)
+		}
+		if !ok && !errors.Is(err, ErrBadResume) {
+			t.Errorf("path %q accepted", path)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world "), 4000)
+	mi := testMetainfo("a", data, 32768)
+	config := DefaultClientConfig()
+	config.ResumeDelay = 10 * time.Millisecond
+	c, tt := testTorrent(t, config, mi)
+	tt.Pause()
+	root := tt.root
+	filename := mi.Info.resumeFilename(root)
+
+	// saved a while after the piece is verified
+	writePiece(t, tt, data, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r, err := readResumeData(filename, mi)
+		if err == nil && r.bitfield[0] == 0x40 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("resume data not saved: %v %v", r, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// first block of piece 0
+	b := blockRequest{0, 0, requestLength}
+	tt.storage.WriteAt(0, data[:requestLength], 0)
+	tt.blocks.written(b)
+	tt.SetFilePriority(0, PriorityHigh)
+	tt.AddTracker("udp://127.0.0.1:1")
+	tt.seePeer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	tt.transfer.uploaded = 100
+	c.Close()
+
+	config.DownloadRoot = root
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	tt, err = c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	tt.Pause()
+	if tt.bitfield.Bit(0) != 0 || tt.bitfield.Bit(1) != 1 {
+		t.Errorf("bitfield %x", tt.bitfield.copyData())
+	}
+	if missing := tt.blocks.missing(pieceBlocks(mi.Info, 0)); len(missing) != 1 || missing[0].Begin != requestLength {
+		t.Errorf("missing blocks %v", missing)
+	}
+	if tt.FilePriority(0) != PriorityHigh || tt.PiecePriority(0) != PriorityHigh {
+		t.Errorf("priority %s", tt.FilePriority(0))
+	}
+	if trackers := tt.Trackers(); len(trackers) != 1 || trackers[0] != "udp://127.0.0.1:1" {
+		t.Errorf("trackers %v", trackers)
+	}
+	if len(tt.seenPeers) != 1 || tt.seenPeers[0] != "127.0.0.1:1" {
+		t.Errorf("peers %v", tt.seenPeers)
+	}
+	if stats := tt.TotalStats(); stats.Uploaded != 100 {
+		t.Errorf("total stats %+v", stats)
+	}
+	c.Close()
+
+	// bad resume data is checked against data on disk
+	ioutil.WriteFile(filename, []byte("d7:version"), 0664)
+	c, err = NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	tt, err = c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	// waits for verify
+	tt.Pause()
+	if tt.bitfield.Bit(0) != 0 || tt.bitfield.Bit(1) != 1 {
+		t.Errorf("bitfield after verify %x", tt.bitfield.copyData())
+	}
+}
@@ -0,0 +1,468 @@
+package gobt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage holds the data of a torrent, blocks are read and written by piece.
+// It is used by many goroutines at once.
+type Storage interface {
+	// ReadAt reads len(b) bytes at off in piece index, bytes not written yet are zero
+	ReadAt(index int, b []byte, off int64) (int, error)
+	// WriteAt writes b at off in piece index
+	WriteAt(index int, b []byte, off int64) (int, error)
+	// MarkComplete is called when the hash of a piece is verified
+	MarkComplete(index int) error
+	// Close is called when the torrent is stopped
+	Close() error
+}
+
+// StorageFunc opens the storage of a torrent, root is the download root directory
+type StorageFunc func(info *MetainfoInfo, root string) (Storage, error)
+
+// storageFlusher a storage which releases resources when the torrent is paused, e.g. open files
+type storageFlusher interface {
+	Flush() error
+}
+
+// pieceOffset the offset in data of the torrent of off in piece index, n bytes from it must be in the piece
+func pieceOffset(info *MetainfoInfo, index int, off int64, n int) (int64, error) {
+	if index < 0 || index >= info.piecesCount() || off < 0 || off+int64(n) > int64(info.pieceSize(index)) {
+		return 0, fmt.Errorf("%d bytes at %d out of piece %d", n, off, index)
+	}
+	return int64(index)*int64(info.PieceLength) + off, nil
+}
+
+// readPiece reads a whole piece
+func readPiece(s Storage, info *MetainfoInfo, index int) ([]byte, error) {
+	b := make([]byte, info.pieceSize(index))
+	_, err := s.ReadAt(index, b, 0)
+	return b, err
+}
+
+func checkHash(s Storage, info *MetainfoInfo, index int, ih hash) (bool, error) {
+	if h, ok := s.(pieceHasher); ok {
+		sum, err := h.hashPiece(index)
+		return sum == ih, err
+	}
+	b, err := readPiece(s, info, index)
+	if err != nil {
+		return false, err
+	}
+	sum := sha1.Sum(b)
+	return bytes.Equal(sum[:], ih[:]), nil
+}
+
+// fileStorage files under download root, as other clients do.
+// Files skipped before created are not created, their data in pieces shared with other files is in the part file.
+type fileStorage struct {
+	info  *MetainfoInfo
+	cache *fileCache // may be shared with other torrents
+
+	mu         sync.RWMutex // write locked to move data out of the part file, or to move files
+	root       string
+	files      []fileRange // paths may be renamed
+	allocation Allocation
+	inPart     []bool        // files skipped and not created
+	slots      map[int]int64 // pieces shared by files to their offsets in the part file
+}
+
+// partStorage a storage which can leave files out
+type partStorage interface {
+	skipFile(index int, skip bool) error
+}
+
+// storageMover a storage of files which can be moved while in use, paths are relative to root
+type storageMover interface {
+	layout() (root string, files []fileRange)
+	move(root string, paths []string) error
+	relocate(root string, paths []string) // files are there already, before the storage is used
+}
+
+// NewFileStorage the default storage, it creates the files of the torrent under root
+func NewFileStorage(info *MetainfoInfo, root string) (Storage, error) {
+	err := ensureFile(context.Background(), root, info, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newFileStorage(info, root, newFileCache(defaultMaxOpenFiles)), nil
+}
+
+func newFileStorage(info *MetainfoInfo, root string, cache *fileCache) *fileStorage {
+	files := fileRanges(info)
+	return &fileStorage{
+		info:       info,
+		root:       root,
+		files:      files,
+		cache:      cache,
+		allocation: AllocateCompact,
+		inPart:     make([]bool, len(files)),
+		slots:      partSlots(info, files),
+	}
+}
+
+// partSlots every piece shared by files has a slot of a piece length in the part file
+func partSlots(info *MetainfoInfo, files []fileRange) map[int]int64 {
+	slots := make(map[int]int64)
+	prev := -1 // last piece of the previous file not empty
+	for _, r := range files {
+		if r.length == 0 {
+			continue
+		}
+		first, last := r.pieces(info)
+		if first == prev {
+			if _, ok := slots[first]; !ok {
+				slots[first] = int64(len(slots)) * int64(info.PieceLength)
+			}
+		}
+		prev = last
+	}
+	return slots
+}
+
+// newFileStorage files of torrents of the client share open files, they are created when allocated
+func (c *Client) newFileStorage(info *MetainfoInfo, root string) (Storage, error) {
+	return newFileStorage(info, root, c.files), nil
+}
+
+// defaultStorage the storage in config
+func (c *Client) defaultStorage() (StorageFunc, error) {
+	switch c.config.Storage {
+	case "", "file":
+		return c.newFileStorage, nil
+	case "mmap":
+		return NewMmapStorage, nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", c.config.Storage)
+}
+
+func (s *fileStorage) partFilename() string {
+	return s.info.filename(s.root) + ".parts"
+}
+
+// span calls fn for every part of b in a file, pos is the offset of b in data of the torrent
+func (s *fileStorage) span(pos int64, b []byte, fn func(i int, b []byte, off int64) error) error {
+	for i, r := range s.files {
+		if len(b) == 0 {
+			break
+		}
+		if pos >= r.offset+r.length {
+			continue
+		}
+		off := pos - r.offset
+		n := r.length - off
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		err := fn(i, b[:n], off)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+		pos += n
+	}
+	return nil
+}
+
+// locate where off in file i of piece index is, on disk it may not exist if the file is skipped.
+// Must hold mu.
+func (s *fileStorage) locate(index int, i int, off int64) (filename string, fileOff int64, skipped bool) {
+	if !s.inPart[i] {
+		return filepath.Join(s.root, s.files[i].path), off, false
+	}
+	if slot, ok := s.slots[index]; ok {
+		return s.partFilename(), slot + s.files[i].offset + off - int64(index)*int64(s.info.PieceLength), true
+	}
+	return filepath.Join(s.root, s.files[i].path), off, true
+}
+
+func (s *fileStorage) ReadAt(index int, b []byte, off int64) (int, error) {
+	pos, err := pieceOffset(s.info, index, off, len(b))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	err = s.span(pos, b, func(i int, b []byte, off int64) error {
+		filename, off, skipped := s.locate(index, i, off)
+		cf, err := s.cache.open(filename, false)
+		if os.IsNotExist(err) && skipped {
+			zero(b)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer s.cache.release(cf)
+		n, err := cf.f.ReadAt(b, off)
+		if err == io.EOF {
+			// not written yet
+			zero(b[n:])
+			err = nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func (s *fileStorage) WriteAt(index int, b []byte, off int64) (int, error) {
+	pos, err := pieceOffset(s.info, index, off, len(b))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	err = s.span(pos, b, func(i int, b []byte, off int64) error {
+		filename, off, _ := s.locate(index, i, off)
+		cf, err := s.cache.open(filename, true)
+		if err != nil {
+			return err
+		}
+		defer s.cache.release(cf)
+		_, err = cf.f.WriteAt(b, off)
+		return err
+	})
+	if err != nil {
+		return 0, diskFull(err)
+	}
+	return len(b), nil
+}
+
+// MarkComplete does nothing, the bitfield is saved by the torrent
+func (s *fileStorage) MarkComplete(index int) error {
+	return nil
+}
+
+// allocate creates and allocates files, but not those skipped and not created yet
+func (s *fileStorage) allocate(mode Allocation, skip []bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allocation = mode
+	for i, r := range s.files {
+		if skip != nil && skip[i] {
+			_, err := os.Stat(filepath.Join(s.root, r.path))
+			s.inPart[i] = os.IsNotExist(err)
+		}
+	}
+	err := ensureFileRanges(s.root, s.files, s.inPart)
+	if err != nil {
+		return err
+	}
+	return allocateFiles(s.root, s.files, mode, s.inPart)
+}
+
+// skipFile a file not created yet is left out if skip, or created and its data is moved out of the part file.
+// A file created keeps its data when skipped.
+func (s *fileStorage) skipFile(i int, skip bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.files[i]
+	filename := filepath.Join(s.root, r.path)
+	if skip {
+		_, err := os.Stat(filename)
+		s.inPart[i] = os.IsNotExist(err)
+		return nil
+	}
+	if !s.inPart[i] {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(filename), 0775)
+	if err != nil {
+		return err
+	}
+	cf, err := s.cache.open(filename, true)
+	if err != nil {
+		return err
+	}
+	defer s.cache.release(cf)
+	err = s.movePart(cf.f, r)
+	if err != nil {
+		return err
+	}
+	s.inPart[i] = false
+	if s.allocation == AllocateCompact {
+		return nil
+	}
+	return diskFull(allocateFile(filename, r.length, s.allocation))
+}
+
+// movePart copies data of file r in the part file to f, must hold mu
+func (s *fileStorage) movePart(f *os.File, r fileRange) error {
+	first, last := r.pieces(s.info)
+	for _, index := range []int{first, last} {
+		slot, ok := s.slots[index]
+		if !ok {
+			continue
+		}
+		start := int64(index) * int64(s.info.PieceLength)
+		begin, end := start, start+int64(s.info.pieceSize(index))
+		if begin < r.offset {
+			begin = r.offset
+		}
+		if end > r.offset+r.length {
+			end = r.offset + r.length
+		}
+		b := make([]byte, end-begin)
+		cf, err := s.cache.open(s.partFilename(), false)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n, err := cf.f.ReadAt(b, slot+begin-start)
+		s.cache.release(cf)
+		if err == io.EOF {
+			b = b[:n]
+		} else if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(b, begin-r.offset); err != nil {
+			return diskFull(err)
+		}
+		if first == last {
+			break
+		}
+	}
+	return nil
+}
+
+// layout where files are
+func (s *fileStorage) layout() (string, []fileRange) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.root, append([]fileRange(nil), s.files...)
+}
+
+func (s *fileStorage) relocate(root string, paths []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root = root
+	for i := range s.files {
+		s.files[i].path = paths[i]
+	}
+}
+
+// move moves files and the part file to root, reads and writes wait until done.
+// Files not created are only renamed. If one fails, those moved are moved back.
+func (s *fileStorage) move(root string, paths []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	from := make([]string, len(s.files)+1)
+	to := make([]string, len(s.files)+1)
+	for i, r := range s.files {
+		from[i], to[i] = filepath.Join(s.root, r.path), filepath.Join(root, paths[i])
+	}
+	from[len(s.files)], to[len(s.files)] = s.partFilename(), s.info.filename(root)+".parts"
+	for i := range from {
+		if err := moveFile(from[i], to[i]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				moveFile(to[j], from[j])
+			}
+			return err
+		}
+	}
+	for i := range from {
+		removeEmptyDirs(s.root, filepath.Dir(from[i]))
+	}
+	s.root = root
+	for i := range s.files {
+		s.files[i].path = paths[i]
+	}
+	return nil
+}
+
+// Flush closes open files of the torrent
+func (s *fileStorage) Flush() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.flush()
+}
+
+// flush must hold mu
+func (s *fileStorage) flush() error {
+	names := make([]string, len(s.files), len(s.files)+1)
+	for i, r := range s.files {
+		names[i] = filepath.Join(s.root, r.path)
+	}
+	return s.cache.close(append(names, s.partFilename()))
+}
+
+func (s *fileStorage) Close() error {
+	return s.Flush()
+}
+
+// memoryStorage keeps pieces in memory, e.g. for tests
+type memoryStorage struct {
+	mu       sync.RWMutex
+	info     *MetainfoInfo
+	pieces   map[int][]byte
+	complete map[int]bool
+}
+
+// NewMemoryStorage a storage in memory, root is not used
+func NewMemoryStorage(info *MetainfoInfo, root string) (Storage, error) {
+	return &memoryStorage{
+		info:     info,
+		pieces:   make(map[int][]byte),
+		complete: make(map[int]bool),
+	}, nil
+}
+
+func (s *memoryStorage) ReadAt(index int, b []byte, off int64) (int, error) {
+	if _, err := pieceOffset(s.info, index, off, len(b)); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p := s.pieces[index]
+	if p == nil {
+		zero(b)
+		return len(b), nil
+	}
+	return copy(b, p[off:]), nil
+}
+
+func (s *memoryStorage) WriteAt(index int, b []byte, off int64) (int, error) {
+	if _, err := pieceOffset(s.info, index, off, len(b)); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.pieces[index]
+	if p == nil {
+		p = make([]byte, s.info.pieceSize(index))
+		s.pieces[index] = p
+	}
+	return copy(p[off:], b), nil
+}
+
+func (s *memoryStorage) MarkComplete(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.complete[index] = true
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
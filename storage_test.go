@@ -0,0 +1,96 @@
+package gobt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/picasso250/gobt/peerwire"
+)
+
+func TestFileStorage(t *testing.T) {
+	data := []byte("hello world")
+	info, err := NewMetainfoInfoFromMap(map[string]interface{}{
+		"name":         []byte("m"),
+		"piece length": int64(4),
+		"pieces":       []byte(testMetainfo("a", data, 4).Info.Pieces),
+		"files": []interface{}{
+			map[string]interface{}{"length": int64(3), "path": []interface{}{[]byte("x")}},
+			map[string]interface{}{"length": int64(0), "path": []interface{}{[]byte("empty")}},
+			map[string]interface{}{"length": int64(8), "path": []interface{}{[]byte("d"), []byte("y")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileStorage(info, t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage error: %v", err)
+	}
+	defer s.Close()
+
+	// not written yet
+	b := make([]byte, 4)
+	if n, err := s.ReadAt(0, b, 0); n != 4 || err != nil || !bytes.Equal(b, make([]byte, 4)) {
+		t.Errorf("read %d %v %q", n, err, b)
+	}
+	for i := 0; i < info.piecesCount(); i++ {
+		begin := i * 4
+		end := begin + info.pieceSize(i)
+		if _, err := s.WriteAt(i, data[begin:end], 0); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	// across files
+	if _, err := s.ReadAt(0, b[:3], 1); err != nil || string(b[:3]) != "ell" {
+		t.Errorf("read %q %v", b[:3], err)
+	}
+	for i := 0; i < info.piecesCount(); i++ {
+		var h hash
+		copy(h[:], info.Pieces[i*hashSize:])
+		if ok, err := checkHash(s, info, i, h); !ok || err != nil {
+			t.Errorf("piece %d %v %v", i, ok, err)
+		}
+	}
+	if _, err := s.ReadAt(2, b, 0); err == nil {
+		t.Errorf("read out of the short last piece")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	data := []byte("hello")
+	mi := testMetainfo("a", data, len(data))
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	c.SetStorage(NewMemoryStorage)
+	tt, err := c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	conn := connectPeer(t, tt)
+	defer conn.Close()
+	writeMessages(t, conn,
+		&peerwire.Message{ID: peerwire.Bitfield, Bitfield: []byte{0x80}},
+		&peerwire.Message{ID: peerwire.Unchoke},
+	)
+	nextMessage(t, conn, peerwire.Request)
+	writeMessages(t, conn, &peerwire.Message{ID: peerwire.Piece, Block: data})
+
+	s := tt.storage.(*memoryStorage)
+	for i := 0; tt.bitfield.Bit(0) == 0; i++ {
+		if i > 100 {
+			t.Fatalf("piece not verified")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.complete[0] || string(s.pieces[0]) != "hello" {
+		t.Errorf("storage %v %q", s.complete, s.pieces[0])
+	}
+}
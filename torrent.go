@@ -0,0 +1,312 @@
+package gobt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// torrent states
+const (
+	torrentPaused = iota
+	torrentRunning
+	torrentStopped
+)
+
+var errTorrentStopped = errors.New("torrent stopped")
+
+// Torrent a torrent added to a client
+type Torrent struct {
+	Metainfo *Metainfo
+
+	client     *Client
+	root       string // download root directory
+	storage    Storage
+	bitfield   *bitfield
+	allocation Allocation // of files in storage
+
+	files          []*TorrentFile
+	filesMutex     sync.Mutex // serializes priority changes of files
+	filePriorities []PiecePriority
+	trackers       *trackerList
+	pieces         *pieceTracker
+	blocks         *blockMap
+	limiters       rateLimiters
+	transfer       transferCounter
+	previous       TransferStats // payload of earlier runs, from resume data
+
+	stateMutex sync.Mutex // serializes Pause, Resume and Stop
+	state      int
+	stopped    chan struct{}      // closed by Stop
+	ctx        context.Context    // done when stopped, before stateMutex is locked by Stop
+	cancel     context.CancelFunc // cancels ctx
+	hashMutex  sync.RWMutex       // read locked by hash jobs, which are done once ctx is done and it is locked
+
+	waitMutex sync.Mutex    // guards pieceWait
+	pieceWait chan struct{} // closed when a piece is verified
+
+	peersMutex   sync.RWMutex
+	peers        map[string]*peer
+	peersToStart chan net.Addr
+	run          *torrentRun // nil if not running
+
+	seenMutex sync.Mutex
+	seenPeers []string // connected to lately, saved in resume data
+
+	resumeMutex  sync.Mutex  // guards resumeTimer and resumeClosed
+	resumeTimer  *time.Timer // to save resume data, nil if not changed
+	resumeClosed bool        // saved for the last time
+	saveMutex    sync.Mutex  // serializes writes of resume data
+}
+
+// torrentRun goroutines of a torrent between Resume and Pause
+type torrentRun struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newTorrent opts are checked already
+func newTorrent(c *Client, mi *Metainfo, storage StorageFunc, opts TorrentOptions) (*Torrent, error) {
+	root := c.config.DownloadRoot
+	s, err := storage(mi.Info, root)
+	if err != nil {
+		return nil, err
+	}
+	t := &Torrent{
+		Metainfo:     mi,
+		client:       c,
+		root:         root,
+		storage:      s,
+		allocation:   opts.Allocation,
+		bitfield:     allZeroBitField(mi.Info.piecesCount()),
+		trackers:     newTrackerList(getAllAnnounce(mi)),
+		pieces:       newPieceTracker(mi.Info.piecesCount()),
+		blocks:       newBlockMap(mi.Info),
+		limiters:     newRateLimiters(0, 0),
+		state:        torrentPaused,
+		peers:        make(map[string]*peer),
+		peersToStart: make(chan net.Addr, 10),
+		stopped:      make(chan struct{}),
+		pieceWait:    make(chan struct{}),
+	}
+	t.ctx, t.cancel = context.WithCancel(c.ctx)
+	t.initFiles(opts.FilePriorities)
+	return t, nil
+}
+
+// InfoHash info hash of the torrent
+func (t *Torrent) InfoHash() [hashSize]byte {
+	return t.Metainfo.InfoHash
+}
+
+// Resume starts announcing to trackers and connecting to peers
+func (t *Torrent) Resume() error {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	switch t.state {
+	case torrentRunning:
+		return nil
+	case torrentStopped:
+		return errTorrentStopped
+	}
+	t.resume()
+	return nil
+}
+
+// resume must hold stateMutex, the torrent is paused
+func (t *Torrent) resume() {
+	ctx, cancel := context.WithCancel(t.ctx)
+	r := &torrentRun{ctx: ctx, cancel: cancel}
+	t.peersMutex.Lock()
+	t.run = r
+	t.peersMutex.Unlock()
+
+	r.wg.Add(3)
+	go func() {
+		defer r.wg.Done()
+		runTrackers(ctx, t)
+	}()
+	go func() {
+		defer r.wg.Done()
+		t.runChoker(ctx)
+	}()
+	go func() {
+		defer r.wg.Done()
+		t.startPeers(ctx)
+	}()
+	t.state = torrentRunning
+}
+
+// Pause sends stopped to trackers, closes peer connections and saves resume data.
+// It returns when all of them are done, Resume to continue.
+func (t *Torrent) Pause() error {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	if t.state != torrentRunning {
+		return nil
+	}
+	t.state = torrentPaused
+	if err := t.pause(); err != nil {
+		return err
+	}
+	return t.saveResume()
+}
+
+func (t *Torrent) pause() error {
+	t.peersMutex.Lock()
+	r := t.run
+	t.run = nil
+	t.peersMutex.Unlock()
+
+	r.cancel()
+	r.wg.Wait()
+	if f, ok := t.storage.(storageFlusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Stop pauses the torrent for good, it can not be resumed
+func (t *Torrent) Stop() error {
+	// a verify holding stateMutex returns early
+	t.cancel()
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	state := t.state
+	if state == torrentStopped {
+		return nil
+	}
+	t.state = torrentStopped
+	close(t.stopped)
+	var err error
+	if state == torrentRunning {
+		err = t.pause()
+	}
+	// jobs hashing are done, those still queued do nothing
+	t.hashMutex.Lock()
+	t.hashMutex.Unlock()
+	if err2 := t.closeResume(); err == nil {
+		err = err2
+	}
+	if err2 := t.storage.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// startPeers connects to the peers got from trackers
+func (t *Torrent) startPeers(ctx context.Context) {
+	t.startSeenPeers()
+	for {
+		select {
+		case addr := <-t.peersToStart:
+			if t.addPeer(newPeer(t, addr)) {
+				t.seePeer(addr)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// addPeer starts the peer if we are not connected to it, returns false otherwise
+func (t *Torrent) addPeer(p *peer) bool {
+	t.peersMutex.Lock()
+	defer t.peersMutex.Unlock()
+	r := t.run
+	if r == nil || t.peers[p.String()] != nil || len(t.peers) >= t.client.config.MaxPeerCount {
+		return false
+	}
+	if t.client.bans.banned(peerHost(p.Addr)) {
+		return false
+	}
+	if atomic.AddInt32(&t.client.peerCount, 1) > int32(t.client.config.MaxConnections) {
+		atomic.AddInt32(&t.client.peerCount, -1)
+		return false
+	}
+	t.client.config.logf("start peer %s", p.String())
+	t.peers[p.String()] = p
+	p.ctx, p.cancel = context.WithCancel(r.ctx)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		p.run()
+		t.removePeer(p)
+	}()
+	return true
+}
+
+func (t *Torrent) removePeer(p *peer) {
+	t.peersMutex.Lock()
+	defer t.peersMutex.Unlock()
+	if t.peers[p.String()] == p {
+		delete(t.peers, p.String())
+		atomic.AddInt32(&t.client.peerCount, -1)
+	}
+}
+
+// diskError reports a storage error of the torrent to client events, returns err
+func (t *Torrent) diskError(err error) error {
+	t.client.emit(Event{Type: EventTorrentError, Torrent: t, Err: err})
+	return err
+}
+
+// left bytes we don't have yet, the last piece may be short
+func (t *Torrent) left() uint64 {
+	data := t.bitfield.copyData()
+	info := t.Metainfo.Info
+	left := uint64(0)
+	for i := 0; i < info.piecesCount(); i++ {
+		if data[i/8]&(0x80>>uint(i%8)) == 0 {
+			left += uint64(info.pieceSize(i))
+		}
+	}
+	return left
+}
+
+func (t *Torrent) trackerRequest(event uint32) *TrackerRequest {
+	return &TrackerRequest{
+		Event:      event,
+		InfoHash:   t.Metainfo.InfoHash,
+		PeerID:     t.client.peerID,
+		Port:       t.client.port,
+		Uploaded:   uint64(atomic.LoadInt64(&t.transfer.uploaded)),
+		Downloaded: uint64(atomic.LoadInt64(&t.transfer.downloaded)),
+		Left:       t.left(),
+		// Key        uint32
+		NumWant: -1,
+	}
+}
+
+// Trackers announce urls of the torrent
+func (t *Torrent) Trackers() []string {
+	urls, _ := t.trackers.snapshot()
+	return urls
+}
+
+// AddTracker starts announcing to a new tracker
+func (t *Torrent) AddTracker(announce string) error {
+	return t.trackersChanged(t.trackers.add(announce))
+}
+
+// RemoveTracker stops announcing to a tracker
+func (t *Torrent) RemoveTracker(announce string) error {
+	return t.trackersChanged(t.trackers.remove(announce))
+}
+
+// ReplaceTracker use a new announce url instead of old one, e.g. a moved tracker or a new passkey
+func (t *Torrent) ReplaceTracker(old, announce string) error {
+	return t.trackersChanged(t.trackers.replace(old, announce))
+}
+
+// trackersChanged saves trackers in resume data if err is nil, returns err
+func (t *Torrent) trackersChanged(err error) error {
+	if err == nil {
+		t.saveResumeLater()
+	}
+	return err
+}
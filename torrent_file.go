@@ -0,0 +1,149 @@
+package gobt
+
+import "fmt"
+
+// TorrentFile a file of a torrent, a single file torrent has one
+type TorrentFile struct {
+	t          *Torrent
+	index      int
+	Path       string // relative to the directory of data, which is download root unless moved
+	Offset     int64  // in data of the torrent
+	Length     int64
+	FirstPiece int
+	LastPiece  int // less than FirstPiece if the file is empty
+}
+
+// initFiles priorities may be nil for all normal
+func (t *Torrent) initFiles(priorities []PiecePriority) {
+	ranges := fileRanges(t.Metainfo.Info)
+	t.files = make([]*TorrentFile, len(ranges))
+	t.filePriorities = make([]PiecePriority, len(ranges))
+	for i, r := range ranges {
+		first, last := r.pieces(t.Metainfo.Info)
+		t.files[i] = &TorrentFile{t, i, r.path, r.offset, r.length, first, last}
+		t.filePriorities[i] = PriorityNormal
+		if priorities != nil {
+			t.filePriorities[i] = priorities[i]
+		}
+	}
+	if priorities != nil {
+		t.updatePiecePriorities(0, t.Metainfo.Info.piecesCount()-1)
+	}
+}
+
+// Files files of the torrent in order, their paths are of now
+func (t *Torrent) Files() []*TorrentFile {
+	t.filesMutex.Lock()
+	defer t.filesMutex.Unlock()
+	files := make([]*TorrentFile, len(t.files))
+	copy(files, t.files)
+	return files
+}
+
+// SetFilePriority sets the priority of pieces of file index, a piece shared by files is of the highest of them.
+// A file skipped before created is not created, until it is wanted.
+// Files of mmap storage can not be skipped.
+func (t *Torrent) SetFilePriority(index int, priority PiecePriority) error {
+	if index < 0 || index >= len(t.files) {
+		return fmt.Errorf("file index %d out of range", index)
+	}
+	if err := checkPriority(priority); err != nil {
+		return err
+	}
+	if _, ok := t.storage.(*mmapStorage); ok && priority == PrioritySkip {
+		return ErrMmapSkip
+	}
+	t.filesMutex.Lock()
+	defer t.filesMutex.Unlock()
+	s, _ := t.storage.(partStorage)
+	if s != nil && priority != PrioritySkip {
+		// created before its pieces are downloaded
+		if err := s.skipFile(index, false); err != nil {
+			return err
+		}
+	}
+	t.filePriorities[index] = priority
+	f := t.files[index]
+	t.updatePiecePriorities(f.FirstPiece, f.LastPiece)
+	t.saveResumeLater()
+	if s != nil && priority == PrioritySkip {
+		return s.skipFile(index, true)
+	}
+	return nil
+}
+
+// FilePriority the priority of file index
+func (t *Torrent) FilePriority(index int) PiecePriority {
+	t.filesMutex.Lock()
+	defer t.filesMutex.Unlock()
+	return t.filePriorities[index]
+}
+
+// updatePiecePriorities sets priorities of pieces first to last by files, must hold filesMutex or before used
+func (t *Torrent) updatePiecePriorities(first, last int) {
+	if last < first {
+		return
+	}
+	priorities := make([]PiecePriority, last-first+1)
+	for i, f := range t.files {
+		if f.Length == 0 || f.LastPiece < first || f.FirstPiece > last {
+			continue
+		}
+		begin, end := f.FirstPiece, f.LastPiece
+		if begin < first {
+			begin = first
+		}
+		if end > last {
+			end = last
+		}
+		for p := begin; p <= end; p++ {
+			if t.filePriorities[i] > priorities[p-first] {
+				priorities[p-first] = t.filePriorities[i]
+			}
+		}
+	}
+	t.pieces.mu.Lock()
+	defer t.pieces.mu.Unlock()
+	copy(t.pieces.priorities[first:], priorities)
+}
+
+// Index of the file in the torrent
+func (f *TorrentFile) Index() int {
+	return f.index
+}
+
+// Priority of the file
+func (f *TorrentFile) Priority() PiecePriority {
+	return f.t.FilePriority(f.index)
+}
+
+// SetPriority see Torrent.SetFilePriority
+func (f *TorrentFile) SetPriority(priority PiecePriority) error {
+	return f.t.SetFilePriority(f.index, priority)
+}
+
+// BytesCompleted bytes of the file in pieces we have
+func (f *TorrentFile) BytesCompleted() int64 {
+	info := f.t.Metainfo.Info
+	n := int64(0)
+	for p := f.FirstPiece; p <= f.LastPiece; p++ {
+		if f.t.bitfield.Bit(p) == 0 {
+			continue
+		}
+		begin := int64(p) * int64(info.PieceLength)
+		end := begin + int64(info.pieceSize(p))
+		if begin < f.Offset {
+			begin = f.Offset
+		}
+		if end > f.Offset+f.Length {
+			end = f.Offset + f.Length
+		}
+		n += end - begin
+	}
+	return n
+}
+
+// Complete all pieces of the file are verified
+func (f *TorrentFile) Complete() bool {
+	return f.BytesCompleted() == f.Length
+}
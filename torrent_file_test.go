@@ -0,0 +1,125 @@
+package gobt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFilesMetainfo a multi-file torrent of data, files are of lengths in order
+func testFilesMetainfo(name string, data []byte, pieceLength int, paths []string, lengths []int64) *Metainfo {
+	var files []interface{}
+	for i, path := range paths {
+		var list []interface{}
+		for _, p := range strings.Split(path, "/") {
+			list = append(list, []byte(p))
+		}
+		files = append(files, map[string]interface{}{"length": lengths[i], "path": list})
+	}
+	mi, err := NewMetainfoFromMap(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         []byte(name),
+			"piece length": int64(pieceLength),
+			"pieces":       []byte(testMetainfo(name, data, pieceLength).Info.Pieces),
+			"files":        files,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return mi
+}
+
+func TestFilePriorities(t *testing.T) {
+	data := []byte("hello world")
+	mi := testFilesMetainfo("m", data, 4, []string{"x", "empty", "d/y"}, []int64{3, 0, 8})
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.AddTorrentWithOptions(mi, TorrentOptions{FilePriorities: []PiecePriority{PrioritySkip}}); err == nil {
+		t.Errorf("wrong count of priorities accepted")
+	}
+	tt, err := c.AddTorrentWithOptions(mi, TorrentOptions{FilePriorities: []PiecePriority{PrioritySkip, PriorityNormal, PriorityHigh}})
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.DownloadRoot, "m", "x")); !os.IsNotExist(err) {
+		t.Errorf("skipped file created: %v", err)
+	}
+
+	files := tt.Files()
+	if len(files) != 3 || files[2].Path != filepath.Join("m", "d", "y") || files[2].FirstPiece != 0 || files[2].LastPiece != 2 || files[1].LastPiece >= files[1].FirstPiece {
+		t.Fatalf("files %+v %+v %+v", files[0], files[1], files[2])
+	}
+	// piece 0 is shared by x and y
+	for i, p := range []PiecePriority{PriorityHigh, PriorityHigh, PriorityHigh} {
+		if tt.PiecePriority(i) != p {
+			t.Errorf("piece %d priority %s", i, tt.PiecePriority(i))
+		}
+	}
+	if err := files[2].SetPriority(PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+	if tt.PiecePriority(0) != PrioritySkip || tt.PiecePriority(2) != PrioritySkip {
+		t.Errorf("piece priorities %s %s", tt.PiecePriority(0), tt.PiecePriority(2))
+	}
+	if err := tt.SetFilePriority(0, PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	if tt.PiecePriority(0) != PriorityLow || tt.PiecePriority(1) != PrioritySkip {
+		t.Errorf("piece priorities %s %s", tt.PiecePriority(0), tt.PiecePriority(1))
+	}
+	if err := tt.SetFilePriority(3, PriorityLow); err == nil {
+		t.Errorf("file index out of range accepted")
+	}
+
+	tt.bitfield.SetBit(1, 1)
+	tt.bitfield.SetBit(2, 1)
+	if n := files[2].BytesCompleted(); n != 7 || files[2].Complete() || files[0].Complete() || !files[1].Complete() {
+		t.Errorf("completed %d", n)
+	}
+}
+
+func TestPartFile(t *testing.T) {
+	data := []byte("hello world")
+	mi := testFilesMetainfo("m", data, 4, []string{"x", "empty", "d/y"}, []int64{3, 0, 8})
+	root := t.TempDir()
+	s := newFileStorage(mi.Info, root, newFileCache(defaultMaxOpenFiles))
+	defer s.Close()
+	if err := s.allocate(AllocateSparse, []bool{true, false, false}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < mi.Info.piecesCount(); i++ {
+		if _, err := s.WriteAt(i, data[i*4:i*4+mi.Info.pieceSize(i)], 0); err != nil {
+			t.Fatalf("write piece %d error: %v", i, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "m", "x")); !os.IsNotExist(err) {
+		t.Errorf("skipped file created: %v", err)
+	}
+	b, err := readPiece(s, mi.Info, 0)
+	if err != nil || string(b) != "hell" {
+		t.Errorf("read %q %v", b, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(root, "m", "d", "y")); !bytes.Equal(b, data[3:]) {
+		t.Errorf("y is %q", b)
+	}
+
+	if err := s.skipFile(0, false); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(root, "m", "x")); string(b) != "hel" {
+		t.Errorf("x is %q", b)
+	}
+	b, err = readPiece(s, mi.Info, 0)
+	if err != nil || string(b) != "hell" {
+		t.Errorf("read %q %v", b, err)
+	}
+}
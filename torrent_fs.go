@@ -0,0 +1,206 @@
+package gobt
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// torrentFS files of a torrent as a read only file system
+type torrentFS struct {
+	t    *Torrent
+	root *fsNode
+}
+
+// fsNode a file or a directory of torrentFS
+type fsNode struct {
+	name     string
+	file     *TorrentFile // nil for a directory
+	children []*fsNode    // sorted by name
+}
+
+// FS the files of the torrent as a read only file system, without the torrent name in a multi-file torrent.
+// Files renamed are at their new paths.
+// Files are io.ReadSeeker and io.ReaderAt, reads wait for pieces and download them first.
+func (t *Torrent) FS() fs.FS {
+	root := &fsNode{name: "."}
+	multi := len(t.Metainfo.Info.Files) != 0
+	for _, f := range t.Files() {
+		parts := strings.Split(filepath.ToSlash(f.Path), "/")
+		if multi && len(parts) > 1 && parts[0] == t.Metainfo.Info.Name {
+			parts = parts[1:]
+		}
+		n := root
+		for _, p := range parts[:len(parts)-1] {
+			n = n.dir(p)
+		}
+		n.children = append(n.children, &fsNode{name: parts[len(parts)-1], file: f})
+	}
+	root.sort()
+	return &torrentFS{t, root}
+}
+
+// dir the child directory of name, created if not yet
+func (n *fsNode) dir(name string) *fsNode {
+	for _, c := range n.children {
+		if c.name == name && c.file == nil {
+			return c
+		}
+	}
+	c := &fsNode{name: name}
+	n.children = append(n.children, c)
+	return c
+}
+
+func (n *fsNode) sort() {
+	sort.Slice(n.children, func(i, j int) bool {
+		return n.children[i].name < n.children[j].name
+	})
+	for _, c := range n.children {
+		c.sort()
+	}
+}
+
+func (fsys *torrentFS) lookup(op, name string) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n := fsys.root
+	if name == "." {
+		return n, nil
+	}
+	for _, p := range strings.Split(name, "/") {
+		var next *fsNode
+		for _, c := range n.children {
+			if c.name == p {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		n = next
+	}
+	return n, nil
+}
+
+// Open implements fs.FS
+func (fsys *torrentFS) Open(name string) (fs.File, error) {
+	n, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.file == nil {
+		return &fsDir{path: name, node: n}, nil
+	}
+	return &fsFile{n.file.NewReader(), n}, nil
+}
+
+// Stat implements fs.StatFS
+func (fsys *torrentFS) Stat(name string) (fs.FileInfo, error) {
+	n, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsInfo{n}, nil
+}
+
+// ReadDir implements fs.ReadDirFS
+func (fsys *torrentFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.file != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return n.entries(), nil
+}
+
+func (n *fsNode) entries() []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(n.children))
+	for i, c := range n.children {
+		entries[i] = fsInfo{c}
+	}
+	return entries
+}
+
+// fsInfo is fs.FileInfo and fs.DirEntry of a node
+type fsInfo struct {
+	n *fsNode
+}
+
+func (i fsInfo) Name() string { return i.n.name }
+
+func (i fsInfo) Size() int64 {
+	if i.n.file == nil {
+		return 0
+	}
+	return i.n.file.Length
+}
+
+func (i fsInfo) Mode() fs.FileMode {
+	if i.n.file == nil {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i fsInfo) ModTime() time.Time { return time.Time{} }
+
+func (i fsInfo) IsDir() bool { return i.n.file == nil }
+
+func (i fsInfo) Sys() interface{} { return nil }
+
+func (i fsInfo) Type() fs.FileMode { return i.Mode().Type() }
+
+func (i fsInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// fsFile a file opened, reading waits for pieces
+type fsFile struct {
+	*Reader
+	n *fsNode
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return fsInfo{f.n}, nil
+}
+
+// fsDir a directory opened
+type fsDir struct {
+	path string
+	node *fsNode
+	pos  int // entries read
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return fsInfo{d.node}, nil
+}
+
+func (d *fsDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *fsDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries := d.node.entries()[d.pos:]
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(entries) {
+			entries = entries[:count]
+		}
+	}
+	d.pos += len(entries)
+	return entries, nil
+}
@@ -0,0 +1,40 @@
+package gobt
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTorrentFS(t *testing.T) {
+	data := []byte("hello world")
+	mi := testFilesMetainfo("m", data, 4, []string{"x", "empty", "d/y.txt"}, []int64{3, 0, 8})
+	c, tt := testTorrent(t, DefaultClientConfig(), mi)
+	defer c.Close()
+	tt.Pause()
+	for i := 0; i < mi.Info.piecesCount(); i++ {
+		writePiece(t, tt, data, i)
+	}
+	fsys := tt.FS()
+	if err := fstest.TestFS(fsys, "x", "empty", "d/y.txt"); err != nil {
+		t.Errorf("TestFS: %v", err)
+	}
+	b, err := fs.ReadFile(fsys, "d/y.txt")
+	if string(b) != "lo world" || err != nil {
+		t.Errorf("ReadFile %q %v", b, err)
+	}
+	f, _ := fsys.Open("d/y.txt")
+	defer f.Close()
+	f.(io.Seeker).Seek(3, io.SeekStart)
+	if b, _ = ioutil.ReadAll(f); string(b) != "world" {
+		t.Errorf("read after seek %q", b)
+	}
+	if _, err = fsys.Open("m/x"); err == nil {
+		t.Errorf("torrent name is in the path")
+	}
+	if _, err = fs.Stat(fsys, "../x"); err == nil {
+		t.Errorf("invalid path")
+	}
+}
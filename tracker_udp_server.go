@@ -0,0 +1,377 @@
+package gobt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	cryptorand "crypto/rand"
+)
+
+// UDP tracker actions (BEP 15)
+const (
+	actionConnect uint32 = iota
+	actionAnnounce
+	actionScrape
+	actionError
+)
+
+// announce events
+const (
+	eventNone uint32 = iota
+	eventCompleted
+	eventStarted
+	eventStopped
+)
+
+const udpProtocolID uint64 = 0x41727101980 // magic constant
+const udpMaxPacketSize = 1 << 16
+const connectRequestSize = 16
+const announceRequestSize = 98
+const scrapeMaxInfoHashes = 74 // keeps the response inside one packet
+
+// An ID is tied to the minute it was issued and is accepted in that minute and the next two,
+// so it lives 2-3 minutes, as BEP 15 requires.
+const connectionIDEpoch = time.Minute
+
+// UDPTracker a tracker server speaking the UDP tracker protocol
+type UDPTracker struct {
+	Interval    time.Duration // how long clients should wait between announces
+	DefaultWant int           // peers returned when num_want is negative
+	MaxWant     int           // upper bound of peers in one response
+	RateLimit   float64       // requests per second per source IP, 0 for no limit
+	RateBurst   int           // how many requests a source IP may send at once
+
+	conn   *net.UDPConn
+	secret [20]byte
+
+	mu        sync.Mutex
+	swarms    map[hash]*trackerSwarm
+	buckets   map[string]*ipBucket
+	lastSweep time.Time
+}
+
+type trackerSwarm struct {
+	peers     map[string]*trackerPeer // ip:port => peer
+	completed uint32
+}
+
+type trackerPeer struct {
+	IP       net.IP
+	Port     uint16
+	Left     uint64
+	LastSeen time.Time
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewUDPTracker listen on address, call Serve to handle requests
+func NewUDPTracker(address string) (*UDPTracker, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &UDPTracker{
+		Interval:    30 * time.Minute,
+		DefaultWant: 50,
+		MaxWant:     200,
+		RateLimit:   10,
+		RateBurst:   20,
+		conn:        conn,
+		swarms:      make(map[hash]*trackerSwarm),
+		buckets:     make(map[string]*ipBucket),
+	}
+	_, err = cryptorand.Read(s.secret[:])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Addr the local address the tracker listens on
+func (s *UDPTracker) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close stop serving
+func (s *UDPTracker) Close() error {
+	return s.conn.Close()
+}
+
+// Serve handle requests until the tracker is closed
+func (s *UDPTracker) Serve() error {
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		n, raddr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if oe, ok := err.(net.Error); ok && oe.Timeout() {
+				continue
+			}
+			return err
+		}
+		resp := s.handlePacket(buffer[:n], raddr, time.Now())
+		if resp == nil {
+			continue
+		}
+		// lost as if on the way, the client asks again
+		s.conn.WriteToUDP(resp, raddr)
+	}
+}
+
+// handlePacket returns the bytes to send back, nil for nothing
+func (s *UDPTracker) handlePacket(b []byte, raddr *net.UDPAddr, now time.Time) []byte {
+	if len(b) < connectRequestSize {
+		return nil
+	}
+	if !s.allow(raddr.IP, now) {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(b[0:8])
+	action := binary.BigEndian.Uint32(b[8:12])
+	transactionID := binary.BigEndian.Uint32(b[12:16])
+
+	if action == actionConnect {
+		if connectionID != udpProtocolID {
+			return errorResponseBytes(transactionID, "bad protocol id")
+		}
+		return connectResponseBytes(transactionID, s.connectionID(raddr.IP, now.Unix()/int64(connectionIDEpoch/time.Second)))
+	}
+
+	if !s.validConnectionID(connectionID, raddr.IP, now) {
+		return errorResponseBytes(transactionID, "invalid connection id")
+	}
+
+	switch action {
+	case actionAnnounce:
+		_, _, req, err := parseAnnounceRequest(b)
+		if err != nil {
+			return errorResponseBytes(transactionID, err.Error())
+		}
+		return s.announce(transactionID, req, raddr, now)
+	case actionScrape:
+		hashes, err := parseScrapeRequest(b)
+		if err != nil {
+			return errorResponseBytes(transactionID, err.Error())
+		}
+		return s.scrape(transactionID, hashes)
+	}
+	return errorResponseBytes(transactionID, "unknown action")
+}
+
+func (s *UDPTracker) connectionID(ip net.IP, epoch int64) uint64 {
+	h := sha1.New()
+	h.Write(s.secret[:])
+	h.Write(ip.To16())
+	binary.Write(h, binary.BigEndian, epoch)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (s *UDPTracker) validConnectionID(connectionID uint64, ip net.IP, now time.Time) bool {
+	epoch := now.Unix() / int64(connectionIDEpoch/time.Second)
+	for e := epoch; e >= epoch-2; e-- {
+		if connectionID == s.connectionID(ip, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow is a token bucket per source IP
+func (s *UDPTracker) allow(ip net.IP, now time.Time) bool {
+	if s.RateLimit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	key := ip.String()
+	b := s.buckets[key]
+	if b == nil {
+		b = &ipBucket{float64(s.RateBurst), now}
+		s.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.RateLimit
+	if b.tokens > float64(s.RateBurst) {
+		b.tokens = float64(s.RateBurst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (s *UDPTracker) announce(transactionID uint32, req *TrackerRequest, raddr *net.UDPAddr, now time.Time) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw := s.swarms[req.InfoHash]
+	if sw == nil {
+		sw = &trackerSwarm{peers: make(map[string]*trackerPeer)}
+		s.swarms[req.InfoHash] = sw
+	}
+	for k, p := range sw.peers {
+		if now.Sub(p.LastSeen) > 2*s.Interval {
+			delete(sw.peers, k)
+		}
+	}
+
+	self := &trackerPeer{raddr.IP, req.Port, req.Left, now}
+	key := ipPort6String(self.IP, self.Port)
+	switch req.Event {
+	case eventStopped:
+		delete(sw.peers, key)
+	case eventCompleted:
+		sw.completed++
+		sw.peers[key] = self
+	default:
+		sw.peers[key] = self
+	}
+
+	want := int(req.NumWant)
+	if want < 0 {
+		want = s.DefaultWant
+	}
+	if want > s.MaxWant {
+		want = s.MaxWant
+	}
+	isV4 := raddr.IP.To4() != nil
+	var seeders, leechers uint32
+	list := make([]*trackerPeer, 0, want)
+	for k, p := range sw.peers {
+		if p.Left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+		if k == key || len(list) >= want || (p.IP.To4() != nil) != isV4 {
+			continue
+		}
+		list = append(list, p)
+	}
+
+	buf := new(bytes.Buffer)
+	writeIntegers(buf, actionAnnounce, transactionID, uint32(s.Interval/time.Second), leechers, seeders)
+	for _, p := range list {
+		if isV4 {
+			buf.Write(p.IP.To4())
+		} else {
+			buf.Write(p.IP.To16())
+		}
+		writeInteger(buf, p.Port)
+	}
+	return buf.Bytes()
+}
+
+func (s *UDPTracker) scrape(transactionID uint32, hashes []hash) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	writeIntegers(buf, actionScrape, transactionID)
+	for _, h := range hashes {
+		var seeders, completed, leechers uint32
+		if sw := s.swarms[h]; sw != nil {
+			completed = sw.completed
+			for _, p := range sw.peers {
+				if p.Left == 0 {
+					seeders++
+				} else {
+					leechers++
+				}
+			}
+		}
+		writeIntegers(buf, seeders, completed, leechers)
+	}
+	return buf.Bytes()
+}
+
+func ipPort6String(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), fmt.Sprint(port))
+}
+
+func connectResponseBytes(transactionID uint32, connectionID uint64) []byte {
+	buf := new(bytes.Buffer)
+	writeIntegers(buf, actionConnect, transactionID, connectionID)
+	return buf.Bytes()
+}
+
+func errorResponseBytes(transactionID uint32, message string) []byte {
+	buf := new(bytes.Buffer)
+	writeIntegers(buf, actionError, transactionID)
+	buf.WriteString(message)
+	return buf.Bytes()
+}
+
+// parseAnnounceRequest reads the layout written by announceRequestBytes
+func parseAnnounceRequest(b []byte) (connectionID uint64, transactionID uint32, req *TrackerRequest, err error) {
+	if len(b) < announceRequestSize {
+		return 0, 0, nil, errors.New("announce request too short")
+	}
+	buf := bytes.NewReader(b)
+	var action uint32
+	req = new(TrackerRequest)
+	fields := []interface{}{
+		&connectionID,
+		&action,
+		&transactionID,
+		&req.InfoHash,
+		&req.PeerID,
+		&req.Downloaded,
+		&req.Left,
+		&req.Uploaded,
+		&req.Event,
+		&req.IP,
+		&req.Key,
+		&req.NumWant,
+		&req.Port,
+	}
+	for _, f := range fields {
+		err = binary.Read(buf, binary.BigEndian, f)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	if action != actionAnnounce {
+		return 0, 0, nil, errors.New("action not announce")
+	}
+	return connectionID, transactionID, req, nil
+}
+
+func parseScrapeRequest(b []byte) ([]hash, error) {
+	b = b[connectRequestSize:]
+	if len(b) == 0 || len(b)%hashSize != 0 {
+		return nil, errors.New("scrape info hashes length error")
+	}
+	if len(b)/hashSize > scrapeMaxInfoHashes {
+		return nil, errors.New("too many info hashes")
+	}
+	hashes := make([]hash, len(b)/hashSize)
+	for i := range hashes {
+		copy(hashes[i][:], b[i*hashSize:])
+	}
+	return hashes, nil
+}
@@ -0,0 +1,192 @@
+package gobt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func startUDPTracker(t *testing.T) *UDPTracker {
+	s, err := NewUDPTracker("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	go s.Serve()
+	return s
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	s := startUDPTracker(t)
+	defer s.Close()
+
+	var h hash
+	copy(h[:], "0123456789abcdefghij")
+	seed := &TrackerRequest{InfoHash: h, Port: 6881, Left: 0, Event: eventStarted, NumWant: -1}
+	resp, err := udpTracker(context.Background(), s.Addr().String(), seed, time.Second)
+	if err != nil {
+		t.Fatalf("announce error: %v", err)
+	}
+	if resp.Seeders != 1 || resp.Leechers != 0 || len(resp.IPPort) != 0 {
+		t.Errorf("first announce got %+v", resp)
+	}
+	if resp.Interval != uint32(s.Interval/time.Second) {
+		t.Errorf("interval %d", resp.Interval)
+	}
+
+	leech := &TrackerRequest{InfoHash: h, Port: 6882, Left: 100, Event: eventStarted, NumWant: -1}
+	resp, err = udpTracker(context.Background(), s.Addr().String(), leech, time.Second)
+	if err != nil {
+		t.Fatalf("announce error: %v", err)
+	}
+	if resp.Seeders != 1 || resp.Leechers != 1 {
+		t.Errorf("second announce got %+v", resp)
+	}
+	if len(resp.IPPort) != 1 || resp.IPPort[0].String() != "127.0.0.1:6881" {
+		t.Errorf("peers %v", resp.IPPort)
+	}
+}
+
+func TestUDPTrackerConnectionID(t *testing.T) {
+	s, err := NewUDPTracker("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer s.Close()
+	s.RateLimit = 0
+
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	now := time.Now()
+	b, _ := connectRequestBytes(7)
+	resp := s.handlePacket(b, addr, now)
+	if len(resp) != 16 || binary.BigEndian.Uint32(resp) != actionConnect {
+		t.Fatalf("connect response %x", resp)
+	}
+	connectionID := binary.BigEndian.Uint64(resp[8:])
+
+	req := &TrackerRequest{NumWant: -1}
+	b, _ = announceRequestBytes(8, connectionID, req)
+	if len(b) != announceRequestSize {
+		t.Errorf("announce request size %d", len(b))
+	}
+	resp = s.handlePacket(b, addr, now.Add(2*time.Minute))
+	if binary.BigEndian.Uint32(resp) != actionAnnounce {
+		t.Errorf("valid connection id refused: %s", resp[8:])
+	}
+
+	resp = s.handlePacket(b, addr, now.Add(3*time.Minute))
+	if binary.BigEndian.Uint32(resp) != actionError {
+		t.Errorf("expired connection id accepted")
+	}
+
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}
+	resp = s.handlePacket(b, other, now)
+	if binary.BigEndian.Uint32(resp) != actionError {
+		t.Errorf("connection id of other ip accepted")
+	}
+}
+
+func TestUDPTrackerWant(t *testing.T) {
+	s, err := NewUDPTracker("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer s.Close()
+	s.DefaultWant, s.MaxWant = 2, 3
+	now := time.Now()
+
+	var h hash
+	peers := func(want int32) int {
+		req := &TrackerRequest{InfoHash: h, Port: 1000, Left: 10, NumWant: want}
+		// 20 bytes header, IPv4 peers of 6 bytes
+		return (len(s.announce(1, req, &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}, now)) - 20) / 6
+	}
+	for i := 0; i < 5; i++ {
+		req := &TrackerRequest{InfoHash: h, Port: uint16(2000 + i), Left: 10}
+		s.announce(1, req, &net.UDPAddr{IP: net.ParseIP("10.0.0.2")}, now)
+	}
+	if n := peers(-1); n != 2 {
+		t.Errorf("default want got %d peers", n)
+	}
+	if n := peers(1); n != 1 {
+		t.Errorf("want 1 got %d peers", n)
+	}
+	if n := peers(10); n != 3 {
+		t.Errorf("want 10 got %d peers, max 3", n)
+	}
+}
+
+func TestUDPTrackerIPv6AndScrape(t *testing.T) {
+	s, err := NewUDPTracker("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer s.Close()
+	s.RateLimit = 0
+	now := time.Now()
+
+	var h hash
+	copy(h[:], "0123456789abcdefghij")
+	announce := func(addr *net.UDPAddr, left uint64, event uint32) []byte {
+		b, _ := connectRequestBytes(1)
+		connectionID := binary.BigEndian.Uint64(s.handlePacket(b, addr, now)[8:])
+		req := &TrackerRequest{InfoHash: h, Port: uint16(addr.Port), Left: left, Event: event, NumWant: -1}
+		b, _ = announceRequestBytes(2, connectionID, req)
+		return s.handlePacket(b, addr, now)
+	}
+	a := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000}
+	b := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2000}
+	c := &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 3000}
+	announce(a, 0, eventCompleted)
+	announce(c, 10, eventStarted)
+	resp := announce(b, 10, eventStarted)
+	// 20 bytes header, one IPv6 peer of 18 bytes
+	if len(resp) != 20+18 {
+		t.Fatalf("ipv6 announce response length %d", len(resp))
+	}
+	if !net.IP(resp[20:36]).Equal(a.IP) || binary.BigEndian.Uint16(resp[36:]) != 1000 {
+		t.Errorf("ipv6 peer %x", resp[20:])
+	}
+
+	conn, _ := connectRequestBytes(3)
+	connectionID := binary.BigEndian.Uint64(s.handlePacket(conn, a, now)[8:])
+	buf := new(bytes.Buffer)
+	writeIntegers(buf, connectionID, actionScrape, uint32(4), h)
+	resp = s.handlePacket(buf.Bytes(), a, now)
+	if len(resp) != 8+12 {
+		t.Fatalf("scrape response length %d", len(resp))
+	}
+	seeders := binary.BigEndian.Uint32(resp[8:])
+	completed := binary.BigEndian.Uint32(resp[12:])
+	leechers := binary.BigEndian.Uint32(resp[16:])
+	if seeders != 1 || completed != 1 || leechers != 2 {
+		t.Errorf("scrape got %d %d %d", seeders, completed, leechers)
+	}
+}
+
+func TestUDPTrackerRateLimit(t *testing.T) {
+	s, err := NewUDPTracker("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer s.Close()
+	s.RateLimit = 1
+	s.RateBurst = 2
+
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	now := time.Now()
+	b, _ := connectRequestBytes(1)
+	for i := 0; i < 2; i++ {
+		if s.handlePacket(b, addr, now) == nil {
+			t.Errorf("request %d limited", i)
+		}
+	}
+	if s.handlePacket(b, addr, now) != nil {
+		t.Errorf("burst not limited")
+	}
+	if s.handlePacket(b, addr, now.Add(time.Second)) == nil {
+		t.Errorf("not refilled")
+	}
+}
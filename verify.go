@@ -0,0 +1,254 @@
+package gobt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// VerifyProgress is called after every piece is checked
+type VerifyProgress func(checked, total int)
+
+// VerifyReport what Verify found on disk
+type VerifyReport struct {
+	Pieces int // pieces of the torrent
+	Have   int // pieces of right hash
+	Files  []FileState
+}
+
+// FileState what Verify found of a file
+type FileState struct {
+	Path     string // relative to the directory of data
+	Length   int64
+	Missing  bool // not on disk, or shorter than it should be
+	Complete bool // all pieces of it are right
+	Corrupt  bool // a piece of it has data written but a wrong hash
+}
+
+// fileRange where a file is in the data of a torrent
+type fileRange struct {
+	path   string // relative to download root, or the directory of data if moved
+	offset int64
+	length int64
+}
+
+func fileRanges(info *MetainfoInfo) []fileRange {
+	if len(info.Files) == 0 {
+		return []fileRange{{info.Name, 0, info.Length}}
+	}
+	ranges := make([]fileRange, len(info.Files))
+	offset := int64(0)
+	for i, f := range info.Files {
+		ranges[i] = fileRange{filepath.Join(append([]string{info.Name}, f.Path...)...), offset, f.Length}
+		offset += f.Length
+	}
+	return ranges
+}
+
+// pieces the first and the last piece of the file, last < first if it is empty
+func (r fileRange) pieces(info *MetainfoInfo) (first, last int) {
+	first = int(r.offset / int64(info.PieceLength))
+	last = int((r.offset + r.length - 1) / int64(info.PieceLength))
+	if r.length == 0 {
+		last = first - 1
+	}
+	return first, last
+}
+
+// pieceResult hash check of a piece
+type pieceResult struct {
+	index   int
+	ok      bool
+	corrupt bool // not ok, and not all zero as never written
+	err     error
+}
+
+// verifyPieces hashes every piece with workers goroutines
+func verifyPieces(ctx context.Context, info *MetainfoInfo, s Storage, workers int, progress VerifyProgress) (ok, corrupt []bool, err error) {
+	count := info.piecesCount()
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan int)
+	results := make(chan pieceResult)
+	go func() {
+		defer close(jobs)
+		for i := 0; i < count; i++ {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				r := hashPiece(ctx, info, s, i)
+				select {
+				case results <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	ok = make([]bool, count)
+	corrupt = make([]bool, count)
+	for checked := 1; checked <= count; checked++ {
+		var r pieceResult
+		select {
+		case r = <-results:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		ok[r.index] = r.ok
+		corrupt[r.index] = r.corrupt
+		if progress != nil {
+			progress(checked, count)
+		}
+	}
+	return ok, corrupt, nil
+}
+
+func hashPiece(ctx context.Context, info *MetainfoInfo, s Storage, index int) pieceResult {
+	if err := ctx.Err(); err != nil {
+		return pieceResult{index: index, err: err}
+	}
+	b, err := readPiece(s, info, index)
+	if os.IsNotExist(err) {
+		return pieceResult{index: index}
+	}
+	if err != nil {
+		return pieceResult{index: index, err: err}
+	}
+	sum := sha1.Sum(b)
+	if bytes.Equal(sum[:], info.Pieces[index*hashSize:(index+1)*hashSize]) {
+		return pieceResult{index: index, ok: true}
+	}
+	for _, c := range b {
+		if c != 0 {
+			return pieceResult{index: index, corrupt: true}
+		}
+	}
+	return pieceResult{index: index}
+}
+
+// verifyData checks all data of a torrent, returns the bitfield of pieces of right hash
+func verifyData(ctx context.Context, info *MetainfoInfo, s Storage, workers int, progress VerifyProgress) (*bitfield, *VerifyReport, error) {
+	ok, corrupt, err := verifyPieces(ctx, info, s, workers, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+	bf := allZeroBitField(info.piecesCount())
+	report := &VerifyReport{Pieces: info.piecesCount()}
+	for i, v := range ok {
+		if v {
+			bf.SetBit(i, 1)
+			report.Have++
+		}
+	}
+	root, files := "", fileRanges(info)
+	fs, inFiles := s.(*fileStorage)
+	if inFiles {
+		root, files = fs.layout()
+	}
+	for _, r := range files {
+		f := FileState{Path: r.path, Length: r.length, Complete: true}
+		if inFiles {
+			st, err := os.Stat(filepath.Join(root, r.path))
+			f.Missing = err != nil || st.Size() < r.length
+		}
+		first, last := r.pieces(info)
+		for i := first; i <= last; i++ {
+			f.Complete = f.Complete && ok[i]
+			f.Corrupt = f.Corrupt || corrupt[i]
+		}
+		f.Complete = f.Complete && !f.Missing
+		report.Files = append(report.Files, f)
+	}
+	return bf, report, nil
+}
+
+// VerifyData hashes all pieces of a torrent in root, and rebuilds the pieces in its resume data.
+// Other resume data is kept if valid, data moved or renamed is found by it.
+func VerifyData(mi *Metainfo, root string, progress VerifyProgress) (*VerifyReport, error) {
+	filename := mi.Info.resumeFilename(root)
+	r, err := readResumeData(filename, mi)
+	if err != nil {
+		r = &resumeData{infoHash: mi.InfoHash}
+	}
+	// files are not created
+	s := newFileStorage(mi.Info, root, newFileCache(defaultMaxOpenFiles))
+	defer s.Close()
+	if r.root != "" {
+		s.relocate(r.root, r.paths)
+	}
+	bf, report, err := verifyData(context.Background(), mi.Info, s, runtime.NumCPU(), progress)
+	if err != nil {
+		return nil, err
+	}
+	dataRoot, files := s.layout()
+	r.bitfield = bf.copyData()
+	r.partial = nil
+	r.files = statFiles(dataRoot, files)
+	return report, writeResumeData(filename, r)
+}
+
+// Verify pauses the torrent and hashes all pieces, pieces we have are those of right hash.
+// The torrent is resumed after if it was running.
+func (t *Torrent) Verify(progress VerifyProgress) (*VerifyReport, error) {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	switch t.state {
+	case torrentStopped:
+		return nil, errTorrentStopped
+	case torrentRunning:
+		err := t.pause()
+		if err != nil {
+			return nil, err
+		}
+		defer t.resume()
+	}
+	return t.verify(progress)
+}
+
+// verify must hold stateMutex, the torrent is not running
+func (t *Torrent) verify(progress VerifyProgress) (*VerifyReport, error) {
+	info := t.Metainfo.Info
+	bf, report, err := verifyData(t.ctx, info, t.storage, t.client.config.HashWorkers, progress)
+	if err != nil {
+		return nil, err
+	}
+	t.bitfield.SetBitData(bf.copyData())
+	for i := 0; i < info.piecesCount(); i++ {
+		t.resetPiece(i)
+	}
+	t.havePiece()
+	return report, t.saveResume()
+}
+
+// verifyAndResume runs with stateMutex held, and unlocks it
+func (t *Torrent) verifyAndResume() {
+	defer t.stateMutex.Unlock()
+	_, err := t.verify(nil)
+	if t.ctx.Err() != nil {
+		// being stopped
+		return
+	}
+	if err != nil {
+		t.diskError(err)
+	}
+	if t.state == torrentPaused {
+		t.resume()
+	}
+}
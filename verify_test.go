@@ -0,0 +1,180 @@
+package gobt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyData(t *testing.T) {
+	mi := testMetainfo("a", []byte("hello world"), 4)
+	root := t.TempDir()
+	ioutil.WriteFile(filepath.Join(root, "a"), []byte("hello wXrld"), 0664)
+	calls := 0
+	report, err := VerifyData(mi, root, func(checked, total int) {
+		calls++
+		if checked != calls || total != 3 {
+			t.Errorf("progress %d/%d", checked, total)
+		}
+	})
+	if err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+	if report.Have != 2 || len(report.Files) != 1 || !report.Files[0].Corrupt || report.Files[0].Complete || calls != 3 {
+		t.Errorf("report %+v", report)
+	}
+	r, err := readResumeData(mi.Info.resumeFilename(root), mi)
+	if err != nil || r.bitfield[0] != 0xa0 {
+		t.Errorf("resume data %v %v", r, err)
+	}
+
+	// a file missing and a file complete
+	info, _ := NewMetainfoInfoFromMap(map[string]interface{}{
+		"name":         []byte("m"),
+		"piece length": int64(4),
+		"pieces":       []byte(mi.Info.Pieces),
+		"files": []interface{}{
+			map[string]interface{}{"length": int64(4), "path": []interface{}{[]byte("x")}},
+			map[string]interface{}{"length": int64(7), "path": []interface{}{[]byte("y")}},
+		},
+	})
+	os.Mkdir(filepath.Join(root, "m"), 0775)
+	ioutil.WriteFile(filepath.Join(root, "m", "x"), []byte("hell"), 0664)
+	_, report, err = verifyData(context.Background(), info, newFileStorage(info, root, newFileCache(1)), 2, nil)
+	if err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+	x, y := report.Files[0], report.Files[1]
+	if !x.Complete || x.Missing || !y.Missing || y.Corrupt || y.Path != filepath.Join("m", "y") {
+		t.Errorf("files %+v", report.Files)
+	}
+}
+
+func TestTorrentVerify(t *testing.T) {
+	data := []byte("hello world")
+	c, tt := testTorrent(t, DefaultClientConfig(), testMetainfo("a", data, 4))
+	defer c.Close()
+	ioutil.WriteFile(filepath.Join(tt.root, "a"), data, 0664)
+	report, err := tt.Verify(nil)
+	if err != nil || report.Have != 3 || !report.Files[0].Complete {
+		t.Fatalf("report %+v %v", report, err)
+	}
+	if tt.left() != 0 {
+		t.Errorf("left %d", tt.left())
+	}
+	// only the short last piece is missing
+	tt.bitfield.SetBit(2, 0)
+	if tt.left() != 3 {
+		t.Errorf("left %d without the last piece", tt.left())
+	}
+	tt.bitfield.SetBit(0, 0)
+	if tt.left() != 7 {
+		t.Errorf("left %d without the first and last pieces", tt.left())
+	}
+}
+
+func TestAutoVerify(t *testing.T) {
+	mi := testMetainfo("a", []byte("hello world"), 4)
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	// all pieces are said to be there, but the file is short
+	filename := filepath.Join(config.DownloadRoot, "a")
+	ioutil.WriteFile(filename, []byte("hello world"), 0664)
+	r := &resumeData{infoHash: mi.InfoHash, bitfield: []byte{0xe0}, files: statFiles(config.DownloadRoot, fileRanges(mi.Info))}
+	writeResumeData(mi.Info.resumeFilename(config.DownloadRoot), r)
+	os.Truncate(filename, 5)
+	if reason := r.check(mi.Info, config.DownloadRoot, fileRanges(mi.Info)); reason == "" {
+		t.Errorf("short file not found")
+	}
+
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	tt, err := c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	// waits for verify
+	tt.Pause()
+	if tt.bitfield.Bit(0) != 1 || tt.bitfield.Bit(1) != 0 || tt.bitfield.Bit(2) != 0 {
+		t.Errorf("bitfield %x", tt.bitfield.copyData())
+	}
+	r, err = readResumeData(mi.Info.resumeFilename(config.DownloadRoot), mi)
+	if err != nil {
+		t.Fatalf("read resume data error: %v", err)
+	}
+	if reason := r.check(mi.Info, config.DownloadRoot, fileRanges(mi.Info)); reason != "" {
+		t.Errorf("after verify %s", reason)
+	}
+}
+
+func TestResumeMismatchNoVerify(t *testing.T) {
+	mi := testMetainfo("a", []byte("hello world"), 4)
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	config.AutoVerify = false
+	filename := filepath.Join(config.DownloadRoot, "a")
+	ioutil.WriteFile(filename, []byte("hello world"), 0664)
+	r := &resumeData{infoHash: mi.InfoHash, bitfield: []byte{0xe0}, files: statFiles(config.DownloadRoot, fileRanges(mi.Info))}
+	writeResumeData(mi.Info.resumeFilename(config.DownloadRoot), r)
+	os.Truncate(filename, 5)
+
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	tt, err := c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	// pieces of resume data not matching the files are not served
+	if tt.bitfield.copyData()[0] != 0 {
+		t.Errorf("bitfield %x", tt.bitfield.copyData())
+	}
+}
+
+// slowStorage reads slowly, so a verify takes long
+type slowStorage struct {
+	Storage
+}
+
+func (s slowStorage) ReadAt(index int, b []byte, off int64) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.Storage.ReadAt(index, b, off)
+}
+
+func TestStopVerify(t *testing.T) {
+	data := make([]byte, 4000)
+	mi := testMetainfo("a", data, 4)
+	config := DefaultClientConfig()
+	config.DownloadRoot = t.TempDir()
+	config.HashWorkers = 1
+	ioutil.WriteFile(filepath.Join(config.DownloadRoot, "a"), data, 0664)
+	ioutil.WriteFile(mi.Info.resumeFilename(config.DownloadRoot), []byte("d7:version"), 0664)
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("new client error: %v", err)
+	}
+	defer c.Close()
+	c.SetStorage(func(info *MetainfoInfo, root string) (Storage, error) {
+		return slowStorage{newFileStorage(info, root, newFileCache(1))}, nil
+	})
+	// verified as resume data is bad, 1000 pieces take 10 seconds
+	tt, err := c.AddTorrent(mi)
+	if err != nil {
+		t.Fatalf("add torrent error: %v", err)
+	}
+	start := time.Now()
+	if err := tt.Stop(); err != nil {
+		t.Errorf("stop error: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("stopped after %v", d)
+	}
+}